@@ -0,0 +1,105 @@
+package address
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/m-lab/pipe.v3"
+)
+
+// Counters are the packets and bytes accepted by the rules granted to a subnet.
+type Counters struct {
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// Sub returns the difference between c and prev, e.g. the traffic accepted
+// between two reads of the same grant.
+func (c Counters) Sub(prev Counters) Counters {
+	return Counters{Packets: c.Packets - prev.Packets, Bytes: c.Bytes - prev.Bytes}
+}
+
+// Counters reads the packet and byte counters of the rules granted to the
+// subnet containing ip for the same ports. Counters must be read before Revoke
+// removes the rules. When several grants share a subnet and ports, their
+// counters are combined.
+func (r *IPManager) Counters(ip net.IP, ports ...string) (Counters, error) {
+	save, subnet := r.saveForIP(ip)
+	out, err := pipe.OutputTimeout(pipe.Exec(save, "--counters", "--table=filter"), 10*time.Second)
+	if err != nil {
+		return Counters{}, err
+	}
+	return parseCounters(out, grantRules(subnet, ports))
+}
+
+// Counters returns zero counters for the given ip.
+func (r *NullManager) Counters(ip net.IP, ports ...string) (Counters, error) {
+	return Counters{}, nil
+}
+
+// saveForIP returns the iptables-save command and the granted subnet for ip,
+// formatted as iptables-save reports rule sources.
+func (r *IPManager) saveForIP(ip net.IP) (string, string) {
+	if ip.To4() != nil {
+		return r.cmds.IPTablesSave, Subnet(ip).String()
+	}
+	return r.cmds.IP6TablesSave, Subnet(ip).String()
+}
+
+// grantRules returns the rules a grant to the subnet and ports installs, as
+// iptables-save reports them. The rules accepting HTTP ports from any source
+// are shared by all grants, so they are not included.
+func grantRules(subnet string, ports []string) map[string]bool {
+	if len(ports) == 0 {
+		return map[string]bool{"-A INPUT -s " + subnet + " -j ACCEPT": true}
+	}
+	rules := map[string]bool{}
+	for _, proto := range []string{"tcp", "udp"} {
+		rule := "-A INPUT -s " + subnet + " -p " + proto + " -m multiport --dports " +
+			strings.Join(ports, ",") + " -j ACCEPT"
+		rules[rule] = true
+	}
+	return rules
+}
+
+// parseCounters sums the counters of the given rules from iptables-save
+// --counters output, e.g.:
+//
+//	[12:3456] -A INPUT -s 192.0.2.0/24 -j ACCEPT
+func parseCounters(out []byte, rules map[string]bool) (Counters, error) {
+	total := Counters{}
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		line := s.Text()
+		if !strings.HasPrefix(line, "[") {
+			continue
+		}
+		end := strings.Index(line, "]")
+		if end < 0 {
+			return Counters{}, fmt.Errorf("malformed counters: %q", line)
+		}
+		if !rules[strings.Join(strings.Fields(line[end+1:]), " ")] {
+			continue
+		}
+		values := strings.Split(line[1:end], ":")
+		if len(values) != 2 {
+			return Counters{}, fmt.Errorf("malformed counters: %q", line)
+		}
+		packets, err := strconv.ParseUint(values[0], 10, 64)
+		if err != nil {
+			return Counters{}, err
+		}
+		bytes, err := strconv.ParseUint(values[1], 10, 64)
+		if err != nil {
+			return Counters{}, err
+		}
+		total.Packets += packets
+		total.Bytes += bytes
+	}
+	return total, s.Err()
+}
@@ -0,0 +1,146 @@
+package address
+
+import (
+	"net"
+	"testing"
+
+	"github.com/m-lab/go/osx"
+)
+
+func TestIPManager_Counters(t *testing.T) {
+	tests := []struct {
+		name     string
+		ip       string
+		ports    []string
+		saveExit string
+		want     Counters
+		wantErr  bool
+	}{
+		{
+			name:     "success-ipv4-port-rules",
+			ip:       "127.0.0.1",
+			ports:    []string{"3001:3010"},
+			saveExit: "0",
+			want:     Counters{Packets: 15, Bytes: 1500},
+		},
+		{
+			name:     "success-ipv4-without-ports",
+			ip:       "127.0.0.1",
+			saveExit: "0",
+			want:     Counters{Packets: 4, Bytes: 400},
+		},
+		{
+			name:     "success-ipv4-other-ports",
+			ip:       "127.0.0.1",
+			ports:    []string{"5001"},
+			saveExit: "0",
+			want:     Counters{},
+		},
+		{
+			name:     "success-ipv6",
+			ip:       "2002::1",
+			saveExit: "0",
+			want:     Counters{Packets: 7, Bytes: 700},
+		},
+		{
+			name:     "success-no-rules",
+			ip:       "198.51.100.1",
+			saveExit: "0",
+			want:     Counters{},
+		},
+		{
+			name:     "error-save-failure",
+			ip:       "127.0.0.1",
+			saveExit: "1",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer osx.MustSetenv("IPTABLES_SAVE_EXIT", tt.saveExit)()
+
+			r := NewIPManager(1, Commands{
+				IPTablesSave:  "./testdata/iptables-save-counters",
+				IP6TablesSave: "./testdata/iptables-save-counters",
+			})
+			got, err := r.Counters(net.ParseIP(tt.ip), tt.ports...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("IPManager.Counters() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("IPManager.Counters() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseCounters(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		ports   []string
+		want    Counters
+		wantErr bool
+	}{
+		{
+			name: "success-ignores-other-chains-and-targets",
+			out: "[1:10] -A OUTPUT -s 192.0.2.0/24 -j ACCEPT\n" +
+				"[2:20] -A INPUT -s 192.0.2.0/24 -j REJECT\n" +
+				"[3:30] -A INPUT -s 192.0.2.0/24 -j ACCEPT\n",
+			want: Counters{Packets: 3, Bytes: 30},
+		},
+		{
+			name: "success-only-granted-ports",
+			out: "[1:10] -A INPUT -s 192.0.2.0/24 -j ACCEPT\n" +
+				"[2:20] -A INPUT -s 192.0.2.0/24 -p tcp -m multiport --dports 443 -j ACCEPT\n" +
+				"[3:30] -A INPUT -s 192.0.2.0/24 -p tcp -m multiport --dports 3001:3010,443 -j ACCEPT\n" +
+				"[4:40] -A INPUT -s 192.0.2.0/24 -p udp -m multiport --dports 3001:3010,443 -j ACCEPT\n",
+			ports: []string{"3001:3010", "443"},
+			want:  Counters{Packets: 7, Bytes: 70},
+		},
+		{
+			name: "success-ignores-other-rules-with-subnet",
+			out: "[1:10] -A INPUT -s 192.0.2.0/24 -p tcp -j ACCEPT\n" +
+				"[2:20] -A INPUT -i eth0 -s 192.0.2.0/24 -j ACCEPT\n",
+			want: Counters{},
+		},
+		{
+			name:    "error-missing-bracket",
+			out:     "[3:30 -A INPUT -s 192.0.2.0/24 -j ACCEPT\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-missing-bytes",
+			out:     "[3] -A INPUT -s 192.0.2.0/24 -j ACCEPT\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-bad-packets",
+			out:     "[x:30] -A INPUT -s 192.0.2.0/24 -j ACCEPT\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-bad-bytes",
+			out:     "[3:x] -A INPUT -s 192.0.2.0/24 -j ACCEPT\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCounters([]byte(tt.out), grantRules("192.0.2.0/24", tt.ports))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCounters() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseCounters() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCounters_Sub(t *testing.T) {
+	got := Counters{Packets: 10, Bytes: 1000}.Sub(Counters{Packets: 4, Bytes: 400})
+	if got != (Counters{Packets: 6, Bytes: 600}) {
+		t.Errorf("Counters.Sub() = %#v, want {6 600}", got)
+	}
+}
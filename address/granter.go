@@ -3,10 +3,18 @@
 package address
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net"
+	"strconv"
+	"strings"
 	"time"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/semaphore"
 
 	"gopkg.in/m-lab/pipe.v3"
@@ -15,14 +23,15 @@ import (
 // Manager manages access to a device by IP and port.
 type Manager interface {
 	Start(port, device string) error
-	Grant(ip net.IP) error
-	Revoke(ip net.IP) error
+	Grant(ip net.IP, ports ...string) error
+	Revoke(ip net.IP, ports ...string) error
 	Stop() ([]byte, error)
 }
 
 // IPManager supports granting IP subnet access using iptables or ip6tables.
 type IPManager struct {
 	*semaphore.Weighted
+	cmds       Commands
 	origRules4 []byte
 	origRules6 []byte
 }
@@ -30,19 +39,38 @@ type IPManager struct {
 // ErrMaxConcurrent is returned when the max concurrent grants has already been reached.
 var ErrMaxConcurrent = errors.New("max concurrent reached")
 
+// ErrInvalidPorts is returned when a port list cannot be used in a grant rule.
+var ErrInvalidPorts = errors.New("invalid ports")
+
+// maxPorts is the number of ports accepted by the iptables multiport match. A
+// port range counts as two ports.
+const maxPorts = 15
+
 // NewIPManager creates a new instance that will allow granting up to max IP subnets
 // concurrently. Due to overhead in iptable processing and the impact that could
-// have on measurements, max should be small.
-func NewIPManager(max int64) *IPManager {
+// have on measurements, max should be small. The IPManager runs the given
+// iptables commands; empty commands use the DefaultCommands.
+func NewIPManager(max int64, cmds Commands) *IPManager {
 	return &IPManager{
 		Weighted: semaphore.NewWeighted(max),
+		cmds:     cmds.withDefaults(),
 	}
 }
 
 // Grant adds an iptables/ip6tables rule to allow packets from a subnet
-// containing the given IP on the INPUT chain. On success, the caller must call
-// Revoke to allow a new Grants in the future.
-func (r *IPManager) Grant(ip net.IP) error {
+// containing the given IP on the INPUT chain. When ports are given, only TCP
+// and UDP packets to those destination ports are allowed. On success, the
+// caller must call Revoke with the same ports to allow a new Grants in the
+// future.
+func (r *IPManager) Grant(ip net.IP, ports ...string) error {
+	return r.GrantContext(context.Background(), ip, ports...)
+}
+
+// GrantContext is like Grant, and records the iptables commands in a span that
+// is a child of any span in ctx.
+func (r *IPManager) GrantContext(ctx context.Context, ip net.IP, ports ...string) (err error) {
+	_, span := startSpan(ctx, "address.grant", ip, ports)
+	defer func() { endSpan(span, err) }()
 	if !r.TryAcquire(1) {
 		return ErrMaxConcurrent
 	}
@@ -50,8 +78,8 @@ func (r *IPManager) Grant(ip net.IP) error {
 	// Note: use 'insert' (rather than 'append') to place the new rule first, to
 	// a) cooperate with the rules in the environment, b) minimize the time a packet
 	// stays in the chain handling logic.
-	addRule := pipe.Script("Add rules to allow "+ip.String(), ipTable("insert", ip))
-	err := pipe.RunTimeout(addRule, 10*time.Second)
+	addRule := pipe.Script("Add rules to allow "+ip.String(), r.ipTable("insert", ip, ports))
+	err = pipe.RunTimeout(addRule, 10*time.Second)
 	if err != nil {
 		// Release semaphore before returning. Note: this assumes that iptables
 		// cannot add a rule AND return an error.
@@ -60,10 +88,19 @@ func (r *IPManager) Grant(ip net.IP) error {
 	return err
 }
 
-// Revoke removes the iptables/ip6tables rule previously granted for the same IP.
-func (r *IPManager) Revoke(ip net.IP) error {
-	delRule := pipe.Script("Remove rule to allow "+ip.String(), ipTable("delete", ip))
-	err := pipe.RunTimeout(delRule, 10*time.Second)
+// Revoke removes the iptables/ip6tables rule previously granted for the same IP
+// and ports.
+func (r *IPManager) Revoke(ip net.IP, ports ...string) error {
+	return r.RevokeContext(context.Background(), ip, ports...)
+}
+
+// RevokeContext is like Revoke, and records the iptables commands in a span
+// that is a child of any span in ctx.
+func (r *IPManager) RevokeContext(ctx context.Context, ip net.IP, ports ...string) (err error) {
+	_, span := startSpan(ctx, "address.revoke", ip, ports)
+	defer func() { endSpan(span, err) }()
+	delRule := pipe.Script("Remove rule to allow "+ip.String(), r.ipTable("delete", ip, ports))
+	err = pipe.RunTimeout(delRule, 10*time.Second)
 	if err == nil {
 		// Only release semaphore if removing rule succeeds.
 		// NOTE: if the rule is not removed, then an error represents a leak.
@@ -72,35 +109,109 @@ func (r *IPManager) Revoke(ip net.IP) error {
 	return err
 }
 
-func ipTable(action string, ip net.IP) pipe.Pipe {
+// tracerName is the instrumentation scope of address spans.
+const tracerName = "github.com/m-lab/access/address"
+
+// startSpan starts a span for an iptables operation using the global
+// TracerProvider.
+func startSpan(ctx context.Context, name string, ip net.IP, ports []string) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(
+		attribute.String("address.subnet", Subnet(ip).String()),
+		attribute.StringSlice("address.ports", ports),
+	))
+}
+
+// endSpan records the error, if any, and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// CheckPorts validates that ports may be used to restrict a grant. Each port
+// is a single port number, e.g. "443", or an inclusive range, e.g. "3001:3010".
+func CheckPorts(ports []string) error {
+	count := 0
+	for _, p := range ports {
+		bounds := strings.Split(p, ":")
+		if len(bounds) > 2 {
+			return fmt.Errorf("%w: %q", ErrInvalidPorts, p)
+		}
+		for _, b := range bounds {
+			n, err := strconv.Atoi(b)
+			if err != nil || n < 1 || n > 65535 {
+				return fmt.Errorf("%w: %q", ErrInvalidPorts, p)
+			}
+		}
+		count += len(bounds)
+	}
+	if count > maxPorts {
+		return fmt.Errorf("%w: too many ports: %d", ErrInvalidPorts, count)
+	}
+	return nil
+}
+
+func (r *IPManager) ipTable(action string, ip net.IP, ports []string) pipe.Pipe {
 	// Parameters are the same for IPv4 and IPv6 addresses, but the command is not.
-	cmd, subnet := cmdForIP(ip)
-	return pipe.Script(action,
-		pipe.Exec(cmd, "--"+action+"=INPUT", "--source="+ip.String()+subnet, "--jump=ACCEPT", "--wait=1"),
+	cmd, subnet := r.cmdForIP(ip)
+	source := "--source=" + ip.String() + subnet
+	rules := []pipe.Pipe{}
+	if len(ports) == 0 {
+		rules = append(rules, pipe.Exec(cmd, "--"+action+"=INPUT", source, "--jump=ACCEPT", "--wait=1"))
+	} else {
+		dports := "--dports=" + strings.Join(ports, ",")
+		for _, proto := range []string{"tcp", "udp"} {
+			rules = append(rules, pipe.Exec(cmd, "--"+action+"=INPUT", source, "--protocol="+proto,
+				"--match=multiport", dports, "--jump=ACCEPT", "--wait=1"))
+		}
+	}
+	rules = append(rules,
 		// Unconditionally allow connections from "standard HTTP ports" to allow connections
 		// from "optimizing proxies" which may use different source addresses.
 		pipe.Exec(cmd, "--"+action+"=INPUT", "--protocol=tcp", "--dport=80", "--jump=ACCEPT", "--wait=1"),
 		pipe.Exec(cmd, "--"+action+"=INPUT", "--protocol=tcp", "--dport=443", "--jump=ACCEPT", "--wait=1"),
 	)
+	return pipe.Script(action, rules...)
+}
+
+// Subnet returns the subnet granted for ip: the /24 containing an IPv4 address
+// or the /64 containing an IPv6 address.
+func Subnet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}
+	}
+	return &net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}
 }
 
-func cmdForIP(ip net.IP) (string, string) {
+func (r *IPManager) cmdForIP(ip net.IP) (string, string) {
 	if ip.To4() != nil {
-		return ip4tables, "/24"
+		return r.cmds.IPTables, "/24"
 	}
-	return ip6tables, "/64"
+	return r.cmds.IP6Tables, "/64"
 }
 
 // NullManager implements the address.Manager interface while doing nothing.
 type NullManager struct{}
 
 // Grant does nothing with the given ip.
-func (r *NullManager) Grant(ip net.IP) error {
+func (r *NullManager) Grant(ip net.IP, ports ...string) error {
 	return nil
 }
 
 // Revoke does nothing with the given ip.
-func (r *NullManager) Revoke(ip net.IP) error {
+func (r *NullManager) Revoke(ip net.IP, ports ...string) error {
+	return nil
+}
+
+// GrantContext does nothing with the given ip.
+func (r *NullManager) GrantContext(ctx context.Context, ip net.IP, ports ...string) error {
+	return nil
+}
+
+// RevokeContext does nothing with the given ip.
+func (r *NullManager) RevokeContext(ctx context.Context, ip net.IP, ports ...string) error {
 	return nil
 }
 
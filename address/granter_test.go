@@ -1,12 +1,17 @@
 package address
 
 import (
+	"context"
 	"net"
 	"sync"
 	"testing"
 
 	"github.com/m-lab/go/osx"
 	"github.com/m-lab/go/rtx"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 func TestIPManager_Grant(t *testing.T) {
@@ -14,6 +19,7 @@ func TestIPManager_Grant(t *testing.T) {
 		name          string
 		max           int64
 		ip            net.IP
+		ports         []string
 		grantExit     string
 		revokeExit    string
 		wantGrantErr  bool
@@ -33,6 +39,14 @@ func TestIPManager_Grant(t *testing.T) {
 			grantExit:  "0",
 			revokeExit: "0",
 		},
+		{
+			name:       "success-ipv4-ports",
+			max:        1,
+			ip:         net.ParseIP("127.0.0.1"),
+			ports:      []string{"3010", "4000:4010"},
+			grantExit:  "0",
+			revokeExit: "0",
+		},
 		{
 			name:         "error-max-concurent",
 			max:          0, // Make first Grant fail.
@@ -61,14 +75,8 @@ func TestIPManager_Grant(t *testing.T) {
 			defer osx.MustSetenv("IPTABLES_EXIT", tt.grantExit)()
 			defer osx.MustSetenv("IP6TABLES_EXIT", tt.grantExit)()
 
-			if tt.ip.To4() != nil {
-				ip4tables = "./testdata/iptables"
-			} else {
-				ip6tables = "./testdata/ip6tables"
-			}
-
-			r := NewIPManager(tt.max)
-			if err := r.Grant(tt.ip); (err != nil) != tt.wantGrantErr {
+			r := NewIPManager(tt.max, testCommands)
+			if err := r.Grant(tt.ip, tt.ports...); (err != nil) != tt.wantGrantErr {
 				t.Errorf("IPGranter.Grant() error = %v, wantErr %v", err, tt.wantGrantErr)
 				return
 			}
@@ -77,17 +85,54 @@ func TestIPManager_Grant(t *testing.T) {
 			}
 
 			defer osx.MustSetenv("IPTABLES_EXIT", tt.revokeExit)()
-			if err := r.Revoke(tt.ip); (err != nil) != tt.wantRevokeErr {
+			if err := r.Revoke(tt.ip, tt.ports...); (err != nil) != tt.wantRevokeErr {
 				t.Errorf("IPGranter.Revoke() error = %v, wantErr %v", err, tt.wantRevokeErr)
 			}
 		})
 	}
 }
 
+func TestIPManager_GrantContext(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "parent")
+	defer osx.MustSetenv("IPTABLES_EXIT", "0")()
+	r := NewIPManager(1, testCommands)
+	ip := net.ParseIP("127.0.0.1")
+	rtx.Must(r.GrantContext(ctx, ip, "3010"), "failed to grant")
+	if err := r.GrantContext(ctx, ip, "3010"); err != ErrMaxConcurrent {
+		t.Errorf("IPManager.GrantContext() wrong error; got %v, want %v", err, ErrMaxConcurrent)
+	}
+	rtx.Must(r.RevokeContext(ctx, ip, "3010"), "failed to revoke")
+	parent.End()
+
+	spans := sr.Ended()
+	want := []struct {
+		name string
+		code codes.Code
+	}{
+		{name: "address.grant", code: codes.Unset},
+		{name: "address.grant", code: codes.Error},
+		{name: "address.revoke", code: codes.Unset},
+	}
+	if len(spans) != len(want)+1 {
+		t.Fatalf("IPManager recorded wrong number of spans; got %d, want %d", len(spans), len(want)+1)
+	}
+	for i, w := range want {
+		s := spans[i]
+		if s.Name() != w.name || s.Status().Code != w.code {
+			t.Errorf("span[%d] = %s %v, want %s %v", i, s.Name(), s.Status().Code, w.name, w.code)
+		}
+		if s.Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("span[%d] is not a child of the context span", i)
+		}
+	}
+}
+
 func TestIPManager(t *testing.T) {
-	ip4tables = "./testdata/iptables"
 	wg := sync.WaitGroup{}
-	mgr := NewIPManager(10)
+	mgr := NewIPManager(10, testCommands)
 	ip := net.ParseIP("127.0.0.2")
 	for i := 0; i < 100; i++ {
 		wg.Add(1)
@@ -103,6 +148,67 @@ func TestIPManager(t *testing.T) {
 	wg.Wait()
 }
 
+func TestCheckPorts(t *testing.T) {
+	tests := []struct {
+		name    string
+		ports   []string
+		wantErr bool
+	}{
+		{
+			name: "success-empty",
+		},
+		{
+			name:  "success-ports-and-ranges",
+			ports: []string{"80", "3001:3010", "65535"},
+		},
+		{
+			name:    "error-not-a-number",
+			ports:   []string{"http"},
+			wantErr: true,
+		},
+		{
+			name:    "error-out-of-range",
+			ports:   []string{"65536"},
+			wantErr: true,
+		},
+		{
+			name:    "error-bad-range",
+			ports:   []string{"1:2:3"},
+			wantErr: true,
+		},
+		{
+			name:    "error-too-many-ports",
+			ports:   []string{"1:2", "3:4", "5:6", "7:8", "9:10", "11:12", "13:14", "15:16"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := CheckPorts(tt.ports); (err != nil) != tt.wantErr {
+				t.Errorf("CheckPorts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSubnet(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{ip: "192.0.2.77", want: "192.0.2.0/24"},
+		{ip: "::ffff:192.0.2.77", want: "192.0.2.0/24"},
+		{ip: "2001:db8:1:2:3:4:5:6", want: "2001:db8:1:2::/64"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := Subnet(net.ParseIP(tt.ip)).String(); got != tt.want {
+				t.Errorf("Subnet() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
 // TestNullManager verifies that the NullManager does nothing.
 func TestNullManager(t *testing.T) {
 	t.Run("null-manager", func(t *testing.T) {
@@ -113,6 +219,15 @@ func TestNullManager(t *testing.T) {
 		if err := r.Revoke(net.ParseIP("127.0.0.1")); err != nil {
 			t.Errorf("NullManager.Revoke() error = %v, want nil", err)
 		}
+		if err := r.GrantContext(context.Background(), net.ParseIP("127.0.0.1")); err != nil {
+			t.Errorf("NullManager.GrantContext() error = %v, want nil", err)
+		}
+		if err := r.RevokeContext(context.Background(), net.ParseIP("127.0.0.1")); err != nil {
+			t.Errorf("NullManager.RevokeContext() error = %v, want nil", err)
+		}
+		if c, err := r.Counters(net.ParseIP("127.0.0.1")); err != nil || c != (Counters{}) {
+			t.Errorf("NullManager.Counters() = %v, %v, want zero, nil", c, err)
+		}
 		if err := r.Start("1234", "eth0"); err != nil {
 			t.Errorf("NullManager.Start() error = %v, want nil", err)
 		}
@@ -11,33 +11,70 @@ import (
 )
 
 var (
-	ip4tables        string
-	ip4tablesSave    string
-	ip4tablesRestore string
-
-	ip6tables        string
-	ip6tablesSave    string
-	ip6tablesRestore string
-
 	icmpv4 = "icmp"
 	icmpv6 = "icmpv6"
 )
 
-func init() {
-	// NOTE: because ip6tables is flag-compatible with iptables.
-	flag.StringVar(&ip4tables, "address.iptables", "/sbin/iptables",
-		"The absolute path to the iptables command")
-	flag.StringVar(&ip4tablesSave, "address.iptables-save", "/sbin/iptables-save",
-		"The absolute path to the iptables-save command")
-	flag.StringVar(&ip4tablesRestore, "address.iptables-restore", "/sbin/iptables-restore",
-		"The absolute path to the iptables-restore command")
+// Commands are the absolute paths of the iptables commands used by an
+// IPManager. ip6tables is flag-compatible with iptables, so the same rules are
+// used for both address families.
+type Commands struct {
+	IPTables        string
+	IPTablesSave    string
+	IPTablesRestore string
+
+	IP6Tables        string
+	IP6TablesSave    string
+	IP6TablesRestore string
+}
+
+// DefaultCommands returns the standard locations of the iptables commands.
+func DefaultCommands() Commands {
+	return Commands{
+		IPTables:         "/sbin/iptables",
+		IPTablesSave:     "/sbin/iptables-save",
+		IPTablesRestore:  "/sbin/iptables-restore",
+		IP6Tables:        "/sbin/ip6tables",
+		IP6TablesSave:    "/sbin/ip6tables-save",
+		IP6TablesRestore: "/sbin/ip6tables-restore",
+	}
+}
 
-	flag.StringVar(&ip6tables, "address.ip6tables", "/sbin/ip6tables",
+// RegisterFlags binds the commands to the -address.* flags in fs, using the
+// current values as defaults. Binaries that configure an IPManager from the
+// command line should call RegisterFlags before parsing flags.
+func (c *Commands) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.IPTables, "address.iptables", c.IPTables,
 		"The absolute path to the iptables command")
-	flag.StringVar(&ip6tablesSave, "address.ip6tables-save", "/sbin/ip6tables-save",
+	fs.StringVar(&c.IPTablesSave, "address.iptables-save", c.IPTablesSave,
 		"The absolute path to the iptables-save command")
-	flag.StringVar(&ip6tablesRestore, "address.ip6tables-restore", "/sbin/ip6tables-restore",
+	fs.StringVar(&c.IPTablesRestore, "address.iptables-restore", c.IPTablesRestore,
 		"The absolute path to the iptables-restore command")
+
+	fs.StringVar(&c.IP6Tables, "address.ip6tables", c.IP6Tables,
+		"The absolute path to the ip6tables command")
+	fs.StringVar(&c.IP6TablesSave, "address.ip6tables-save", c.IP6TablesSave,
+		"The absolute path to the ip6tables-save command")
+	fs.StringVar(&c.IP6TablesRestore, "address.ip6tables-restore", c.IP6TablesRestore,
+		"The absolute path to the ip6tables-restore command")
+}
+
+// withDefaults returns a copy of c with empty commands set to their defaults.
+func (c Commands) withDefaults() Commands {
+	d := DefaultCommands()
+	for _, f := range []struct{ v, def *string }{
+		{&c.IPTables, &d.IPTables},
+		{&c.IPTablesSave, &d.IPTablesSave},
+		{&c.IPTablesRestore, &d.IPTablesRestore},
+		{&c.IP6Tables, &d.IP6Tables},
+		{&c.IP6TablesSave, &d.IP6TablesSave},
+		{&c.IP6TablesRestore, &d.IP6TablesRestore},
+	} {
+		if *f.v == "" {
+			*f.v = *f.def
+		}
+	}
+	return c
 }
 
 // Start initializes iptables with rules for managing device, while the envelope
@@ -49,11 +86,11 @@ func init() {
 func (r *IPManager) Start(port, device string) error {
 	// Save original rules.
 	var err error
-	r.origRules4, err = start(ip4tablesSave, ip4tables, port, device, icmpv4)
+	r.origRules4, err = start(r.cmds.IPTablesSave, r.cmds.IPTables, port, device, icmpv4)
 	if err != nil {
 		return err
 	}
-	r.origRules6, err = start(ip6tablesSave, ip6tables, port, device, icmpv6)
+	r.origRules6, err = start(r.cmds.IP6TablesSave, r.cmds.IP6Tables, port, device, icmpv6)
 	if err != nil {
 		return err
 	}
@@ -114,11 +151,11 @@ func start(iptablesSave, iptables, port, device, protocol string) ([]byte, error
 
 // Stop restores the iptables rules originally found before running Start().
 func (r *IPManager) Stop() ([]byte, error) {
-	b4, err := stop(ip4tablesRestore, r.origRules4)
+	b4, err := stop(r.cmds.IPTablesRestore, r.origRules4)
 	if err != nil {
 		return b4, err
 	}
-	b6, err := stop(ip6tablesRestore, r.origRules6)
+	b6, err := stop(r.cmds.IP6TablesRestore, r.origRules6)
 	return append(b4, b6...), err
 }
 
@@ -1,17 +1,48 @@
 package address
 
 import (
+	"flag"
 	"testing"
 
 	"github.com/m-lab/go/osx"
 )
 
-func TestIPManager_Start(t *testing.T) {
-	ip4tables = "./testdata/iptables"
-	ip4tablesSave = "./testdata/iptables-save"
-	ip6tables = "./testdata/ip6tables"
-	ip6tablesSave = "./testdata/ip6tables-save"
+// testCommands are fake iptables commands that exit using the *_EXIT environment.
+var testCommands = Commands{
+	IPTables:         "./testdata/iptables",
+	IPTablesSave:     "./testdata/iptables-save",
+	IPTablesRestore:  "./testdata/iptables-restore",
+	IP6Tables:        "./testdata/ip6tables",
+	IP6TablesSave:    "./testdata/ip6tables-save",
+	IP6TablesRestore: "./testdata/iptables-restore",
+}
+
+func TestCommands_RegisterFlags(t *testing.T) {
+	c := DefaultCommands()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	c.RegisterFlags(fs)
+	err := fs.Parse([]string{"-address.iptables=/usr/sbin/iptables", "-address.ip6tables-restore=/usr/sbin/ip6tables-restore"})
+	if err != nil {
+		t.Fatalf("Commands.RegisterFlags() failed to parse flags: %v", err)
+	}
+	want := DefaultCommands()
+	want.IPTables = "/usr/sbin/iptables"
+	want.IP6TablesRestore = "/usr/sbin/ip6tables-restore"
+	if c != want {
+		t.Errorf("Commands.RegisterFlags() = %#v, want %#v", c, want)
+	}
+}
 
+func TestNewIPManager_defaults(t *testing.T) {
+	r := NewIPManager(1, Commands{IPTables: "./testdata/iptables"})
+	want := DefaultCommands()
+	want.IPTables = "./testdata/iptables"
+	if r.cmds != want {
+		t.Errorf("NewIPManager() wrong commands = %#v, want %#v", r.cmds, want)
+	}
+}
+
+func TestIPManager_Start(t *testing.T) {
 	tests := []struct {
 		name              string
 		iptablesSaveCode  string
@@ -46,7 +77,7 @@ func TestIPManager_Start(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			r := &IPManager{}
+			r := &IPManager{cmds: testCommands}
 			defer osx.MustSetenv("IPTABLES_SAVE_EXIT", tt.iptablesSaveCode)()
 			defer osx.MustSetenv("IPTABLES_EXIT", tt.iptablesCode)()
 
@@ -61,9 +92,6 @@ func TestIPManager_Start(t *testing.T) {
 }
 
 func TestIPManager_Stop(t *testing.T) {
-	ip4tablesRestore = "./testdata/iptables-restore"
-	ip6tablesRestore = "./testdata/iptables-restore"
-
 	tests := []struct {
 		name        string
 		origRules4  []byte
@@ -84,7 +112,7 @@ func TestIPManager_Stop(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			r := &IPManager{origRules4: tt.origRules4, origRules6: tt.origRules6}
+			r := &IPManager{cmds: testCommands, origRules4: tt.origRules4, origRules6: tt.origRules6}
 			defer osx.MustSetenv("IPTABLES_RESTORE_EXIT", tt.restoreExit)()
 
 			b, err := r.Stop()
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"sigs.k8s.io/yaml"
+
+	"github.com/m-lab/access/address"
+	"github.com/m-lab/access/controller"
+	"github.com/m-lab/access/token"
+)
+
+// Config is the typed configuration for the envelope service. The default
+// configuration is derived from command line flags, and the file given by
+// -envelope.config overrides every field that it specifies. The file may be
+// YAML or JSON.
+//
+// Only the verify keys and issuers, the timeout, the profiles (including their
+// grant limits) and the contents of the IP lists file may change on reload. A
+// reload that changes any other field, e.g. the txcontroller limits,
+// address.max_clients or the classes, is rejected; those changes require a
+// restart.
+type Config struct {
+	Listener     ListenerConfig     `json:"listener"`
+	TLS          TLSConfig          `json:"tls"`
+	Token        TokenConfig        `json:"token"`
+	Address      AddressConfig      `json:"address"`
+	TxController TxControllerConfig `json:"txcontroller"`
+
+	// Timeout is the default grant duration for profiles without a timeout.
+	Timeout Duration `json:"timeout"`
+
+	// Profiles are the per-subject service profiles.
+	Profiles []*Profile `json:"profiles"`
+
+	// AuditLog is the file that receives session audit records. When empty,
+	// records are written to stderr.
+	AuditLog string `json:"audit_log,omitempty"`
+
+	// Classes are the priority classes of clients, selected by token subject
+	// or issuer. Classes may bypass limits, scale the txcontroller limits, and
+	// reserve part of address.max_clients. When empty, monitoring tokens
+	// bypass limits.
+	Classes controller.Classes `json:"classes,omitempty"`
+
+	// IPLists is the file with client allow and deny lists (see
+	// controller.ParseIPLists). Denied clients are rejected, and allowed
+	// clients without an access token receive the IPListsProfile. The lists
+	// reload with the configuration.
+	IPLists string `json:"ip_lists,omitempty"`
+
+	// IPListsProfile is the subject of the profile for allowed clients without
+	// an access token. It is required with IPLists, and the profile must not
+	// have required claims.
+	IPListsProfile string `json:"ip_lists_profile,omitempty"`
+
+	// TraceExporter is where OpenTelemetry spans are exported: "otlp" for a
+	// collector, "stdout", or empty to disable tracing.
+	TraceExporter string `json:"trace_exporter,omitempty"`
+}
+
+// ListenerConfig configures the envelope access API server.
+type ListenerConfig struct {
+	Address string `json:"address"`
+}
+
+// TLSConfig configures the envelope server certificate. When both are empty,
+// the envelope server does not use TLS.
+type TLSConfig struct {
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+}
+
+// TokenConfig configures access token verification. Tokens are verified
+// either by the verify keys, for tokens from the locate service, or by the keys
+// of each issuer.
+type TokenConfig struct {
+	Required   bool     `json:"required"`
+	Machine    string   `json:"machine"`
+	VerifyKeys []string `json:"verify_keys"`
+
+	// Audience are other names of the machine, e.g. its FQDN or service names,
+	// or patterns of names, e.g. "*.mlab-oti.measurement-lab.org", accepted in
+	// the token audience in addition to the machine.
+	Audience []string `json:"audience,omitempty"`
+
+	// Issuers bind verify keys to token issuers. A token is only accepted when
+	// it is from the issuer of the key that signed it. When issuers are given,
+	// the verify keys must be empty.
+	Issuers []IssuerConfig `json:"issuers,omitempty"`
+}
+
+// IssuerConfig configures a token issuer. The audience may include patterns.
+// When the audience is empty, tokens must be for the machine or one of its
+// token audience names. When the subjects are empty, any subject is accepted.
+type IssuerConfig struct {
+	Name       string       `json:"name"`
+	VerifyKeys []string     `json:"verify_keys"`
+	Audience   jwt.Audience `json:"audience,omitempty"`
+	Subjects   []string     `json:"subjects,omitempty"`
+}
+
+// AddressConfig configures the iptables address manager.
+type AddressConfig struct {
+	Device           string `json:"device"`
+	MaxClients       int64  `json:"max_clients"`
+	IPTables         string `json:"iptables"`
+	IPTablesSave     string `json:"iptables_save"`
+	IPTablesRestore  string `json:"iptables_restore"`
+	IP6Tables        string `json:"ip6tables"`
+	IP6TablesSave    string `json:"ip6tables_save"`
+	IP6TablesRestore string `json:"ip6tables_restore"`
+}
+
+// TxControllerConfig configures the tx controller. The device is a comma
+// separated list of device patterns, each with optional per-device limits (see
+// controller.ParseDeviceLimits). When the device is empty, the tx controller is
+// disabled. Rates are in bits per second and apply to the sum of all devices.
+// Zero rates are not enforced. The low rates are the watermarks at which a
+// limited tx controller accepts new clients again, and the estimator is given
+// to controller.ParseEstimator. Above early_start, a fraction of each limit, new
+// clients are rejected with a probability that increases along early_curve.
+type TxControllerConfig struct {
+	Device       string  `json:"device"`
+	MaxRate      uint64  `json:"max_rate"`
+	MaxRxRate    uint64  `json:"max_rx_rate,omitempty"`
+	MaxTotalRate uint64  `json:"max_total_rate,omitempty"`
+	LowRate      uint64  `json:"low_rate,omitempty"`
+	LowRxRate    uint64  `json:"low_rx_rate,omitempty"`
+	LowTotalRate uint64  `json:"low_total_rate,omitempty"`
+	Estimator    string  `json:"estimator,omitempty"`
+	EarlyStart   float64 `json:"early_start,omitempty"`
+	EarlyCurve   float64 `json:"early_curve,omitempty"`
+}
+
+// configFromFlags returns the configuration given by command line flags.
+func configFromFlags() (*Config, error) {
+	cfg := &Config{
+		Listener: ListenerConfig{Address: listenAddr},
+		TLS:      TLSConfig{Cert: certFile, Key: keyFile},
+		Token: TokenConfig{
+			Required: requireTokens,
+			Machine:  machine,
+			Audience: audiences,
+		},
+		Address: AddressConfig{
+			Device:           manageDevice,
+			MaxClients:       maxIPs,
+			IPTables:         addressFlags.IPTables,
+			IPTablesSave:     addressFlags.IPTablesSave,
+			IPTablesRestore:  addressFlags.IPTablesRestore,
+			IP6Tables:        addressFlags.IP6Tables,
+			IP6TablesSave:    addressFlags.IP6TablesSave,
+			IP6TablesRestore: addressFlags.IP6TablesRestore,
+		},
+		TxController: TxControllerConfig{
+			Device:       txFlags.Devices.String(),
+			MaxRate:      txFlags.Limits.Tx,
+			MaxRxRate:    txFlags.Limits.Rx,
+			MaxTotalRate: txFlags.Limits.Total,
+			LowRate:      txFlags.Low.Tx,
+			LowRxRate:    txFlags.Low.Rx,
+			LowTotalRate: txFlags.Low.Total,
+			Estimator:    txFlags.Estimator,
+			EarlyStart:   txFlags.EarlyStart,
+			EarlyCurve:   txFlags.EarlyCurve,
+		},
+		Timeout:  Duration{timeout},
+		AuditLog: auditFile,
+		IPLists:  ipListsFile,
+
+		IPListsProfile: ipListsProfile,
+
+		TraceExporter: traceExporter,
+	}
+	if verifyKeys.String() != "" {
+		cfg.Token.VerifyKeys = strings.Split(verifyKeys.String(), ",")
+	}
+	switch {
+	case len(profilesFile) > 0:
+		pc := profilesConfig{}
+		if err := json.Unmarshal(profilesFile, &pc); err != nil {
+			return nil, err
+		}
+		cfg.Profiles = pc.Profiles
+	case subject != "":
+		cfg.Profiles = []*Profile{{Subject: subject}}
+	}
+	return cfg, nil
+}
+
+// loadConfig reads the named YAML or JSON file and applies it over a copy of
+// base. Unknown fields are an error. When name is empty, loadConfig returns a
+// copy of base.
+func loadConfig(name string, base *Config) (*Config, error) {
+	cfg := *base
+	if name == "" {
+		return &cfg, nil
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	// Decode lists into new slices so that base is never modified.
+	cfg.Token.VerifyKeys = nil
+	cfg.Token.Audience = nil
+	cfg.Profiles = nil
+	if err := yaml.UnmarshalStrict(b, &cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Token.VerifyKeys == nil {
+		cfg.Token.VerifyKeys = base.Token.VerifyKeys
+	}
+	if cfg.Token.Audience == nil {
+		cfg.Token.Audience = base.Token.Audience
+	}
+	if cfg.Profiles == nil {
+		cfg.Profiles = base.Profiles
+	}
+	return &cfg, nil
+}
+
+// validate reports the first invalid setting in the configuration.
+func (c *Config) validate() error {
+	if _, _, err := net.SplitHostPort(c.Listener.Address); err != nil {
+		return fmt.Errorf("listener: %w", err)
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return errors.New("tls: cert and key must be given together")
+	}
+	if c.Token.Required && c.Token.Machine == "" {
+		return errors.New("token: machine is required when tokens are required")
+	}
+	if !token.ValidAudience(c.Token.Audience) {
+		return fmt.Errorf("token: invalid audience %q", c.Token.Audience)
+	}
+	if len(c.Token.Issuers) > 0 && len(c.Token.VerifyKeys) > 0 {
+		return errors.New("token: verify_keys must be empty when issuers are given")
+	}
+	if c.Address.Device == "" {
+		return errors.New("address: device must not be empty")
+	}
+	if c.Address.MaxClients < 0 {
+		return errors.New("address: max_clients must not be negative")
+	}
+	if _, err := c.txConfig(); err != nil {
+		return fmt.Errorf("txcontroller: %w", err)
+	}
+	if _, err := c.grantLimiter(); err != nil {
+		return fmt.Errorf("classes: %w", err)
+	}
+	if c.IPLists != "" {
+		b, err := os.ReadFile(c.IPLists)
+		if err != nil {
+			return fmt.Errorf("ip_lists: %w", err)
+		}
+		if _, err := controller.ParseIPLists(b); err != nil {
+			return fmt.Errorf("ip_lists: %w", err)
+		}
+		if err := c.checkIPListsProfile(); err != nil {
+			return fmt.Errorf("ip_lists_profile: %w", err)
+		}
+	}
+	switch c.TraceExporter {
+	case "", "otlp", "stdout":
+	default:
+		return fmt.Errorf("trace_exporter: unknown exporter %q", c.TraceExporter)
+	}
+	if c.Timeout.Duration <= 0 {
+		return errors.New("timeout must be positive")
+	}
+	for _, p := range c.Profiles {
+		// Profiles without a timeout use the global timeout.
+		if d := p.timeout(c.Timeout.Duration); p.MaxDuration.Duration > 0 && p.MaxDuration.Duration < d {
+			return fmt.Errorf("profiles: profile %q: max_duration %v is less than timeout %v",
+				p.Subject, p.MaxDuration.Duration, d)
+		}
+	}
+	return nil
+}
+
+// checkIPListsProfile reports whether the profile for allowed clients exists
+// and may be used without an access token.
+func (c *Config) checkIPListsProfile() error {
+	if c.IPListsProfile == "" {
+		return errors.New("a profile is required for allowed clients")
+	}
+	for _, p := range c.Profiles {
+		if p.Subject != c.IPListsProfile {
+			continue
+		}
+		if len(p.RequiredClaims) > 0 {
+			return fmt.Errorf("profile %q has required claims", p.Subject)
+		}
+		return nil
+	}
+	return fmt.Errorf("profile %q not found", c.IPListsProfile)
+}
+
+// commands returns the iptables commands for the address manager.
+func (c *Config) commands() address.Commands {
+	return address.Commands{
+		IPTables:         c.Address.IPTables,
+		IPTablesSave:     c.Address.IPTablesSave,
+		IPTablesRestore:  c.Address.IPTablesRestore,
+		IP6Tables:        c.Address.IP6Tables,
+		IP6TablesSave:    c.Address.IP6TablesSave,
+		IP6TablesRestore: c.Address.IP6TablesRestore,
+	}
+}
+
+// grantLimiter returns the limiter reserving grants for priority classes, or
+// nil when no class reserves grants.
+func (c *Config) grantLimiter() (*controller.ClassLimiter, error) {
+	if err := c.Classes.Validate(); err != nil {
+		return nil, err
+	}
+	for _, cl := range c.Classes {
+		if cl.Reserved > 0 {
+			return controller.NewClassLimiter(c.Address.MaxClients, c.Classes)
+		}
+	}
+	return nil, nil
+}
+
+// txConfig returns the tx controller devices, limits and estimator.
+func (c *Config) txConfig() (controller.TxConfig, error) {
+	devs, err := controller.ParseDeviceLimits(c.TxController.Device)
+	if err != nil {
+		return controller.TxConfig{}, err
+	}
+	// The period only changes the estimator parameters, not their validity.
+	if _, err := controller.ParseEstimator(c.TxController.Estimator, time.Second); err != nil {
+		return controller.TxConfig{}, err
+	}
+	txc := controller.TxConfig{
+		Devices: devs,
+		Limits: controller.Limits{
+			Tx:    c.TxController.MaxRate,
+			Rx:    c.TxController.MaxRxRate,
+			Total: c.TxController.MaxTotalRate,
+		},
+		Low: controller.Limits{
+			Tx:    c.TxController.LowRate,
+			Rx:    c.TxController.LowRxRate,
+			Total: c.TxController.LowTotalRate,
+		},
+		Estimator:  c.TxController.Estimator,
+		EarlyStart: c.TxController.EarlyStart,
+		EarlyCurve: c.TxController.EarlyCurve,
+		Classes:    c.Classes,
+	}
+	if err := txc.ValidateEarly(); err != nil {
+		return controller.TxConfig{}, err
+	}
+	return txc, nil
+}
+
+// newVerifier creates a token verifier from the public key files of the
+// verify keys or of the issuers.
+func newVerifier(tc TokenConfig) (*token.Verifier, error) {
+	if len(tc.Issuers) == 0 {
+		keys, err := readKeys(tc.VerifyKeys)
+		if err != nil {
+			return nil, err
+		}
+		return token.NewVerifier(keys...)
+	}
+	issuers := make([]token.Issuer, 0, len(tc.Issuers))
+	for _, ic := range tc.Issuers {
+		keys, err := readKeys(ic.VerifyKeys)
+		if err != nil {
+			return nil, fmt.Errorf("issuer %q: %w", ic.Name, err)
+		}
+		issuers = append(issuers, token.Issuer{
+			Name:     ic.Name,
+			Keys:     keys,
+			Audience: ic.Audience,
+			Subjects: ic.Subjects,
+		})
+	}
+	return token.NewIssuerVerifier(issuers...)
+}
+
+// readKeys reads the named public key files.
+func readKeys(names []string) ([][]byte, error) {
+	keys := [][]byte{}
+	for _, name := range names {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, b)
+	}
+	return keys, nil
+}
+
+// keyring is a token verifier whose keys may be replaced while running.
+type keyring struct {
+	v atomic.Pointer[token.Verifier]
+}
+
+// Verify verifies the token using the current keys.
+func (k *keyring) Verify(tok string, exp jwt.Expected, extraDest ...any) (*jwt.Claims, error) {
+	return k.v.Load().Verify(tok, exp, extraDest...)
+}
+
+// configManager reloads the configuration file and applies the reloadable
+// settings to the envelope handler and keyring. The IP lists, if not nil, are
+// reloaded too.
+type configManager struct {
+	name    string
+	base    *Config
+	env     *envelopeHandler
+	keys    *keyring
+	ips     *controller.IPListController
+	mu      sync.Mutex
+	current *Config
+}
+
+// errRestartRequired is returned by reload when the configuration changes
+// settings that cannot change while running.
+var errRestartRequired = errors.New("configuration changes other than keys, issuers, timeout, profiles and ip list contents require a restart")
+
+// reload re-reads the configuration file, verify keys and IP lists. When all
+// are valid, and only reloadable settings changed, the verify keys and issuers,
+// timeout, profiles and IP lists are replaced. Otherwise, the current
+// configuration is unchanged and the error is returned.
+func (m *configManager) reload() error {
+	cfg, err := loadConfig(m.name, m.base)
+	if err != nil {
+		return err
+	}
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Keep the current values of settings that cannot change while running.
+	next := *m.current
+	next.Token.VerifyKeys = cfg.Token.VerifyKeys
+	next.Token.Issuers = cfg.Token.Issuers
+	next.Timeout = cfg.Timeout
+	next.Profiles = cfg.Profiles
+	if !reflect.DeepEqual(*cfg, next) {
+		return errRestartRequired
+	}
+	v, err := newVerifier(cfg.Token)
+	if err != nil {
+		return err
+	}
+	profiles, err := profileMap(keepGrants(cfg.Profiles, m.env.currentProfiles()))
+	if err != nil {
+		return err
+	}
+
+	if m.ips != nil {
+		// The lists file was validated above, so Reload only fails if the file
+		// changed since.
+		if err := m.ips.Reload(); err != nil {
+			return err
+		}
+	}
+
+	m.keys.v.Store(v)
+	m.env.update(profiles, cfg.Timeout.Duration)
+	m.current = &next
+	return nil
+}
+
+// watch reloads the configuration whenever the configuration or IP lists file
+// changes or a reload is requested on the given channel. The file directories
+// are watched so that atomic replacements (e.g. kubernetes ConfigMaps) are seen.
+// watch returns when the done channel is closed.
+func (m *configManager) watch(done <-chan struct{}, requests <-chan os.Signal) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	for _, name := range []string{m.name, m.ips.File()} {
+		if name == "" {
+			continue
+		}
+		if err := w.Add(filepath.Dir(name)); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-requests:
+		case ev := <-w.Events:
+			if ev.Op == fsnotify.Chmod {
+				continue
+			}
+		case err := <-w.Errors:
+			log.Println("Error watching configuration:", err)
+			continue
+		}
+		if err := m.reload(); err != nil {
+			log.Println("Failed to reload configuration:", err)
+			continue
+		}
+		log.Println("Reloaded configuration from", m.name)
+	}
+}
+
+// ServeHTTP writes the effective configuration as JSON.
+func (m *configManager) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	m.mu.Lock()
+	b, err := json.MarshalIndent(m.current, "", "  ")
+	m.mu.Unlock()
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(b)
+}
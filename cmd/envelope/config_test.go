@@ -0,0 +1,434 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/access/address"
+	"github.com/m-lab/access/controller"
+	"github.com/m-lab/go/rtx"
+)
+
+const insecurePublicTestKey = `{"use":"sig","kty":"EC","kid":"112","crv":"P-256","alg":"ES256",` +
+	`"x":"V0NoRfUZ-fPACALnakvKtTyXJ5JtgAWlWm-0NaDWUOE","y":"RDbGu6RVhgJGKCTuya4_IzZhT1GzlEIA5ZkumEZ35Ag"}`
+
+func testConfig() *Config {
+	return &Config{
+		Listener: ListenerConfig{Address: ":8880"},
+		Token:    TokenConfig{Required: true, Machine: "mlab1.fake0"},
+		Address:  AddressConfig{Device: "eth0", MaxClients: 1},
+		Timeout:  Duration{time.Minute},
+		Profiles: []*Profile{{Subject: "ndt"}},
+	}
+}
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	p := filepath.Join(dir, name)
+	rtx.Must(os.WriteFile(p, []byte(content), 0o644), "failed to write %s", p)
+	return p
+}
+
+func Test_loadConfig(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name         string
+		file         string
+		content      string
+		wantTimeout  time.Duration
+		wantListen   string
+		wantProfiles []string
+		wantErr      bool
+	}{
+		{
+			name:         "success-no-file",
+			wantTimeout:  time.Minute,
+			wantListen:   ":8880",
+			wantProfiles: []string{"ndt"},
+		},
+		{
+			name: "success-yaml",
+			file: "envelope.yaml",
+			content: `
+listener:
+  address: ":4443"
+timeout: 30s
+profiles:
+- subject: wehe
+  ports: ["443"]
+- subject: ndt
+`,
+			wantTimeout:  30 * time.Second,
+			wantListen:   ":4443",
+			wantProfiles: []string{"wehe", "ndt"},
+		},
+		{
+			name:         "success-json-keeps-unspecified",
+			file:         "envelope.json",
+			content:      `{"timeout": "2m"}`,
+			wantTimeout:  2 * time.Minute,
+			wantListen:   ":8880",
+			wantProfiles: []string{"ndt"},
+		},
+		{
+			name:    "error-unknown-field",
+			file:    "unknown.yaml",
+			content: "not_a_field: 1\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-bad-duration",
+			file:    "duration.yaml",
+			content: "timeout: soon\n",
+			wantErr: true,
+		},
+		{
+			name:    "error-missing-file",
+			file:    "does-not-exist.yaml",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := ""
+			if tt.file != "" {
+				name = filepath.Join(dir, tt.file)
+			}
+			if tt.content != "" {
+				writeFile(t, dir, tt.file, tt.content)
+			}
+			base := testConfig()
+			got, err := loadConfig(name, base)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if base.Profiles[0].Subject != "ndt" || len(base.Profiles) != 1 {
+				t.Errorf("loadConfig() modified base profiles: %v", base.Profiles)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.Timeout.Duration != tt.wantTimeout {
+				t.Errorf("loadConfig() wrong timeout; got %v, want %v", got.Timeout, tt.wantTimeout)
+			}
+			if got.Listener.Address != tt.wantListen {
+				t.Errorf("loadConfig() wrong listener; got %q, want %q", got.Listener.Address, tt.wantListen)
+			}
+			subjects := []string{}
+			for _, p := range got.Profiles {
+				subjects = append(subjects, p.Subject)
+			}
+			if strings.Join(subjects, ",") != strings.Join(tt.wantProfiles, ",") {
+				t.Errorf("loadConfig() wrong profiles; got %v, want %v", subjects, tt.wantProfiles)
+			}
+		})
+	}
+}
+
+func TestConfig_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		wantErr bool
+	}{
+		{
+			name:   "success",
+			modify: func(c *Config) {},
+		},
+		{
+			name:    "error-listener",
+			modify:  func(c *Config) { c.Listener.Address = "no-port" },
+			wantErr: true,
+		},
+		{
+			name:    "error-tls-cert-without-key",
+			modify:  func(c *Config) { c.TLS.Cert = "cert.pem" },
+			wantErr: true,
+		},
+		{
+			name:    "error-required-tokens-without-machine",
+			modify:  func(c *Config) { c.Token.Machine = "" },
+			wantErr: true,
+		},
+		{
+			name:   "success-audience",
+			modify: func(c *Config) { c.Token.Audience = []string{"mlab1-fake0", "*.mlab-oti.example.org"} },
+		},
+		{
+			name:    "error-audience-pattern",
+			modify:  func(c *Config) { c.Token.Audience = []string{"mlab*.example.org"} },
+			wantErr: true,
+		},
+		{
+			name: "success-issuers",
+			modify: func(c *Config) {
+				c.Token.Issuers = []IssuerConfig{{Name: "locate", VerifyKeys: []string{"locate.json"}}}
+			},
+		},
+		{
+			name: "error-issuers-with-verify-keys",
+			modify: func(c *Config) {
+				c.Token.VerifyKeys = []string{"key.json"}
+				c.Token.Issuers = []IssuerConfig{{Name: "locate", VerifyKeys: []string{"locate.json"}}}
+			},
+			wantErr: true,
+		},
+		{
+			name:    "error-empty-device",
+			modify:  func(c *Config) { c.Address.Device = "" },
+			wantErr: true,
+		},
+		{
+			name:    "error-negative-max-clients",
+			modify:  func(c *Config) { c.Address.MaxClients = -1 },
+			wantErr: true,
+		},
+		{
+			name:    "error-txcontroller-device",
+			modify:  func(c *Config) { c.TxController.Device = "eth0:fast" },
+			wantErr: true,
+		},
+		{
+			name:    "error-txcontroller-estimator",
+			modify:  func(c *Config) { c.TxController.Estimator = "median" },
+			wantErr: true,
+		},
+		{
+			name:    "error-txcontroller-early-start",
+			modify:  func(c *Config) { c.TxController.EarlyStart = 1.5 },
+			wantErr: true,
+		},
+		{
+			name: "error-classes-reserved-exceeds-max-clients",
+			modify: func(c *Config) {
+				c.Classes = controller.Classes{{Name: "premium", Reserved: c.Address.MaxClients + 1}}
+			},
+			wantErr: true,
+		},
+		{
+			name:    "error-classes-duplicate-name",
+			modify:  func(c *Config) { c.Classes = controller.Classes{{Name: "a"}, {Name: "a"}} },
+			wantErr: true,
+		},
+		{
+			name: "success-ip-lists",
+			modify: func(c *Config) {
+				c.IPLists = "testdata/iplists.yaml"
+				c.IPListsProfile = "ndt"
+			},
+		},
+		{
+			name:    "error-ip-lists-without-profile",
+			modify:  func(c *Config) { c.IPLists = "testdata/iplists.yaml" },
+			wantErr: true,
+		},
+		{
+			name: "error-ip-lists-missing-profile",
+			modify: func(c *Config) {
+				c.IPLists = "testdata/iplists.yaml"
+				c.IPListsProfile = "wehe"
+			},
+			wantErr: true,
+		},
+		{
+			name: "error-ip-lists-profile-required-claims",
+			modify: func(c *Config) {
+				c.IPLists = "testdata/iplists.yaml"
+				c.IPListsProfile = "ndt"
+				c.Profiles[0].RequiredClaims = map[string]string{"tier": "1"}
+			},
+			wantErr: true,
+		},
+		{
+			name:    "error-ip-lists-missing",
+			modify:  func(c *Config) { c.IPLists = "testdata/missing.yaml" },
+			wantErr: true,
+		},
+		{
+			name:    "error-ip-lists-invalid",
+			modify:  func(c *Config) { c.IPLists = "testdata/insecure-cert.pem" },
+			wantErr: true,
+		},
+		{
+			name: "success-max-duration-equals-timeout",
+			modify: func(c *Config) {
+				c.Profiles[0].MaxDuration = Duration{time.Minute}
+			},
+		},
+		{
+			name: "error-max-duration-less-than-global-timeout",
+			modify: func(c *Config) {
+				c.Profiles[0].MaxDuration = Duration{30 * time.Second}
+			},
+			wantErr: true,
+		},
+		{
+			name: "success-max-duration-with-profile-timeout",
+			modify: func(c *Config) {
+				c.Profiles[0].Timeout = Duration{10 * time.Second}
+				c.Profiles[0].MaxDuration = Duration{30 * time.Second}
+			},
+		},
+		{
+			name:    "error-trace-exporter",
+			modify:  func(c *Config) { c.TraceExporter = "jaeger" },
+			wantErr: true,
+		},
+		{
+			name:    "error-zero-timeout",
+			modify:  func(c *Config) { c.Timeout.Duration = 0 },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testConfig()
+			tt.modify(c)
+			if err := c.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Config.validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_configManager_reload(t *testing.T) {
+	dir := t.TempDir()
+	key := writeFile(t, dir, "key.json", insecurePublicTestKey)
+	name := writeFile(t, dir, "envelope.yaml", "timeout: 30s\n")
+
+	base := testConfig()
+	base.Token.VerifyKeys = []string{key}
+	env := getEnvelopeHandler(map[string]*Profile{}, time.Minute, &address.NullManager{})
+	m := &configManager{name: name, base: base, env: env, keys: &keyring{}, current: base}
+
+	if err := m.reload(); err != nil {
+		t.Fatalf("configManager.reload() failed: %v", err)
+	}
+	if env.timeout != 30*time.Second {
+		t.Errorf("configManager.reload() wrong timeout; got %v, want 30s", env.timeout)
+	}
+	if _, ok := env.profiles["ndt"]; !ok {
+		t.Errorf("configManager.reload() missing profile from base config")
+	}
+	if m.keys.v.Load() == nil {
+		t.Errorf("configManager.reload() did not load verify keys")
+	}
+
+	// Changes to settings that require a restart are rejected.
+	for _, content := range []string{
+		"timeout: 45s\nlistener:\n  address: \":9999\"\n",
+		"timeout: 45s\naddress: {device: eth0, max_clients: 2}\n",
+		"timeout: 45s\ntxcontroller: {device: eth0, max_rate: 1000}\n",
+		"timeout: 45s\nclasses: [{name: monitoring, subjects: [monitoring], bypass: true}]\n",
+	} {
+		writeFile(t, dir, "envelope.yaml", content)
+		if err := m.reload(); !errors.Is(err, errRestartRequired) {
+			t.Errorf("configManager.reload() error = %v, want %v", err, errRestartRequired)
+		}
+	}
+	if m.current.Listener.Address != ":8880" || m.current.Timeout.Duration != 30*time.Second || env.timeout != 30*time.Second {
+		t.Errorf("configManager.reload() wrong effective config: %#v", m.current)
+	}
+	writeFile(t, dir, "envelope.yaml", "timeout: 45s\n")
+	if err := m.reload(); err != nil {
+		t.Fatalf("configManager.reload() failed: %v", err)
+	}
+
+	// Grants outstanding before a reload count against unchanged limits.
+	writeFile(t, dir, "envelope.yaml", "timeout: 45s\nprofiles: [{subject: ndt, max_clients: 1}]\n")
+	if err := m.reload(); err != nil {
+		t.Fatalf("configManager.reload() failed: %v", err)
+	}
+	held := env.profiles["ndt"]
+	if !held.acquire() {
+		t.Fatalf("Profile.acquire() failed before reload")
+	}
+	if err := m.reload(); err != nil {
+		t.Fatalf("configManager.reload() failed: %v", err)
+	}
+	if env.profiles["ndt"] == held || env.profiles["ndt"].acquire() {
+		t.Errorf("configManager.reload() did not keep outstanding grant of unchanged profile")
+	}
+	held.release()
+	if !env.profiles["ndt"].acquire() {
+		t.Errorf("Profile.acquire() failed after releasing grant from before reload")
+	}
+	env.profiles["ndt"].release()
+	// A changed limit starts without outstanding grants.
+	held.acquire()
+	writeFile(t, dir, "envelope.yaml", "timeout: 45s\nprofiles: [{subject: ndt, max_clients: 2}]\n")
+	if err := m.reload(); err != nil {
+		t.Fatalf("configManager.reload() failed: %v", err)
+	}
+	if p := env.profiles["ndt"]; !p.acquire() || !p.acquire() || p.acquire() {
+		t.Errorf("configManager.reload() wrong grant limit for changed profile")
+	}
+
+	// Issuers replace the verify keys from flags.
+	base.Token.VerifyKeys = nil
+	writeFile(t, dir, "envelope.yaml", "timeout: 45s\ntoken:\n  issuers:\n"+
+		"  - {name: monitoring, verify_keys: ["+key+"], audience: probe, subjects: [monitoring]}\n")
+	if err := m.reload(); err != nil {
+		t.Fatalf("configManager.reload() failed: %v", err)
+	}
+	if len(m.current.Token.Issuers) != 1 || m.current.Token.Issuers[0].Audience[0] != "probe" {
+		t.Errorf("configManager.reload() wrong issuers: %#v", m.current.Token.Issuers)
+	}
+
+	// Invalid configurations are rejected and the current config is kept.
+	for _, content := range []string{"timeout: 0s\n", "profiles: [{subject: \"\"}]\n", "token: {verify_keys: [missing.json]}\n",
+		"token: {issuers: [{name: locate, verify_keys: [missing.json]}]}\n"} {
+		writeFile(t, dir, "envelope.yaml", content)
+		if err := m.reload(); err == nil {
+			t.Errorf("configManager.reload() accepted invalid config: %q", content)
+		}
+	}
+	if env.timeout != 45*time.Second {
+		t.Errorf("configManager.reload() changed timeout after error; got %v", env.timeout)
+	}
+
+	// Serve the effective configuration.
+	rw := httptest.NewRecorder()
+	m.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/config", nil))
+	if rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), `"timeout": "45s"`) {
+		t.Errorf("configManager.ServeHTTP() wrong response; got %d %s", rw.Code, rw.Body.String())
+	}
+}
+
+func Test_configManager_watch(t *testing.T) {
+	dir := t.TempDir()
+	name := writeFile(t, dir, "envelope.yaml", "timeout: 30s\n")
+	env := getEnvelopeHandler(map[string]*Profile{}, time.Minute, &address.NullManager{})
+	m := &configManager{name: name, base: testConfig(), env: env, keys: &keyring{}, current: testConfig()}
+
+	done := make(chan struct{})
+	requests := make(chan os.Signal)
+	stopped := make(chan error)
+	go func() {
+		stopped <- m.watch(done, requests)
+	}()
+	// A reload request applies the configuration file.
+	requests <- os.Interrupt
+	// File changes are applied as well.
+	writeFile(t, dir, "envelope.yaml", "timeout: 45s\n")
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		env.mu.RLock()
+		timeout := env.timeout
+		env.mu.RUnlock()
+		if timeout == 45*time.Second {
+			break
+		}
+	}
+	close(done)
+	if err := <-stopped; err != nil {
+		t.Errorf("configManager.watch() returned error: %v", err)
+	}
+	if env.timeout != 45*time.Second {
+		t.Errorf("configManager.watch() did not reload; got %v, want 45s", env.timeout)
+	}
+}
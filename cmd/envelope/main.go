@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -9,6 +10,9 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/go-jose/go-jose/v4/jwt"
@@ -30,20 +34,29 @@ import (
 )
 
 var (
-	verifyKeys    = flagx.FileBytesArray{}
-	listenAddr    string
-	maxIPs        int64
-	certFile      string
-	keyFile       string
-	machine       string
-	requireTokens bool
-	subject       string
-	manageDevice  string
-	timeout       time.Duration
-	tcpNetwork    = flagx.Enum{
+	verifyKeys     = flagx.FileBytesArray{}
+	audiences      flagx.StringArray
+	profilesFile   flagx.FileBytes
+	configFile     string
+	auditFile      string
+	traceExporter  string
+	ipListsFile    string
+	ipListsProfile string
+	listenAddr     string
+	maxIPs         int64
+	certFile       string
+	keyFile        string
+	machine        string
+	requireTokens  bool
+	subject        string
+	manageDevice   string
+	timeout        time.Duration
+	tcpNetwork     = flagx.Enum{
 		Options: []string{"tcp", "tcp4", "tcp6"},
 		Value:   "tcp",
 	}
+	addressFlags = address.DefaultCommands()
+	txFlags      controller.TxConfig
 
 	// count the number of requests received and their apparent success or failure.
 	envelopeRequests = promauto.NewCounterVec(
@@ -53,8 +66,36 @@ var (
 		},
 		[]string{"status"},
 	)
+
+	errMissingClaim     = errors.New("missing claim when tokens required")
+	errWrongSubject     = errors.New("wrong claim subject")
+	errPastExpiration   = errors.New("already past claim expiration")
+	errNoAllowedProfile = errors.New("no profile for allowed client")
 )
 
+// statusLabels are the envelopeRequests status labels for errors returned by
+// getProfile and getDeadline.
+var statusLabels = map[error]string{
+	errMissingClaim:         "missing-claim",
+	errWrongSubject:         "wrong-subject",
+	errMissingRequiredClaim: "missing-required-claim",
+	errWrongRequiredClaim:   "wrong-required-claim",
+	errPastExpiration:       string(token.ReasonExpired),
+	errNoAllowedProfile:     "missing-allowed-profile",
+}
+
+// statusLabel returns the envelopeRequests status label for err. Errors
+// without a label are counted as "bad-request", so that error messages never
+// become label values.
+func statusLabel(err error) string {
+	for e, label := range statusLabels {
+		if errors.Is(err, e) {
+			return label
+		}
+	}
+	return "bad-request"
+}
+
 func init() {
 	flag.StringVar(&listenAddr, "envelope.listen-address", ":8880", "Listen address for the envelope access API")
 	flag.Int64Var(&maxIPs, "envelope.max-clients", 1, "Maximum number of concurrent client IPs allowed")
@@ -63,20 +104,45 @@ func init() {
 	flag.Var(&verifyKeys, "envelope.verify-key", "Public key(s) for verifying access tokens")
 	flag.BoolVar(&requireTokens, "envelope.token-required", true, "Require access token in requests")
 	flag.StringVar(&machine, "envelope.machine", "", "The machine name to expect in access token claims")
+	flag.Var(&audiences, "envelope.audience", "Other names or patterns (e.g. *.mlab-oti.measurement-lab.org) of the machine to accept in access token claims")
 	flag.StringVar(&subject, "envelope.subject", "", "The subject (service name) expected in access token claims")
+	flag.Var(&profilesFile, "envelope.profiles", "JSON file with per-subject service profiles. Overrides -envelope.subject")
+	flag.StringVar(&configFile, "envelope.config", "", "YAML or JSON configuration file. Overrides flags and reloads on change or SIGHUP")
+	flag.StringVar(&auditFile, "envelope.audit-log", "", "File to append JSON session audit records. Default is stderr")
+	flag.StringVar(&ipListsFile, "envelope.ip-lists", "", "YAML or JSON file with client IP allow and deny lists")
+	flag.StringVar(&ipListsProfile, "envelope.ip-lists-profile", "", "The profile subject for allowed clients without access tokens")
+	flag.StringVar(&traceExporter, "envelope.trace-exporter", "", "OpenTelemetry span exporter: otlp or stdout. Default is no tracing")
 	flag.StringVar(&manageDevice, "envelope.device", "eth0", "The public network interface device name that the envelope manages")
 	flag.DurationVar(&timeout, "timeout", time.Minute, "Complete request within timeout. Overrides valid token expiration")
+	addressFlags.RegisterFlags(flag.CommandLine)
+	txFlags.RegisterFlags(flag.CommandLine)
 	flagx.EnableAdvancedFlags() // Enable access to -httpx.tcp-network
 }
 
 type manager interface {
-	Grant(ip net.IP) error
-	Revoke(ip net.IP) error
+	Grant(ip net.IP, ports ...string) error
+	Revoke(ip net.IP, ports ...string) error
 }
 
 type envelopeHandler struct {
 	manager
-	subject string
+	mu sync.RWMutex
+	// profiles maps token subjects to the access granted for that subject.
+	profiles map[string]*Profile
+	// fallback is used for requests without tokens and for monitoring tokens
+	// without a profile of their own.
+	fallback *Profile
+	// allowed is the subject of the profile for clients on the IP allow list
+	// without tokens. When empty, those clients are rejected.
+	allowed string
+	// timeout is the default grant duration for profiles without a timeout.
+	timeout time.Duration
+	// audit receives a record for every finished session, if not nil.
+	audit *auditLog
+	// classes select the priority class of each token, and grants reserves
+	// part of the concurrent grants for classes, if not nil.
+	classes controller.Classes
+	grants  *controller.ClassLimiter
 }
 
 func logger(next http.Handler) http.Handler {
@@ -121,20 +187,46 @@ func (env *envelopeHandler) AllowRequest(rw http.ResponseWriter, req *http.Reque
 		return
 	}
 
-	// Get deadline based on token claim.
+	// Select the service profile based on token claim.
 	cl := controller.GetClaim(req.Context())
-	deadline, err := env.getDeadline(cl)
+	custom, _ := controller.GetCustomClaim(req.Context()).(*customClaims)
+	p, err := env.getProfile(cl, custom, controller.GetAllowed(req.Context()) != "")
+	if err != nil {
+		logx.Debug.Println("failed to get profile:", err)
+		rw.WriteHeader(http.StatusBadRequest)
+		envelopeRequests.WithLabelValues(statusLabel(err)).Inc()
+		return
+	}
+
+	// Get deadline based on token claim.
+	deadline, err := env.getDeadline(p, cl)
 	if err != nil {
 		logx.Debug.Println("failed to get deadline:", err)
 		rw.WriteHeader(http.StatusBadRequest)
-		// NOTE: all errors returned by getDeadline are static strings, so using
-		// this as a label should be safe.
-		envelopeRequests.WithLabelValues(err.Error()).Inc()
+		envelopeRequests.WithLabelValues(statusLabel(err)).Inc()
 		return
 	}
 
+	if !p.acquire() {
+		logx.Debug.Println("profile grant limit reached")
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		envelopeRequests.WithLabelValues("profile-max-concurrent").Inc()
+		return
+	}
+	defer p.release()
+
+	class := env.classes.Classify(cl)
+	release, ok := env.grants.TryAcquire(class)
+	if !ok {
+		logx.Debug.Println("class grant limit reached")
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		envelopeRequests.WithLabelValues("class-max-concurrent").Inc()
+		return
+	}
+	defer release()
+
 	remote := net.ParseIP(host)
-	err = env.Grant(remote)
+	err = env.grant(req.Context(), remote, p.Ports...)
 	switch {
 	case err == address.ErrMaxConcurrent:
 		logx.Debug.Println("grant limit reached")
@@ -152,7 +244,7 @@ func (env *envelopeHandler) AllowRequest(rw http.ResponseWriter, req *http.Reque
 	if conn == nil {
 		logx.Debug.Println("setup websocket conn failed")
 		rw.WriteHeader(http.StatusInternalServerError)
-		rtx.PanicOnError(env.Revoke(remote), "Failed to remove rule for "+remote.String())
+		rtx.PanicOnError(env.revoke(req.Context(), remote, p.Ports...), "Failed to remove rule for "+remote.String())
 		envelopeRequests.WithLabelValues("websocket-setup-failure").Inc()
 		return
 	}
@@ -160,36 +252,95 @@ func (env *envelopeHandler) AllowRequest(rw http.ResponseWriter, req *http.Reque
 	// At this point, we want to wait for either the deadline (when the envelope
 	// service closes the connection) or the client to close the websocket conn
 	// (to signal completion). The call to wait closes the websocket conn.
-	env.wait(req.Context(), conn, deadline)
-
-	rtx.PanicOnError(env.Revoke(remote), "Failed to remove rule for "+remote.String())
+	s := newSession(p, cl, class, remote, deadline)
+	ctx, span := startSession(req.Context(), s)
+	reason := env.wait(ctx, conn, deadline, s)
+
+	// Read the final traffic counters before the rules are removed.
+	env.updateSession(s)
+	err = env.revoke(ctx, remote, p.Ports...)
+	s.finish(reason, err, env.audit)
+	endSession(span, s)
+	rtx.PanicOnError(err, "Failed to remove rule for "+remote.String())
 	envelopeRequests.WithLabelValues("success").Inc()
 }
 
-func (env *envelopeHandler) getDeadline(cl *jwt.Claims) (time.Time, error) {
+// update replaces the profiles and default timeout. Requests in progress keep
+// the profile selected when they started.
+func (env *envelopeHandler) update(profiles map[string]*Profile, timeout time.Duration) {
+	env.mu.Lock()
+	defer env.mu.Unlock()
+	env.profiles = profiles
+	env.timeout = timeout
+}
+
+// currentProfiles returns the current profiles by subject.
+func (env *envelopeHandler) currentProfiles() map[string]*Profile {
+	env.mu.RLock()
+	defer env.mu.RUnlock()
+	return env.profiles
+}
+
+// getProfile selects the profile for the token subject and verifies that the
+// token carries the custom claims required by that profile. Clients on the IP
+// allow list may omit the token, and then receive the allowed profile.
+func (env *envelopeHandler) getProfile(cl *jwt.Claims, custom *customClaims, allowed bool) (*Profile, error) {
+	env.mu.RLock()
+	defer env.mu.RUnlock()
+	if cl == nil && allowed {
+		// Allowed clients only receive the profile named for them, never the
+		// unrestricted fallback.
+		p, ok := env.profiles[env.allowed]
+		if !ok {
+			logx.Debug.Println("no profile for allowed client")
+			return nil, errNoAllowedProfile
+		}
+		return p, nil
+	}
 	if cl == nil && requireTokens {
 		logx.Debug.Println("missing claim")
-		return time.Time{}, fmt.Errorf("missing claim when tokens required")
+		return nil, errMissingClaim
+	}
+	if cl == nil {
+		// This could happen if tokens are not required.
+		return env.fallback, nil
+	}
+
+	// Clients of classes with Bypass, e.g. monitoring, may use the fallback.
+	p, ok := env.profiles[cl.Subject]
+	if !ok && !env.classes.Classify(cl).Bypass {
+		logx.Debug.Println("wrong subject claim")
+		return nil, errWrongSubject
+	}
+	if !ok {
+		p = env.fallback
 	}
+	if err := p.checkClaims(custom); err != nil {
+		logx.Debug.Println("required claims not satisfied:", err)
+		return nil, err
+	}
+	return p, nil
+}
+
+func (env *envelopeHandler) getDeadline(p *Profile, cl *jwt.Claims) (time.Time, error) {
+	env.mu.RLock()
+	timeout := env.timeout
+	env.mu.RUnlock()
 
 	// Calculate the earliest the deadline could be.
-	minDeadline := time.Now().Add(timeout)
+	now := time.Now()
+	minDeadline := now.Add(p.timeout(timeout))
 
 	if cl == nil {
 		// This could happen if tokens are not required.
 		return minDeadline, nil
 	}
 
-	if cl.Subject != env.subject && !controller.IsMonitoring(cl) {
-		logx.Debug.Println("wrong subject claim")
-		return time.Time{}, fmt.Errorf("wrong claim subject")
-	}
-
 	// Tests may run (possibly repeatedly) until the claim expires.
 	deadline := cl.Expiry.Time()
-	if deadline.Before(time.Now()) {
+	if deadline.Before(now) {
 		logx.Debug.Println("already past expiration")
-		return time.Time{}, fmt.Errorf("already past claim expiration")
+		return time.Time{}, errPastExpiration
 	}
 
 	// If the token deadline is even earlier than the minDeadline, reset to the
@@ -197,6 +348,10 @@ func (env *envelopeHandler) getDeadline(cl *jwt.Claims) (time.Time, error) {
 	if deadline.Before(minDeadline) {
 		deadline = minDeadline
 	}
+	// Never grant access for longer than the profile allows.
+	if p.MaxDuration.Duration > 0 && deadline.After(now.Add(p.MaxDuration.Duration)) {
+		deadline = now.Add(p.MaxDuration.Duration)
+	}
 	return deadline, nil
 }
 
@@ -219,7 +374,9 @@ func setupConn(writer http.ResponseWriter, request *http.Request) *websocket.Con
 	return conn
 }
 
-func (env *envelopeHandler) wait(ctx context.Context, c *websocket.Conn, dl time.Time) {
+// wait blocks until the session ends and returns the reason it ended. While
+// waiting, the session traffic counters are updated every counterInterval.
+func (env *envelopeHandler) wait(ctx context.Context, c *websocket.Conn, dl time.Time, s *session) string {
 	// NOTE: we are explicitly ignoring the error value from SetDeadline.
 	// Any error there will show up on read below.
 	c.SetReadDeadline(dl)
@@ -233,17 +390,32 @@ func (env *envelopeHandler) wait(ctx context.Context, c *websocket.Conn, dl time
 	// * parent context expires.
 	// * context deadline expires.
 	// * client disconnects (or writes data that we don't expect).
-	select {
-	case <-ctxdl.Done():
-	case <-chanio.ReadOnce(c.UnderlyingConn()):
+	closed := chanio.ReadOnce(c.UnderlyingConn())
+	t := time.NewTicker(counterInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctxdl.Done():
+			if ctx.Err() != nil {
+				return "canceled"
+			}
+			return "deadline"
+		case <-closed:
+			return "client-closed"
+		case <-t.C:
+			env.updateSession(s)
+		}
 	}
 }
 
 var mainCtx, mainCancel = context.WithCancel(context.Background())
-var getEnvelopeHandler = func(subject string, mgr address.Manager) envelopeHandler {
-	return envelopeHandler{
-		manager: mgr,
-		subject: subject,
+var getEnvelopeHandler = func(profiles map[string]*Profile, timeout time.Duration, mgr address.Manager) *envelopeHandler {
+	return &envelopeHandler{
+		manager:  mgr,
+		profiles: profiles,
+		fallback: &Profile{},
+		timeout:  timeout,
+		audit:    &auditLog{w: os.Stderr},
 	}
 }
 
@@ -252,28 +424,99 @@ func main() {
 	log.SetFlags(log.LUTC | log.Lshortfile | log.LstdFlags)
 	rtx.Must(flagx.ArgsFromEnv(flag.CommandLine), "Could not parse env args")
 
+	base, err := configFromFlags()
+	rtx.Must(err, "Failed to read configuration from flags")
+	cfg, err := loadConfig(configFile, base)
+	rtx.Must(err, "Failed to load configuration file %q", configFile)
+	rtx.Must(cfg.validate(), "Invalid configuration")
+	profiles, err := profileMap(cfg.Profiles)
+	rtx.Must(err, "Invalid profiles")
+	requireTokens = cfg.Token.Required
+
+	shutdown, err := setupTracing(mainCtx, cfg.TraceExporter, os.Stdout)
+	rtx.Must(err, "Failed to setup tracing")
+	defer shutdown(context.Background())
+
 	prom := prometheusx.MustServeMetrics()
 	defer prom.Close()
 
-	verify, err := token.NewVerifier(verifyKeys.Get()...)
+	verify, err := newVerifier(cfg.Token)
 	rtx.Must(err, "Failed to create token verifier")
+	keys := &keyring{}
+	keys.v.Store(verify)
 
 	var mgr address.Manager
 	if requireTokens {
-		mgr = address.NewIPManager(maxIPs)
+		mgr = address.NewIPManager(cfg.Address.MaxClients, cfg.commands())
 	} else {
 		mgr = &address.NullManager{}
 	}
-	env := getEnvelopeHandler(subject, mgr)
+	env := getEnvelopeHandler(profiles, cfg.Timeout.Duration, mgr)
+	env.audit, err = openAuditLog(cfg.AuditLog)
+	rtx.Must(err, "Failed to open audit log %q", cfg.AuditLog)
+	env.classes = cfg.Classes
+	env.grants, err = cfg.grantLimiter()
+	rtx.Must(err, "Invalid priority classes")
+
+	// Reject denied clients, and let allowed clients skip the token controller
+	// to receive the profile named for them.
 	p := controller.Paths{"/v0/envelope/access": true}
-	ctl, _ := controller.Setup(mainCtx, verify, requireTokens, machine, p, p)
+	opts := []controller.SetupOption{
+		controller.WithCustomClaim(newCustomClaims),
+		controller.WithAudience(cfg.Token.Audience...),
+	}
+	var ips *controller.IPListController
+	if cfg.IPLists != "" {
+		ips, err = controller.NewIPListController(cfg.IPLists, p)
+		rtx.Must(err, "Failed to load IP lists %q", cfg.IPLists)
+		env.allowed = cfg.IPListsProfile
+		opts = append(opts, controller.WithAllowListBypass())
+	}
+
+	// Reload the configuration when the file changes or on SIGHUP, and serve
+	// the effective configuration on the metrics server.
+	cm := &configManager{name: configFile, base: base, env: env, keys: keys, ips: ips, current: cfg}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	// Wait for the watcher to return before main does.
+	done, watched := mainCtx.Done(), make(chan struct{})
+	defer func() { <-watched }()
+	go func() {
+		defer close(watched)
+		if err := cm.watch(done, hup); err != nil {
+			log.Println("WARNING: configuration reload is disabled:", err)
+		}
+	}()
+	prom.Handler.(*http.ServeMux).Handle("/config", cm)
+
+	txc, err := cfg.txConfig()
+	rtx.Must(err, "Invalid txcontroller configuration")
+	opts = append(opts, controller.WithTxConfig(txc), controller.WithExcludeHandler(func(name string, err error) {
+		// Fail closed for the controllers the configuration requires: the token
+		// controller when tokens are required, and the tx controller, which
+		// Setup only builds when devices are configured.
+		if name == "tx" || cfg.Token.Required {
+			rtx.Must(err, "Failed to create %s controller", name)
+		}
+		log.Printf("WARNING: %s controller is disabled: %v", name, err)
+	}))
+	ctl, tx := controller.Setup(mainCtx, keys, requireTokens, cfg.Token.Machine, p, p, opts...)
+	if tx != nil {
+		// Serve the recent txcontroller rates on the metrics server for troubleshooting.
+		prom.Handler.(*http.ServeMux).Handle("/debug/txcontroller", tx)
+	}
 	// Handle all requests using the alice http handler chaining library.
 	// Start with request logging.
-	ac := alice.New(logger).Extend(ctl)
+	ac := alice.New(logger, tracing)
+	if ips != nil {
+		ac = ac.Append(ips.Limit)
+	}
+	ac = ac.Extend(ctl)
 	mux := http.NewServeMux()
 	mux.HandleFunc("/v0/envelope/access", env.AllowRequest)
 	srv := &http.Server{
-		Addr:    listenAddr,
+		Addr:    cfg.Listener.Address,
 		Handler: ac.Then(mux),
 
 		// NOTE: prevent connections from staying open indefinitely.
@@ -282,17 +525,17 @@ func main() {
 		ReadTimeout:  time.Minute,
 		WriteTimeout: time.Minute,
 	}
-	_, port, err := net.SplitHostPort(listenAddr)
-	rtx.Must(err, "failed to split listen address: %q", listenAddr)
-	err = mgr.Start(port, manageDevice)
-	rtx.Must(err, "failed to setup iptables management of %q", manageDevice)
+	_, port, err := net.SplitHostPort(cfg.Listener.Address)
+	rtx.Must(err, "failed to split listen address: %q", cfg.Listener.Address)
+	err = mgr.Start(port, cfg.Address.Device)
+	rtx.Must(err, "failed to setup iptables management of %q", cfg.Address.Device)
 	defer mgr.Stop()
 
-	if certFile != "" && keyFile != "" {
-		log.Println("Listening for secure access requests on " + listenAddr)
-		rtx.Must(httpx.ListenAndServeTLSAsync(srv, certFile, keyFile), "Could not start envelop server")
+	if cfg.TLS.Cert != "" && cfg.TLS.Key != "" {
+		log.Println("Listening for secure access requests on " + cfg.Listener.Address)
+		rtx.Must(httpx.ListenAndServeTLSAsync(srv, cfg.TLS.Cert, cfg.TLS.Key), "Could not start envelop server")
 	} else {
-		log.Println("Listening for INSECURE access requests on " + listenAddr)
+		log.Println("Listening for INSECURE access requests on " + cfg.Listener.Address)
 		rtx.Must(httpx.ListenAndServeAsync(srv), "Could not start envelop server")
 	}
 	defer srv.Close()
@@ -5,6 +5,7 @@ import (
 	"context"
 	"errors"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
@@ -59,6 +60,7 @@ func Test_main(t *testing.T) {
 	defer osx.MustSetenv("IP6TABLES_SAVE_EXIT", "0")()
 
 	// Simulate unencrypted server.
+	machine = "mlab1.fake0"
 	listenAddr = ":0"
 	*prometheusx.ListenAddress = ":0"
 	mainCancel()
@@ -69,21 +71,45 @@ func Test_main(t *testing.T) {
 	certFile = "testdata/insecure-cert.pem"
 	keyFile = "testdata/insecure-key.pem"
 	requireTokens = false // use NullManager.
+	profilesFile = []byte(`{"profiles": [{"subject": "ndt", "ports": ["3001:3010"], "max_clients": 1}]}`)
 	mainCancel()
 	main()
+	profilesFile = nil
+
+	// Simulate server using a configuration file.
+	mainCtx, mainCancel = context.WithCancel(context.Background())
+	configFile = "testdata/envelope.yaml"
+	mainCancel()
+	main()
+	configFile = ""
+
+	// Simulate server without tokens or a machine name, which runs without the
+	// token controller.
+	mainCtx, mainCancel = context.WithCancel(context.Background())
+	certFile, keyFile = "", ""
+	machine = ""
+	requireTokens = false
+	mainCancel()
+	main()
+	machine = "mlab1.fake0"
 }
 
 type fakeManager struct {
-	grantErr  error
-	revokeErr error
+	grantErr    error
+	revokeErr   error
+	counters    address.Counters
+	countersErr error
 }
 
-func (f *fakeManager) Grant(ip net.IP) error {
+func (f *fakeManager) Grant(ip net.IP, ports ...string) error {
 	return f.grantErr
 }
-func (f *fakeManager) Revoke(ip net.IP) error {
+func (f *fakeManager) Revoke(ip net.IP, ports ...string) error {
 	return f.revokeErr
 }
+func (f *fakeManager) Counters(ip net.IP, ports ...string) (address.Counters, error) {
+	return f.counters, f.countersErr
+}
 
 // Test_envelopeHandler_AllowRequest_Errors exercises error paths that cannot be
 // reached using the websocket client package directly.
@@ -96,7 +122,13 @@ func Test_envelopeHandler_AllowRequest_Errors(t *testing.T) {
 		code            int
 		allowEmptyClaim bool
 		claim           *jwt.Claims
+		custom          *customClaims
+		profile         *Profile
+		grants          *controller.ClassLimiter
+		classes         controller.Classes
 		grantErr        error
+		allowed         string
+		noAllowed       bool
 	}{
 		{
 			name:   "error-bad-method",
@@ -116,6 +148,25 @@ func Test_envelopeHandler_AllowRequest_Errors(t *testing.T) {
 			allowEmptyClaim: true,
 			remote:          "127.0.0.2:1234",
 		},
+		{
+			// Allowed clients without claims get the allowed profile, and reach
+			// the grant.
+			name:     "error-allowed-without-claim-max-concurrent",
+			method:   http.MethodGet,
+			code:     http.StatusServiceUnavailable,
+			remote:   "127.0.0.2:1234",
+			allowed:  "partner-test",
+			grantErr: address.ErrMaxConcurrent,
+		},
+		{
+			// Without an allowed profile, allowed clients need a token.
+			name:      "error-allowed-without-profile",
+			method:    http.MethodGet,
+			code:      http.StatusBadRequest,
+			remote:    "127.0.0.2:1234",
+			allowed:   "partner-test",
+			noAllowed: true,
+		},
 		{
 			name:   "error-remote-host-corrupt",
 			method: http.MethodGet,
@@ -132,6 +183,21 @@ func Test_envelopeHandler_AllowRequest_Errors(t *testing.T) {
 				Subject: "wrong-subject",
 			},
 		},
+		{
+			// Clients of a configured bypass class get the fallback profile, and
+			// reach the grant.
+			name:   "error-bypass-class-fallback-max-concurrent",
+			method: http.MethodGet,
+			code:   http.StatusServiceUnavailable,
+			remote: "127.0.0.2:1234",
+			claim: &jwt.Claims{
+				Issuer:  "monitoring",
+				Subject: "probe",
+				Expiry:  jwt.NewNumericDate(time.Now().Add(time.Minute)),
+			},
+			classes:  controller.Classes{{Name: "probes", Issuers: []string{"monitoring"}, Bypass: true}},
+			grantErr: address.ErrMaxConcurrent,
+		},
 		{
 			name:   "error-claim-is-already-expired",
 			method: http.MethodGet,
@@ -167,21 +233,105 @@ func Test_envelopeHandler_AllowRequest_Errors(t *testing.T) {
 			},
 			grantErr: errors.New("generic grant error"),
 		},
+		{
+			name:   "error-profile-missing-required-claim",
+			method: http.MethodGet,
+			code:   http.StatusBadRequest,
+			remote: "127.0.0.2:1234",
+			claim: &jwt.Claims{
+				Issuer:  "locate",
+				Subject: subject,
+				Expiry:  jwt.NewNumericDate(time.Now().Add(time.Minute)),
+			},
+			profile: &Profile{
+				Subject:        subject,
+				RequiredClaims: map[string]string{"tier": ""},
+			},
+		},
+		{
+			name:   "error-profile-wrong-required-claim",
+			method: http.MethodGet,
+			code:   http.StatusBadRequest,
+			remote: "127.0.0.2:1234",
+			claim: &jwt.Claims{
+				Issuer:  "locate",
+				Subject: subject,
+				Expiry:  jwt.NewNumericDate(time.Now().Add(time.Minute)),
+			},
+			custom: &customClaims{"tier": "0"},
+			profile: &Profile{
+				Subject:        subject,
+				RequiredClaims: map[string]string{"tier": "1"},
+			},
+		},
+		{
+			name:   "error-profile-max-concurrent",
+			method: http.MethodGet,
+			code:   http.StatusServiceUnavailable,
+			remote: "127.0.0.2:1234",
+			claim: &jwt.Claims{
+				Issuer:  "locate",
+				Subject: subject,
+				Expiry:  jwt.NewNumericDate(time.Now().Add(time.Minute)),
+			},
+			custom: &customClaims{"tier": "1"},
+			profile: &Profile{
+				Subject:        subject,
+				RequiredClaims: map[string]string{"tier": "1"},
+				// Initialize with a limit, then exhaust it below.
+				MaxClients: 1,
+			},
+		},
+		{
+			name:   "error-class-max-concurrent",
+			method: http.MethodGet,
+			code:   http.StatusServiceUnavailable,
+			remote: "127.0.0.2:1234",
+			claim: &jwt.Claims{
+				Issuer:  "locate",
+				Subject: subject,
+				Expiry:  jwt.NewNumericDate(time.Now().Add(time.Minute)),
+			},
+			// All grants are reserved for another class.
+			grants: must(controller.NewClassLimiter(1, controller.Classes{{Name: "premium", Reserved: 1}})),
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			rw := httptest.NewRecorder()
 			req := httptest.NewRequest(tt.method, "/v0/envelope/access", nil)
+			if tt.profile == nil {
+				tt.profile = &Profile{Subject: subject}
+			}
+			rtx.Must(tt.profile.init(), "failed to init profile")
+			if tt.profile.MaxClients > 0 {
+				// Exhaust the profile limit.
+				tt.profile.acquire()
+			}
 			env := &envelopeHandler{
 				manager: &fakeManager{
 					grantErr: tt.grantErr,
 				},
-				subject: "envelope",
+				profiles: map[string]*Profile{subject: tt.profile},
+				fallback: &Profile{},
+				allowed:  subject,
+				timeout:  time.Minute,
+				grants:   tt.grants,
+				classes:  tt.classes,
+			}
+			if tt.noAllowed {
+				env.allowed = ""
 			}
 			requireTokens = !tt.allowEmptyClaim
 			if tt.claim != nil {
 				req = req.Clone(controller.SetClaim(req.Context(), tt.claim))
 			}
+			if tt.custom != nil {
+				req = req.Clone(controller.SetCustomClaim(req.Context(), tt.custom))
+			}
+			if tt.allowed != "" {
+				req = req.Clone(controller.SetAllowed(req.Context(), tt.allowed))
+			}
 
 			req.RemoteAddr = tt.remote
 			env.AllowRequest(rw, req)
@@ -195,6 +345,8 @@ func Test_envelopeHandler_AllowRequest_Errors(t *testing.T) {
 
 func Test_envelopeHandler_AllowRequest_Websocket(t *testing.T) {
 	subject := "envelope"
+	// Read traffic counters during sessions that wait for the timeout.
+	counterInterval = 100 * time.Millisecond
 	tests := []struct {
 		name      string
 		code      int
@@ -246,7 +398,9 @@ func Test_envelopeHandler_AllowRequest_Websocket(t *testing.T) {
 				manager: &fakeManager{
 					revokeErr: tt.revokeErr,
 				},
-				subject: "envelope",
+				profiles: map[string]*Profile{subject: {Subject: subject}},
+				fallback: &Profile{},
+				timeout:  time.Minute,
 			}
 			requireTokens = true
 			// Create a synthetic token claim handler that adds the unit test
@@ -322,3 +476,28 @@ func Test_customFormat(t *testing.T) {
 		})
 	}
 }
+
+func Test_statusLabel(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "missing-claim", err: errMissingClaim, want: "missing-claim"},
+		{name: "wrong-required-claim", err: fmt.Errorf("%w: role", errWrongRequiredClaim), want: "wrong-required-claim"},
+		{name: "expired", err: errPastExpiration, want: "expired"},
+		{name: "bad-request", err: errors.New("client-provided value"), want: "bad-request"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := statusLabel(tt.err); got != tt.want {
+				t.Errorf("statusLabel() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func must(l *controller.ClassLimiter, err error) *controller.ClassLimiter {
+	rtx.Must(err, "failed to create class limiter")
+	return l
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+
+	"github.com/m-lab/access/address"
+)
+
+var (
+	errMissingRequiredClaim = errors.New("missing required claim")
+	errWrongRequiredClaim   = errors.New("wrong required claim")
+)
+
+// Duration is a time.Duration that is encoded in JSON as a string, e.g. "90s".
+type Duration struct {
+	time.Duration
+}
+
+// MarshalJSON encodes the duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON decodes the duration from a string parsed by time.ParseDuration.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// Profile describes the access the envelope grants to clients presenting
+// tokens issued for a single subject (service name).
+type Profile struct {
+	// Subject is the token subject claim that selects this profile.
+	Subject string `json:"subject"`
+
+	// Ports limits granted clients to these destination ports. Each port is
+	// either a single port or an inclusive range, e.g. "3001:3010". When
+	// empty, granted clients may connect to any port.
+	Ports []string `json:"ports,omitempty"`
+
+	// MaxClients is the maximum number of concurrent grants for this profile.
+	// When zero, only the envelope-wide limit applies.
+	MaxClients int64 `json:"max_clients,omitempty"`
+
+	// Timeout is the default grant duration. Valid tokens keep their grant
+	// until token expiration, or at least until Timeout. When zero, the
+	// envelope-wide -timeout is used.
+	Timeout Duration `json:"timeout,omitempty"`
+
+	// MaxDuration caps the grant duration regardless of token expiration.
+	// When zero, grants last until token expiration. MaxDuration must not be
+	// less than the Timeout, or the envelope-wide -timeout when Timeout is
+	// zero.
+	MaxDuration Duration `json:"max_duration,omitempty"`
+
+	// RequiredClaims names custom token claims that must be present. When a
+	// claim's value is non-empty, the token claim must also equal that value.
+	RequiredClaims map[string]string `json:"required_claims,omitempty"`
+
+	sem *semaphore.Weighted
+}
+
+// profilesConfig is the format of the file given to -envelope.profiles.
+type profilesConfig struct {
+	Profiles []*Profile `json:"profiles"`
+}
+
+// customClaims collects all token claims for checking Profile.RequiredClaims.
+type customClaims map[string]any
+
+// newCustomClaims allocates a destination for custom claims per request.
+func newCustomClaims() any {
+	return &customClaims{}
+}
+
+// profileMap validates and initializes profiles, returning them by subject.
+func profileMap(list []*Profile) (map[string]*Profile, error) {
+	profiles := map[string]*Profile{}
+	for _, p := range list {
+		if _, ok := profiles[p.Subject]; ok {
+			return nil, fmt.Errorf("duplicate profile subject: %q", p.Subject)
+		}
+		if err := p.init(); err != nil {
+			return nil, err
+		}
+		profiles[p.Subject] = p
+	}
+	return profiles, nil
+}
+
+// keepGrants returns copies of the profiles for a configuration reload. Each
+// copy shares the grant limit of the current profile with the same subject and
+// MaxClients, so that grants outstanding before the reload still count against
+// the limit. Other copies get a new grant limit from init.
+func keepGrants(list []*Profile, current map[string]*Profile) []*Profile {
+	kept := make([]*Profile, 0, len(list))
+	for _, p := range list {
+		np := *p
+		np.sem = nil
+		if old, ok := current[p.Subject]; ok && old.MaxClients == p.MaxClients {
+			np.sem = old.sem
+		}
+		kept = append(kept, &np)
+	}
+	return kept
+}
+
+// init validates the profile and allocates its grant limit. Calling init on an
+// initialized profile preserves its grant limit; see keepGrants.
+func (p *Profile) init() error {
+	if p.Subject == "" {
+		return errors.New("profile subject must not be empty")
+	}
+	if err := address.CheckPorts(p.Ports); err != nil {
+		return fmt.Errorf("profile %q: %w", p.Subject, err)
+	}
+	if p.MaxClients < 0 || p.Timeout.Duration < 0 || p.MaxDuration.Duration < 0 {
+		return fmt.Errorf("profile %q: limits must not be negative", p.Subject)
+	}
+	if p.MaxDuration.Duration > 0 && p.MaxDuration.Duration < p.Timeout.Duration {
+		return fmt.Errorf("profile %q: max_duration is less than timeout", p.Subject)
+	}
+	if p.MaxClients > 0 && p.sem == nil {
+		p.sem = semaphore.NewWeighted(p.MaxClients)
+	}
+	return nil
+}
+
+// acquire reserves a grant for this profile. The caller must call release
+// after the grant is revoked.
+func (p *Profile) acquire() bool {
+	if p.sem == nil {
+		return true
+	}
+	return p.sem.TryAcquire(1)
+}
+
+// release returns a grant previously reserved by acquire.
+func (p *Profile) release() {
+	if p.sem != nil {
+		p.sem.Release(1)
+	}
+}
+
+// timeout returns the profile default grant duration, or def if unset.
+func (p *Profile) timeout(def time.Duration) time.Duration {
+	if p.Timeout.Duration > 0 {
+		return p.Timeout.Duration
+	}
+	return def
+}
+
+// checkClaims verifies that the custom claims satisfy RequiredClaims.
+func (p *Profile) checkClaims(custom *customClaims) error {
+	for name, want := range p.RequiredClaims {
+		if custom == nil {
+			return errMissingRequiredClaim
+		}
+		v, ok := (*custom)[name]
+		if !ok {
+			return errMissingRequiredClaim
+		}
+		if want != "" && fmt.Sprint(v) != want {
+			return errWrongRequiredClaim
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+func Test_profileMap(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		want    map[string]time.Duration
+		wantErr bool
+	}{
+		{
+			name: "success",
+			config: `{"profiles": [
+				{"subject": "ndt", "ports": ["3001:3010"], "max_clients": 2, "timeout": "30s", "max_duration": "2m"},
+				{"subject": "wehe", "required_claims": {"tier": "1"}}
+			]}`,
+			want: map[string]time.Duration{"ndt": 30 * time.Second, "wehe": 0},
+		},
+		{
+			name:    "error-bad-json",
+			config:  `{"profiles": [`,
+			wantErr: true,
+		},
+		{
+			name:    "error-bad-duration",
+			config:  `{"profiles": [{"subject": "ndt", "timeout": "thirty seconds"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "error-duration-not-a-string",
+			config:  `{"profiles": [{"subject": "ndt", "timeout": 30}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "error-empty-subject",
+			config:  `{"profiles": [{"subject": ""}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "error-duplicate-subject",
+			config:  `{"profiles": [{"subject": "ndt"}, {"subject": "ndt"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "error-bad-ports",
+			config:  `{"profiles": [{"subject": "ndt", "ports": ["http"]}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "error-negative-limit",
+			config:  `{"profiles": [{"subject": "ndt", "max_clients": -1}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "error-max-duration-less-than-timeout",
+			config:  `{"profiles": [{"subject": "ndt", "timeout": "1m", "max_duration": "30s"}]}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got map[string]*Profile
+			cfg := profilesConfig{}
+			err := json.Unmarshal([]byte(tt.config), &cfg)
+			if err == nil {
+				got, err = profileMap(cfg.Profiles)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("profileMap() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("profileMap() wrong number of profiles; got %d, want %d", len(got), len(tt.want))
+			}
+			for subject, timeout := range tt.want {
+				p, ok := got[subject]
+				if !ok {
+					t.Fatalf("profileMap() missing profile %q", subject)
+				}
+				if p.Timeout.Duration != timeout {
+					t.Errorf("profileMap() wrong timeout; got %v, want %v", p.Timeout, timeout)
+				}
+			}
+		})
+	}
+}
+
+func TestProfile_acquire(t *testing.T) {
+	p := &Profile{Subject: "ndt", MaxClients: 1}
+	if err := p.init(); err != nil {
+		t.Fatalf("Profile.init() failed: %v", err)
+	}
+	if !p.acquire() {
+		t.Fatalf("Profile.acquire() failed first grant")
+	}
+	if p.acquire() {
+		t.Errorf("Profile.acquire() allowed more than MaxClients grants")
+	}
+	p.release()
+	if !p.acquire() {
+		t.Errorf("Profile.acquire() failed after release")
+	}
+
+	// Profiles without a limit always acquire.
+	unlimited := &Profile{Subject: "wehe"}
+	if !unlimited.acquire() || !unlimited.acquire() {
+		t.Errorf("Profile.acquire() failed without MaxClients")
+	}
+	unlimited.release()
+}
+
+func Test_envelopeHandler_getDeadline(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile *Profile
+		expiry  time.Duration
+		want    time.Duration
+	}{
+		{
+			name:    "success-token-expiry",
+			profile: &Profile{},
+			expiry:  5 * time.Minute,
+			want:    5 * time.Minute,
+		},
+		{
+			name:    "success-global-timeout",
+			profile: &Profile{},
+			expiry:  time.Second,
+			want:    time.Minute,
+		},
+		{
+			name:    "success-profile-timeout",
+			profile: &Profile{Timeout: Duration{2 * time.Minute}},
+			expiry:  time.Second,
+			want:    2 * time.Minute,
+		},
+		{
+			name:    "success-profile-max-duration",
+			profile: &Profile{MaxDuration: Duration{3 * time.Minute}},
+			expiry:  time.Hour,
+			want:    3 * time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := &envelopeHandler{timeout: time.Minute}
+			start := time.Now()
+			cl := &jwt.Claims{Expiry: jwt.NewNumericDate(start.Add(tt.expiry))}
+			got, err := env.getDeadline(tt.profile, cl)
+			if err != nil {
+				t.Fatalf("getDeadline() returned error: %v", err)
+			}
+			// NumericDate has one second resolution.
+			if d := got.Sub(start.Add(tt.want)); d < -time.Second || d > time.Second {
+				t.Errorf("getDeadline() wrong deadline; got %v, want %v", got.Sub(start), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/m-lab/access/address"
+	"github.com/m-lab/access/controller"
+	"github.com/m-lab/go/logx"
+)
+
+var (
+	// counterInterval is how often the traffic counters of active sessions are read.
+	counterInterval = 10 * time.Second
+
+	sessionBytes = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "envelope_session_bytes",
+			Help:    "Distribution of bytes received from granted clients per session.",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 12), // 1KiB to 4GiB.
+		},
+		[]string{"subject"},
+	)
+	sessionPackets = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "envelope_session_packets",
+			Help:    "Distribution of packets received from granted clients per session.",
+			Buckets: prometheus.ExponentialBuckets(10, 4, 12),
+		},
+		[]string{"subject"},
+	)
+	sessionDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "envelope_session_duration_seconds",
+			Help:    "Distribution of granted session durations.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+		},
+		[]string{"subject"},
+	)
+	grantedBytes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "envelope_granted_bytes_total",
+			Help: "Total bytes received from granted clients, updated while sessions are active.",
+		},
+		[]string{"subject"},
+	)
+	grantedPackets = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "envelope_granted_packets_total",
+			Help: "Total packets received from granted clients, updated while sessions are active.",
+		},
+		[]string{"subject"},
+	)
+)
+
+// counter is implemented by managers that read the traffic counters of the
+// rules granted to an IP and ports.
+type counter interface {
+	Counters(ip net.IP, ports ...string) (address.Counters, error)
+}
+
+var _ counter = &address.IPManager{}
+
+// tokenRecord summarizes the verified access token claims of a session.
+type tokenRecord struct {
+	ID       string    `json:"id,omitempty"`
+	Issuer   string    `json:"issuer"`
+	Subject  string    `json:"subject"`
+	Audience []string  `json:"audience"`
+	Expiry   time.Time `json:"expiry"`
+}
+
+// session accounts for the traffic of one granted client. When finished, the
+// session is written to the audit log as a single JSON record.
+type session struct {
+	Subject     string       `json:"subject"`
+	Token       *tokenRecord `json:"token,omitempty"`
+	Client      string       `json:"client"`
+	Subnet      string       `json:"subnet"`
+	Ports       []string     `json:"ports,omitempty"`
+	Start       time.Time    `json:"start"`
+	Deadline    time.Time    `json:"deadline"`
+	End         time.Time    `json:"end"`
+	Duration    float64      `json:"duration_seconds"`
+	Reason      string       `json:"reason"`
+	Revoked     bool         `json:"revoked"`
+	RevokeError string       `json:"revoke_error,omitempty"`
+	address.Counters
+
+	remote   net.IP
+	reported address.Counters
+}
+
+// newSession starts accounting for the client granted access until deadline.
+// The session subject is a bounded label derived from the selected profile, or
+// the name of a priority class with Bypass.
+func newSession(p *Profile, cl *jwt.Claims, class *controller.Class, remote net.IP, deadline time.Time) *session {
+	subject := p.Subject
+	switch {
+	case class.Bypass:
+		subject = class.Name
+	case subject == "":
+		subject = "none"
+	}
+	s := &session{
+		Subject:  subject,
+		Client:   remote.String(),
+		Subnet:   address.Subnet(remote).String(),
+		Ports:    p.Ports,
+		Start:    time.Now().UTC(),
+		Deadline: deadline.UTC(),
+		remote:   remote,
+	}
+	if cl != nil {
+		s.Token = &tokenRecord{
+			ID:       cl.ID,
+			Issuer:   cl.Issuer,
+			Subject:  cl.Subject,
+			Audience: cl.Audience,
+			Expiry:   cl.Expiry.Time().UTC(),
+		}
+	}
+	return s
+}
+
+// update reads the current counters and exports the traffic since the last
+// update. Counters must be read before the grant is revoked.
+func (s *session) update(c counter) {
+	cur, err := c.Counters(s.remote, s.Ports...)
+	if err != nil {
+		logx.Debug.Println("failed to read counters for", s.Client, err)
+		return
+	}
+	// Rules may be shared with other clients in the same subnet and removed
+	// by their revocation, so never report a decrease.
+	if cur.Packets < s.reported.Packets || cur.Bytes < s.reported.Bytes {
+		return
+	}
+	delta := cur.Sub(s.reported)
+	grantedPackets.WithLabelValues(s.Subject).Add(float64(delta.Packets))
+	grantedBytes.WithLabelValues(s.Subject).Add(float64(delta.Bytes))
+	s.reported = cur
+	s.Counters = cur
+}
+
+// updateSession updates the session counters when the manager reads them.
+func (env *envelopeHandler) updateSession(s *session) {
+	if c, ok := env.manager.(counter); ok {
+		s.update(c)
+	}
+}
+
+// finish records how the session ended and whether the grant was revoked,
+// exports the session totals and writes the session record to the audit log,
+// when the audit log is not nil. Callers should update the counters before
+// revoking the grant.
+func (s *session) finish(reason string, revokeErr error, audit *auditLog) {
+	s.End = time.Now().UTC()
+	s.Duration = s.End.Sub(s.Start).Seconds()
+	s.Reason = reason
+	s.Revoked = revokeErr == nil
+	if revokeErr != nil {
+		s.RevokeError = revokeErr.Error()
+	}
+	sessionBytes.WithLabelValues(s.Subject).Observe(float64(s.Bytes))
+	sessionPackets.WithLabelValues(s.Subject).Observe(float64(s.Packets))
+	sessionDuration.WithLabelValues(s.Subject).Observe(s.Duration)
+	audit.write(s)
+}
+
+// auditLog writes newline delimited JSON records, e.g. for loading into
+// BigQuery. An auditLog is safe for concurrent use.
+type auditLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// openAuditLog appends records to the named file, or to stderr when name is
+// empty.
+func openAuditLog(name string) (*auditLog, error) {
+	if name == "" {
+		return &auditLog{w: os.Stderr}, nil
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{w: f}, nil
+}
+
+// write writes v as a single JSON record. A nil auditLog discards records.
+func (a *auditLog) write(v any) {
+	if a == nil {
+		return
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		logx.Debug.Println("failed to marshal audit record:", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(append(b, '\n')); err != nil {
+		logx.Debug.Println("failed to write audit record:", err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+
+	"github.com/m-lab/access/address"
+	"github.com/m-lab/access/controller"
+)
+
+func Test_newSession(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile *Profile
+		claim   *jwt.Claims
+		classes controller.Classes
+		want    string
+	}{
+		{
+			name:    "profile-subject",
+			profile: &Profile{Subject: "ndt"},
+			claim:   &jwt.Claims{Subject: "ndt"},
+			want:    "ndt",
+		},
+		{
+			name:    "monitoring",
+			profile: &Profile{},
+			claim:   &jwt.Claims{Subject: "monitoring"},
+			want:    "monitoring",
+		},
+		{
+			name:    "bypass-class-by-issuer",
+			profile: &Profile{},
+			claim:   &jwt.Claims{Issuer: "monitoring", Subject: "probe-1234"},
+			classes: controller.Classes{{Name: "probes", Issuers: []string{"monitoring"}, Bypass: true}},
+			want:    "probes",
+		},
+		{
+			name:    "no-claim",
+			profile: &Profile{},
+			want:    "none",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSession(tt.profile, tt.claim, tt.classes.Classify(tt.claim), net.ParseIP("192.0.2.1"), time.Now())
+			if s.Subject != tt.want {
+				t.Errorf("newSession() wrong subject; got %q, want %q", s.Subject, tt.want)
+			}
+		})
+	}
+}
+
+func Test_session_finish(t *testing.T) {
+	mgr := &fakeManager{counters: address.Counters{Packets: 10, Bytes: 1000}}
+	cl := &jwt.Claims{
+		ID:       "abc123",
+		Issuer:   "locate",
+		Subject:  "ndt",
+		Audience: jwt.Audience{"mlab1.fake0"},
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	}
+	p := &Profile{Subject: "ndt", Ports: []string{"3001:3010"}}
+	s := newSession(p, cl, controller.Classes(nil).Classify(cl), net.ParseIP("192.0.2.1"), time.Now().Add(time.Minute))
+
+	s.update(mgr)
+	if s.Counters != mgr.counters {
+		t.Errorf("session.update() wrong counters; got %v, want %v", s.Counters, mgr.counters)
+	}
+	// Errors and decreasing counters leave the session counters unchanged.
+	mgr.countersErr = errors.New("fake counters error")
+	s.update(mgr)
+	mgr.countersErr = nil
+	mgr.counters = address.Counters{Packets: 1, Bytes: 100}
+	s.update(mgr)
+	if s.Counters.Bytes != 1000 {
+		t.Errorf("session.update() wrong counters; got %v, want 1000 bytes", s.Counters)
+	}
+
+	mgr.counters = address.Counters{Packets: 20, Bytes: 3000}
+	s.update(mgr)
+	w := &bytes.Buffer{}
+	s.finish("client-closed", nil, &auditLog{w: w})
+
+	got := map[string]any{}
+	if err := json.Unmarshal(w.Bytes(), &got); err != nil {
+		t.Fatalf("session.finish() wrote invalid record %q: %v", w.String(), err)
+	}
+	want := map[string]any{
+		"subject": "ndt",
+		"client":  "192.0.2.1",
+		"subnet":  "192.0.2.0/24",
+		"reason":  "client-closed",
+		"revoked": true,
+		"packets": float64(20),
+		"bytes":   float64(3000),
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("session.finish() wrong %s; got %v, want %v", k, got[k], v)
+		}
+	}
+	tok, ok := got["token"].(map[string]any)
+	if !ok || tok["id"] != "abc123" || tok["issuer"] != "locate" || tok["subject"] != "ndt" {
+		t.Errorf("session.finish() wrong token record; got %v", got["token"])
+	}
+	if s.End.Before(s.Start) || s.Deadline.Before(s.Start) {
+		t.Errorf("session.finish() wrong timings; start %v, deadline %v, end %v", s.Start, s.Deadline, s.End)
+	}
+
+	// Revoke errors are recorded, and a nil audit log is allowed.
+	s.finish("deadline", errors.New("fake revoke error"), nil)
+	if s.Revoked || s.RevokeError != "fake revoke error" {
+		t.Errorf("session.finish() wrong revoke result; got %v %q", s.Revoked, s.RevokeError)
+	}
+}
+
+// grantManager grants access without reading traffic counters.
+type grantManager struct{}
+
+func (grantManager) Grant(ip net.IP, ports ...string) error  { return nil }
+func (grantManager) Revoke(ip net.IP, ports ...string) error { return nil }
+
+func Test_envelopeHandler_updateSession(t *testing.T) {
+	p := &Profile{Subject: "ndt"}
+	s := newSession(p, nil, controller.Classes(nil).Classify(nil), net.ParseIP("192.0.2.1"), time.Now().Add(time.Minute))
+	mgr := &fakeManager{counters: address.Counters{Packets: 10, Bytes: 1000}}
+	(&envelopeHandler{manager: mgr}).updateSession(s)
+	if s.Counters != mgr.counters {
+		t.Errorf("updateSession() wrong counters; got %v, want %v", s.Counters, mgr.counters)
+	}
+	// Managers without counters leave the session counters unchanged.
+	(&envelopeHandler{manager: grantManager{}}).updateSession(s)
+	if s.Counters != mgr.counters {
+		t.Errorf("updateSession() wrong counters; got %v, want %v", s.Counters, mgr.counters)
+	}
+}
+
+func Test_openAuditLog(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "audit.json")
+	for i := 0; i < 2; i++ {
+		a, err := openAuditLog(name)
+		if err != nil {
+			t.Fatalf("openAuditLog() failed: %v", err)
+		}
+		a.write(map[string]int{"n": i})
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("failed to read audit log: %v", err)
+	}
+	if string(b) != "{\"n\":0}\n{\"n\":1}\n" {
+		t.Errorf("openAuditLog() did not append records; got %q", b)
+	}
+	if a, err := openAuditLog(""); err != nil || a.w != os.Stderr {
+		t.Errorf("openAuditLog() default should be stderr; got %v, %v", a, err)
+	}
+	if _, err := openAuditLog(filepath.Join(name, "not-a-dir")); err == nil {
+		t.Errorf("openAuditLog() expected error for invalid path")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/m-lab/access/address"
+)
+
+// tracerName is the instrumentation scope of envelope spans.
+const tracerName = "github.com/m-lab/access/cmd/envelope"
+
+// setupTracing installs a global TracerProvider that exports spans with the
+// named exporter: "otlp" sends spans to an OpenTelemetry collector over HTTP,
+// configured by the standard OTEL_EXPORTER_OTLP_* environment variables
+// (default localhost:4318), and "stdout" writes spans as JSON to w. When the
+// exporter is empty, tracing is disabled. The returned function flushes and
+// stops the exporter.
+func setupTracing(ctx context.Context, exporter string, w io.Writer) (func(context.Context) error, error) {
+	var exp sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exp, err = otlptracehttp.New(ctx)
+	case "stdout":
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(w))
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp))
+	otel.SetTracerProvider(tp)
+	// Continue traces from the W3C traceparent header of incoming requests.
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+	return tp.Shutdown, nil
+}
+
+// tracing starts a span for every request, continuing any trace propagated
+// by the client. The access controllers and the envelope handler record their
+// spans as children of the request span.
+func tracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := otel.Tracer(tracerName).Start(ctx, "envelope.request",
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+			))
+		defer span.End()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// contextManager is implemented by managers that record spans for grants.
+type contextManager interface {
+	GrantContext(ctx context.Context, ip net.IP, ports ...string) error
+	RevokeContext(ctx context.Context, ip net.IP, ports ...string) error
+}
+
+var _ contextManager = &address.IPManager{}
+
+// grant grants access to the remote IP, passing ctx to managers that record
+// spans.
+func (env *envelopeHandler) grant(ctx context.Context, remote net.IP, ports ...string) error {
+	if m, ok := env.manager.(contextManager); ok {
+		return m.GrantContext(ctx, remote, ports...)
+	}
+	return env.Grant(remote, ports...)
+}
+
+// revoke revokes access like grant.
+func (env *envelopeHandler) revoke(ctx context.Context, remote net.IP, ports ...string) error {
+	if m, ok := env.manager.(contextManager); ok {
+		return m.RevokeContext(ctx, remote, ports...)
+	}
+	return env.Revoke(remote, ports...)
+}
+
+// startSession starts a span covering the granted session.
+func startSession(ctx context.Context, s *session) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, "envelope.session", trace.WithAttributes(
+		attribute.String("envelope.subject", s.Subject),
+		attribute.String("envelope.subnet", s.Subnet),
+		attribute.StringSlice("envelope.ports", s.Ports),
+		attribute.String("envelope.deadline", s.Deadline.String()),
+	))
+}
+
+// endSession records the finished session and ends the span.
+func endSession(span trace.Span, s *session) {
+	span.SetAttributes(
+		attribute.String("envelope.reason", s.Reason),
+		attribute.Bool("envelope.revoked", s.Revoked),
+		attribute.Int64("envelope.bytes", int64(s.Bytes)),
+		attribute.Int64("envelope.packets", int64(s.Packets)),
+	)
+	span.End()
+}
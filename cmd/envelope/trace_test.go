@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+func Test_setupTracing(t *testing.T) {
+	if _, err := setupTracing(context.Background(), "unknown", nil); err == nil {
+		t.Errorf("setupTracing() unknown exporter did not fail")
+	}
+	shutdown, err := setupTracing(context.Background(), "", nil)
+	if err != nil || shutdown(context.Background()) != nil {
+		t.Errorf("setupTracing() disabled failed: %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	shutdown, err = setupTracing(context.Background(), "stdout", buf)
+	if err != nil {
+		t.Fatalf("setupTracing() failed: %v", err)
+	}
+	// Continue the client trace from the traceparent header.
+	parent := "4bf92f3577b34da6a3ce929d0e0e4736"
+	var got trace.SpanContext
+	h := tracing(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = trace.SpanContextFromContext(r.Context())
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/v0/envelope/access", nil)
+	req.Header.Set("traceparent", "00-"+parent+"-00f067aa0ba902b7-01")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if got.TraceID().String() != parent {
+		t.Errorf("tracing() did not continue trace; got %s, want %s", got.TraceID(), parent)
+	}
+
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown() failed: %v", err)
+	}
+	if !strings.Contains(buf.String(), `"Name":"envelope.request"`) {
+		t.Errorf("setupTracing() did not export request span; got %s", buf.String())
+	}
+}
@@ -13,15 +13,17 @@ import (
 )
 
 var (
-	privKey flagx.FileBytes
-	subject string
-	machine string
+	privKey  flagx.FileBytes
+	subject  string
+	machine  string
+	clientIP string
 )
 
 func init() {
 	flag.Var(&privKey, "private", "Private JWT format key used for signing")
 	flag.StringVar(&subject, "subject", "", "Subject to use in the jwt Claim")
 	flag.StringVar(&machine, "machine", "", "Short machine name used as Audience in the jwt Claim")
+	flag.StringVar(&clientIP, "client-ip", "", "Optional client IP or CIDR subnet to bind the token to in the cnf Claim")
 }
 
 func main() {
@@ -46,9 +48,18 @@ func main() {
 	}
 	pretty.Print(cl)
 
+	// Optionally, bind the token to the client address. Verifiers reject the
+	// token when presented from any other address.
+	var extra []any
+	if clientIP != "" {
+		cnf := token.ConfirmationClaims{Confirmation: &token.Confirmation{IP: clientIP}}
+		pretty.Print(cnf)
+		extra = append(extra, cnf)
+	}
+
 	// Signing the claim generates the compact, JWT string. Normally, this would
 	// be added as the access_token= parameter.
-	token, err := priv.Sign(cl)
+	token, err := priv.Sign(cl, extra...)
 	rtx.Must(err, "Failed to sign claims")
 	fmt.Printf("http://localhost:8800/v0/allow?access_token=%s\n", token)
 }
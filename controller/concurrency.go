@@ -0,0 +1,222 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sync/semaphore"
+)
+
+var (
+	concurrencyRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "controller_access_concurrency_requests_total",
+			Help: "Total number of requests handled by the access concurrency controller.",
+		},
+		[]string{"request", "protocol", "reason"},
+	)
+	concurrencyCurrent = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "controller_access_concurrency_current",
+			Help: "Current number of in-flight enforced requests and connections.",
+		},
+	)
+
+	// ErrInvalidLimit is returned when a negative concurrency limit is given.
+	ErrInvalidLimit = errors.New("concurrency limits must not be negative")
+)
+
+// ConcurrencyConfig configures a ConcurrencyController.
+type ConcurrencyConfig struct {
+	// Max is the maximum number of concurrent enforced requests and raw
+	// connections. When zero, only the per-path limits apply.
+	Max int64
+
+	// PathMax is the maximum number of concurrent requests for individual
+	// enforced paths, in addition to Max.
+	PathMax map[string]int64
+
+	// Classes are the priority classes of clients. Classes with Bypass are
+	// not limited or counted, and the Reserved capacity of classes is part of
+	// Max. When nil, the DefaultClasses are used.
+	Classes Classes
+}
+
+// ConcurrencyController limits the number of in-flight enforced requests and
+// raw connections. Unlike the TxController, which observes the rate after
+// clients are admitted, the ConcurrencyController counts clients as they are
+// admitted, so a burst of new clients cannot exceed the limit.
+type ConcurrencyController struct {
+	max     *ClassLimiter
+	pathMax map[string]*semaphore.Weighted
+	classes Classes
+	current int64
+
+	// Enforced is a set of HTTP request resource paths on which the
+	// ConcurrencyController will enforce limits. Any resource missing from the
+	// Enforced set, is allowed. When the ConcurrencyController is used for
+	// Accept(), these paths have no effect.
+	Enforced Paths
+}
+
+// NewConcurrencyController creates a new instance that limits concurrent
+// requests to the enforced paths.
+func NewConcurrencyController(enforced Paths, cfg ConcurrencyConfig) (*ConcurrencyController, error) {
+	if enforced == nil {
+		return nil, ErrNilPaths
+	}
+	if cfg.Max < 0 {
+		return nil, ErrInvalidLimit
+	}
+	if err := cfg.Classes.Validate(); err != nil {
+		return nil, err
+	}
+	c := &ConcurrencyController{
+		pathMax:  map[string]*semaphore.Weighted{},
+		classes:  cfg.Classes,
+		Enforced: enforced,
+	}
+	if cfg.Max > 0 {
+		max, err := NewClassLimiter(cfg.Max, cfg.Classes)
+		if err != nil {
+			return nil, err
+		}
+		c.max = max
+	}
+	for path, max := range cfg.PathMax {
+		if max < 0 {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidLimit, path)
+		}
+		if max > 0 {
+			c.pathMax[path] = semaphore.NewWeighted(max)
+		}
+	}
+	return c, nil
+}
+
+// Current returns the number of in-flight enforced requests and connections.
+func (c *ConcurrencyController) Current() int64 {
+	return atomic.LoadInt64(&c.current)
+}
+
+// acquire reserves capacity of the given class for a request to path, or for
+// a raw connection when path is empty. On success, acquire returns a release
+// function that must be called exactly once when the request completes.
+// Otherwise, acquire returns the name of the exceeded limit.
+func (c *ConcurrencyController) acquire(path string, class *Class) (func(), string) {
+	releaseMax, ok := c.max.TryAcquire(class)
+	if !ok {
+		return nil, "max"
+	}
+	sem := c.pathMax[path]
+	if sem != nil && !sem.TryAcquire(1) {
+		releaseMax()
+		return nil, "path"
+	}
+	concurrencyCurrent.Set(float64(atomic.AddInt64(&c.current, 1)))
+	return func() {
+		concurrencyCurrent.Set(float64(atomic.AddInt64(&c.current, -1)))
+		if sem != nil {
+			sem.Release(1)
+		}
+		releaseMax()
+	}, ""
+}
+
+// Limit enforces that the concurrency limits are respected before running the
+// next handler. The request is counted until the next handler returns.
+// Requests of classes with Bypass, e.g. monitoring, are always accepted and
+// are not counted.
+func (c *ConcurrencyController) Limit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Discover the priority class of the access token claims.
+		class := c.classes.Classify(GetClaim(r.Context()))
+		if class.Bypass || !c.Enforced[r.URL.Path] {
+			concurrencyRequests.WithLabelValues("accepted", "http", "").Inc()
+			next.ServeHTTP(w, r)
+			return
+		}
+		release, reason := c.acquire(r.URL.Path, class)
+		if release == nil {
+			concurrencyRequests.WithLabelValues("rejected", "http", reason).Inc()
+			// 503 - https://tools.ietf.org/html/rfc7231#section-6.6.4
+			w.WriteHeader(http.StatusServiceUnavailable)
+			// Return without additional response.
+			return
+		}
+		defer release()
+		concurrencyRequests.WithLabelValues("accepted", "http", "").Inc()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Accept wraps the call to listener's Accept. If the ConcurrencyController is
+// at its limit, then Accept immediately closes the connection and returns an
+// error. Otherwise, the connection is counted until it is closed.
+func (c *ConcurrencyController) Accept(l net.Listener) (net.Conn, error) {
+	if c == nil {
+		// Simple pass-through.
+		return l.Accept()
+	}
+	return acceptWith(l, c, "ConcurrencyController")
+}
+
+// Name returns "concurrency". Name implements Admitter.
+func (c *ConcurrencyController) Name() string {
+	return "concurrency"
+}
+
+// Admit counts a new connection against the concurrency limits. The returned
+// connection releases its reservation when closed. The priority class is taken
+// from the claims of connections accepted by a TokenListener. Admit implements
+// Admitter.
+func (c *ConcurrencyController) Admit(conn net.Conn) (net.Conn, string) {
+	if c == nil {
+		return conn, ""
+	}
+	// NOTE: treat all raw accept requests as an "enforced path".
+	class := c.classes.Classify(ConnClaims(conn))
+	if class.Bypass {
+		concurrencyRequests.WithLabelValues("accepted", "raw", "").Inc()
+		return conn, ""
+	}
+	release, reason := c.acquire("", class)
+	if release == nil {
+		concurrencyRequests.WithLabelValues("rejected", "raw", reason).Inc()
+		return nil, reason
+	}
+	concurrencyRequests.WithLabelValues("accepted", "raw", "").Inc()
+	return &countedConn{Conn: conn, release: release}, ""
+}
+
+// countedConn releases its concurrency reservation when closed.
+type countedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+// Close closes the connection and releases its reservation. Additional calls
+// to Close do not release again.
+func (c *countedConn) Close() error {
+	err := c.Conn.Close()
+	c.Release()
+	return err
+}
+
+// Release releases the reservation without closing the connection.
+// Additional calls, and Close, do not release again.
+func (c *countedConn) Release() {
+	c.once.Do(c.release)
+}
+
+// Unwrap returns the counted connection.
+func (c *countedConn) Unwrap() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,221 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+func TestNewConcurrencyController(t *testing.T) {
+	tests := []struct {
+		name     string
+		enforced Paths
+		cfg      ConcurrencyConfig
+		wantErr  error
+	}{
+		{
+			name:     "success",
+			enforced: Paths{"/": true},
+			cfg:      ConcurrencyConfig{Max: 2, PathMax: map[string]int64{"/": 1, "/other": 0}},
+		},
+		{
+			name:    "error-nil-paths",
+			wantErr: ErrNilPaths,
+		},
+		{
+			name:     "error-negative-max",
+			enforced: Paths{},
+			cfg:      ConcurrencyConfig{Max: -1},
+			wantErr:  ErrInvalidLimit,
+		},
+		{
+			name:     "error-negative-path-max",
+			enforced: Paths{},
+			cfg:      ConcurrencyConfig{PathMax: map[string]int64{"/": -1}},
+			wantErr:  ErrInvalidLimit,
+		},
+		{
+			name:     "error-reserved-exceeds-max",
+			enforced: Paths{},
+			cfg:      ConcurrencyConfig{Max: 1, Classes: Classes{{Name: "premium", Reserved: 2}}},
+			wantErr:  ErrInvalidLimit,
+		},
+		{
+			name:     "error-invalid-class",
+			enforced: Paths{},
+			cfg:      ConcurrencyConfig{Classes: Classes{{Name: "premium", Reserved: -1}}},
+			wantErr:  ErrInvalidClass,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewConcurrencyController(tt.enforced, tt.cfg)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("NewConcurrencyController() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConcurrencyController_Limit(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      ConcurrencyConfig
+		inflight []string
+		path     string
+		claim    *jwt.Claims
+		visited  bool
+	}{
+		{
+			name:    "success",
+			cfg:     ConcurrencyConfig{Max: 1},
+			path:    "/",
+			visited: true,
+		},
+		{
+			name:     "reject-max",
+			cfg:      ConcurrencyConfig{Max: 1},
+			inflight: []string{"/other"},
+			path:     "/",
+			visited:  false,
+		},
+		{
+			name:     "reject-path-max",
+			cfg:      ConcurrencyConfig{Max: 2, PathMax: map[string]int64{"/": 1}},
+			inflight: []string{"/"},
+			path:     "/",
+			visited:  false,
+		},
+		{
+			name:     "success-other-path",
+			cfg:      ConcurrencyConfig{Max: 2, PathMax: map[string]int64{"/": 1}},
+			inflight: []string{"/"},
+			path:     "/other",
+			visited:  true,
+		},
+		{
+			name:     "success-unenforced-path",
+			cfg:      ConcurrencyConfig{Max: 1},
+			inflight: []string{"/"},
+			path:     "/metrics",
+			visited:  true,
+		},
+		{
+			name:     "success-monitoring",
+			cfg:      ConcurrencyConfig{Max: 1},
+			inflight: []string{"/"},
+			path:     "/",
+			claim:    &jwt.Claims{Subject: monitorSubject},
+			visited:  true,
+		},
+		{
+			name: "success-reserved-class",
+			cfg: ConcurrencyConfig{Max: 2, Classes: Classes{
+				{Name: "premium", Subjects: []string{"wehe"}, Reserved: 1},
+			}},
+			inflight: []string{"/"},
+			path:     "/",
+			claim:    &jwt.Claims{Subject: "wehe"},
+			visited:  true,
+		},
+		{
+			name: "reject-default-class-without-reserved",
+			cfg: ConcurrencyConfig{Max: 2, Classes: Classes{
+				{Name: "premium", Subjects: []string{"wehe"}, Reserved: 1},
+			}},
+			inflight: []string{"/"},
+			path:     "/",
+			claim:    &jwt.Claims{Subject: "ndt"},
+			visited:  false,
+		},
+		{
+			name:     "reject-monitoring-without-default-classes",
+			cfg:      ConcurrencyConfig{Max: 1, Classes: Classes{}},
+			inflight: []string{"/"},
+			path:     "/",
+			claim:    &jwt.Claims{Subject: monitorSubject},
+			visited:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewConcurrencyController(Paths{"/": true, "/other": true}, tt.cfg)
+			if err != nil {
+				t.Fatalf("NewConcurrencyController() failed: %v", err)
+			}
+			for _, p := range tt.inflight {
+				release, reason := c.acquire(p, defaultClass)
+				if release == nil {
+					t.Fatalf("acquire(%q) failed: %s", p, reason)
+				}
+				defer release()
+			}
+
+			visited := false
+			var during int64
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				visited = true
+				during = c.Current()
+			})
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req = req.Clone(SetClaim(req.Context(), tt.claim))
+			rw := httptest.NewRecorder()
+
+			c.Limit(next).ServeHTTP(rw, req)
+
+			if visited != tt.visited {
+				t.Errorf("ConcurrencyController.Limit() got %t, want %t", visited, tt.visited)
+			}
+			if !visited && rw.Code != http.StatusServiceUnavailable {
+				t.Errorf("ConcurrencyController.Limit() wrong code; got %d, want %d", rw.Code, http.StatusServiceUnavailable)
+			}
+			if tt.path == "/" && tt.claim == nil && visited && during != int64(len(tt.inflight))+1 {
+				t.Errorf("ConcurrencyController.Limit() did not count request; got %d", during)
+			}
+			if c.Current() != int64(len(tt.inflight)) {
+				t.Errorf("ConcurrencyController.Limit() did not release; got %d, want %d", c.Current(), len(tt.inflight))
+			}
+		})
+	}
+}
+
+func TestConcurrencyController_Accept(t *testing.T) {
+	c, err := NewConcurrencyController(Paths{}, ConcurrencyConfig{Max: 1})
+	if err != nil {
+		t.Fatalf("NewConcurrencyController() failed: %v", err)
+	}
+	l := &fakeListener{}
+	conn, err := c.Accept(l)
+	if err != nil {
+		t.Fatalf("ConcurrencyController.Accept() failed: %v", err)
+	}
+	// A second connection exceeds the limit and is closed.
+	l2 := &fakeListener{}
+	if _, err := c.Accept(l2); err == nil || l2.conn.closed != 1 {
+		t.Errorf("ConcurrencyController.Accept() accepted beyond limit; err %v, closed %d", err, l2.conn.closed)
+	}
+	// Closing the accepted connection, even twice, releases exactly once.
+	conn.Close()
+	conn.Close()
+	if c.Current() != 0 {
+		t.Errorf("ConcurrencyController.Accept() conn close did not release; got %d", c.Current())
+	}
+	conn, err = c.Accept(l)
+	if err != nil {
+		t.Errorf("ConcurrencyController.Accept() failed after release: %v", err)
+	}
+	conn.Close()
+
+	// Accept errors are returned.
+	if _, err := c.Accept(&fakeListener{err: errors.New("fake accept error")}); err == nil {
+		t.Errorf("ConcurrencyController.Accept() expected error")
+	}
+	// Accept works with a nil controller.
+	var nilc *ConcurrencyController
+	if _, err := nilc.Accept(&fakeListener{}); err != nil {
+		t.Errorf("ConcurrencyController.Accept() with nil controller failed: %v", err)
+	}
+}
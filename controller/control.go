@@ -1,10 +1,9 @@
 // Package controller provides various access controllers for use in
-// socket-based and HTTP-based services.
+// socket-based, HTTP-based and gRPC-based services.
 package controller
 
 import (
 	"context"
-	"log"
 	"net/http"
 
 	// Alice package provides a light weight way to chain HTTP middleware functions.
@@ -61,6 +60,10 @@ type SetupOption func(*setupConfig)
 
 type setupConfig struct {
 	newCustomClaim func() any
+	tx             TxConfig
+	audience       jwt.Audience
+	allowList      bool
+	onExclude      func(name string, err error)
 }
 
 // WithCustomClaim configures Setup to install a NewCustomClaim factory on the
@@ -71,15 +74,45 @@ func WithCustomClaim(factory func() any) SetupOption {
 	return func(c *setupConfig) { c.newCustomClaim = factory }
 }
 
+// WithTxConfig configures Setup to build a TxController with the given devices
+// and limits. Without WithTxConfig, the tx controller is excluded.
+func WithTxConfig(tx TxConfig) SetupOption {
+	return func(c *setupConfig) { c.tx = tx }
+}
+
+// WithAudience configures Setup to accept tokens for the given audience aliases
+// and patterns, e.g. "*.mlab-oti.measurement-lab.org", in addition to the
+// machine name. See token.MatchAudience for the pattern syntax.
+func WithAudience(aud ...string) SetupOption {
+	return func(c *setupConfig) { c.audience = append(c.audience, aud...) }
+}
+
+// WithAllowListBypass configures Setup to build a TokenController that accepts
+// clients on the allow list of an IPListController without an access token.
+// See TokenController.AllowListBypass.
+func WithAllowListBypass() SetupOption {
+	return func(c *setupConfig) { c.allowList = true }
+}
+
+// WithExcludeHandler configures Setup to call the handler with the name and
+// error of each controller that cannot be built, instead of logging a warning.
+// Callers that must not run without a controller may exit from the handler.
+func WithExcludeHandler(handler func(name string, err error)) SetupOption {
+	return func(c *setupConfig) { c.onExclude = handler }
+}
+
 // Setup creates a sequence of access control http.Handlers. When the verifier
 // is nil then the token controller will be excluded from the returned handler
 // chain. When the tx controller is unconfigured then the tx controller will be
 // excluded from the returned handler chain. Setup returns the TxController
 // because it provides the Accepter interface for use by servers accepting raw
 // TCP connections. See TxController.Accept for more information. When
-// tokenRequired is true, then the token controller requires valid access tokens
-// for the named machine. Optional SetupOptions configure extensions such as
-// custom JWT claim extraction; see WithCustomClaim.
+// tokenRequired is true, then the token controller requires valid access
+// tokens for the named machine. Optional SetupOptions configure extensions
+// such as custom JWT claim extraction, audience aliases and the tx
+// controller; see WithCustomClaim, WithAudience and WithTxConfig. Controllers
+// that cannot be built are excluded and reported with WithExcludeHandler. To
+// compose other controllers, use a Policy.
 func Setup(ctx context.Context, v Verifier, tokenRequired bool, machine string, txEnf, tkEnf Paths, opts ...SetupOption) (alice.Chain, *TxController) {
 	cfg := setupConfig{}
 	for _, opt := range opts {
@@ -91,30 +124,30 @@ func Setup(ctx context.Context, v Verifier, tokenRequired bool, machine string,
 	// requests. When token validation is successful, the validated claims are
 	// added to the HTTP request context. The tx controller looks for claims in
 	// the request context to determine if a request is monitoring (to allow it).
-	ac := alice.New()
+	p := &Policy{OnExclude: cfg.onExclude}
 
 	// If the verifier is not nil, include the token limit.
 	exp := jwt.Expected{
 		Issuer:      locateIssuer,
-		AnyAudience: jwt.Audience{machine},
+		AnyAudience: append(jwt.Audience{machine}, cfg.audience...),
 	}
-	token, err := NewTokenController(v, tokenRequired, exp, tkEnf)
-	if err == nil {
-		if cfg.newCustomClaim != nil {
-			token.NewCustomClaim = cfg.newCustomClaim
+	p.Add("token", func() (Controller, error) {
+		token, err := NewTokenController(v, tokenRequired, exp, tkEnf)
+		if err != nil {
+			return nil, err
 		}
-		ac = ac.Append(token.Limit)
-	} else {
-		log.Printf("WARNING: token controller is disabled: %v", err)
-	}
-
-	// If the tx controller is successful, include the tx limit.
-	tx, err := NewTxController(ctx, txEnf)
-	if err == nil {
-		ac = ac.Append(tx.Limit)
-	} else {
-		log.Printf("WARNING: tx controller is disabled: %v", err)
+		token.NewCustomClaim = cfg.newCustomClaim
+		token.AllowListBypass = cfg.allowList
+		return token, nil
+	})
+
+	// If the tx controller is configured and successful, include the tx limit.
+	if len(cfg.tx.Devices) > 0 {
+		p.Tx(ctx, txEnf, cfg.tx)
 	}
 
-	return ac, tx
+	// Without FailClosed, Build excludes the controllers that fail.
+	pc, _ := p.Build()
+	tx, _ := pc.Get("tx").(*TxController)
+	return pc.Chain, tx
 }
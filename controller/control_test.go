@@ -2,6 +2,7 @@ package controller
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -75,9 +76,9 @@ func TestSetupDefault(t *testing.T) {
 			ctx := context.Background()
 			// Use synthetic proc data to allow tests to work on any platform.
 			procPath = "testdata/proc-success"
-			device = tt.device
 			p := Paths{"/": true}
-			ac, tx := Setup(ctx, tt.v, false, tt.hostname, p, p)
+			cfg := TxConfig{Devices: DeviceList{{Pattern: tt.device}}}
+			ac, tx := Setup(ctx, tt.v, false, tt.hostname, p, p, WithTxConfig(cfg))
 			// The tx controller only works in linux; only report errors for linux.
 			if (tx != nil) == tt.wantNil {
 				t.Errorf("Setup() tx = %v, wantNil %v", tx, tt.wantNil)
@@ -105,7 +106,6 @@ func TestSetupDefault(t *testing.T) {
 
 func TestSetupWithCustomClaim(t *testing.T) {
 	procPath = "testdata/proc-success"
-	device = "eth0"
 	machine := "mlab1.foo01"
 	enforced := Paths{"/": true}
 	verifier := &fakeVerifier{
@@ -119,6 +119,7 @@ func TestSetupWithCustomClaim(t *testing.T) {
 
 	ac, _ := Setup(context.Background(), verifier, true, machine, enforced, enforced,
 		WithCustomClaim(func() any { return &testCustomClaims{} }),
+		WithTxConfig(TxConfig{Devices: DeviceList{{Pattern: "eth0"}}}),
 	)
 
 	var gotCustom any
@@ -139,3 +140,54 @@ func TestSetupWithCustomClaim(t *testing.T) {
 		t.Errorf("Setup() with custom claim mismatch: %v", diff)
 	}
 }
+
+// expectedVerifier records the expected claims given to Verify.
+type expectedVerifier struct {
+	fakeVerifier
+	exp jwt.Expected
+}
+
+func (v *expectedVerifier) Verify(tok string, exp jwt.Expected, extraDest ...any) (*jwt.Claims, error) {
+	v.exp = exp
+	return v.fakeVerifier.Verify(tok, exp, extraDest...)
+}
+
+func TestSetupWithAudience(t *testing.T) {
+	machine := "mlab1-foo01"
+	enforced := Paths{"/": true}
+	v := &expectedVerifier{fakeVerifier: fakeVerifier{claims: &jwt.Claims{Issuer: locateIssuer}}}
+	ac, _ := Setup(context.Background(), v, true, machine, enforced, enforced,
+		WithAudience("mlab1-foo01.example.org"), WithAudience("*.mlab-oti.example.org"))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Form = url.Values{"access_token": {"fake-token"}}
+	rw := httptest.NewRecorder()
+	ac.Then(http.NotFoundHandler()).ServeHTTP(rw, req)
+
+	want := jwt.Audience{machine, "mlab1-foo01.example.org", "*.mlab-oti.example.org"}
+	if diff := deep.Equal(v.exp.AnyAudience, want); diff != nil {
+		t.Errorf("Setup() with audience wrong expected audience: %v", diff)
+	}
+}
+
+func TestSetupWithExcludeHandler(t *testing.T) {
+	procPath = "testdata/proc-success"
+	p := Paths{"/": true}
+	excluded := map[string]error{}
+	Setup(context.Background(), (*fakeVerifier)(nil), true, "mlab1.foo01", p, p,
+		WithTxConfig(TxConfig{Devices: DeviceList{{Pattern: "no-such-device"}}}),
+		WithExcludeHandler(func(name string, err error) { excluded[name] = err }),
+	)
+	if !errors.Is(excluded["token"], ErrInvalidVerifier) || excluded["tx"] == nil || len(excluded) != 2 {
+		t.Errorf("Setup() wrong excluded controllers; got %v", excluded)
+	}
+
+	// An unconfigured tx controller is not an error.
+	excluded = map[string]error{}
+	Setup(context.Background(), &fakeVerifier{}, true, "mlab1.foo01", p, p,
+		WithExcludeHandler(func(name string, err error) { excluded[name] = err }),
+	)
+	if len(excluded) != 0 {
+		t.Errorf("Setup() wrong excluded controllers; got %v", excluded)
+	}
+}
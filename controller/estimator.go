@@ -0,0 +1,153 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidEstimator is returned when an estimator specification cannot be parsed.
+var ErrInvalidEstimator = errors.New("invalid estimator specification")
+
+// Estimator estimates a rate from periodic observations. Estimators are not
+// safe for concurrent use.
+type Estimator interface {
+	// Update records the rate observed over the last period and returns the
+	// new estimate.
+	Update(rate float64) float64
+}
+
+// ewma is an asymmetric exponentially weighted moving average that responds
+// immediately to increases and decays slowly.
+type ewma struct {
+	alpha float64
+	value float64
+}
+
+// NewEWMA returns an Estimator that follows increases immediately and decays
+// with the given alpha, between 0 and 1, for decreases.
+func NewEWMA(alpha float64) Estimator {
+	return &ewma{alpha: alpha}
+}
+
+func (e *ewma) Update(rate float64) float64 {
+	e.value = decay(e.value, rate, e.alpha)
+	return e.value
+}
+
+// decay returns the next rate estimate given the previous estimate and the
+// current rate. The estimate decays over a few seconds for decreases and
+// responds immediately to increases.
+func decay(prev, now, alpha float64) float64 {
+	return math.Max(now, (1-alpha)*prev+alpha*now)
+}
+
+// window keeps the most recent observations.
+type window struct {
+	samples []float64
+	next    int
+	full    bool
+}
+
+func (w *window) add(rate float64) []float64 {
+	w.samples[w.next] = rate
+	w.next = (w.next + 1) % len(w.samples)
+	if w.next == 0 {
+		w.full = true
+	}
+	if w.full {
+		return w.samples
+	}
+	return w.samples[:w.next]
+}
+
+// windowMax estimates the rate as the maximum of recent observations.
+type windowMax struct {
+	window
+}
+
+// NewWindowMax returns an Estimator reporting the maximum of the last size
+// observations.
+func NewWindowMax(size int) Estimator {
+	return &windowMax{window{samples: make([]float64, size)}}
+}
+
+func (w *windowMax) Update(rate float64) float64 {
+	max := 0.0
+	for _, v := range w.add(rate) {
+		max = math.Max(max, v)
+	}
+	return max
+}
+
+// percentile estimates the rate as a percentile of recent observations.
+type percentile struct {
+	window
+	p float64
+}
+
+// NewPercentile returns an Estimator reporting the p-th percentile, between 0
+// and 100, of the last size observations.
+func NewPercentile(size int, p float64) Estimator {
+	return &percentile{window: window{samples: make([]float64, size)}, p: p}
+}
+
+func (e *percentile) Update(rate float64) float64 {
+	sorted := append([]float64(nil), e.add(rate)...)
+	sort.Float64s(sorted)
+	// Nearest rank.
+	i := int(math.Ceil(e.p/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// ParseEstimator parses an estimator specification and returns a function
+// that creates new estimators. Specifications are:
+//
+//	ewma                     asymmetric EWMA with alpha = period/2 seconds (the default)
+//	max:<samples>            maximum of the last samples
+//	percentile:<p>:<samples> p-th percentile of the last samples
+//
+// The period is the interval between observations. An empty specification is
+// the default.
+func ParseEstimator(spec string, period time.Duration) (func() Estimator, error) {
+	fields := strings.Split(spec, ":")
+	invalid := fmt.Errorf("%w: %q", ErrInvalidEstimator, spec)
+	switch fields[0] {
+	case "", "ewma":
+		if len(fields) != 1 {
+			return nil, invalid
+		}
+		alpha := period.Seconds() / 2
+		return func() Estimator { return NewEWMA(alpha) }, nil
+	case "max":
+		if len(fields) != 2 {
+			return nil, invalid
+		}
+		size, err := strconv.Atoi(fields[1])
+		if err != nil || size < 1 {
+			return nil, invalid
+		}
+		return func() Estimator { return NewWindowMax(size) }, nil
+	case "percentile":
+		if len(fields) != 3 {
+			return nil, invalid
+		}
+		p, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || p <= 0 || p > 100 {
+			return nil, invalid
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil || size < 1 {
+			return nil, invalid
+		}
+		return func() Estimator { return NewPercentile(size, p) }, nil
+	}
+	return nil, invalid
+}
@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEstimators(t *testing.T) {
+	tests := []struct {
+		name    string
+		est     Estimator
+		samples []float64
+		want    []float64
+	}{
+		{
+			name:    "ewma",
+			est:     NewEWMA(0.5),
+			samples: []float64{100, 0, 0, 200},
+			want:    []float64{100, 50, 25, 200},
+		},
+		{
+			name:    "window-max",
+			est:     NewWindowMax(2),
+			samples: []float64{100, 50, 10, 20},
+			want:    []float64{100, 100, 50, 20},
+		},
+		{
+			name:    "percentile",
+			est:     NewPercentile(4, 50),
+			samples: []float64{40, 10, 30, 20, 50},
+			want:    []float64{40, 10, 30, 20, 20},
+		},
+		{
+			name:    "percentile-100",
+			est:     NewPercentile(3, 100),
+			samples: []float64{40, 10, 30, 20},
+			want:    []float64{40, 40, 40, 30},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, s := range tt.samples {
+				if got := tt.est.Update(s); got != tt.want[i] {
+					t.Errorf("Update(%v) sample %d = %v, want %v", s, i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseEstimator(t *testing.T) {
+	tests := []struct {
+		spec    string
+		sample  []float64
+		want    float64
+		wantErr bool
+	}{
+		{spec: "", sample: []float64{100, 0}, want: 95},
+		{spec: "ewma", sample: []float64{100, 0}, want: 95},
+		{spec: "max:3", sample: []float64{100, 0}, want: 100},
+		{spec: "percentile:50:2", sample: []float64{100, 0}, want: 0},
+		{spec: "ewma:1", wantErr: true},
+		{spec: "max", wantErr: true},
+		{spec: "max:0", wantErr: true},
+		{spec: "percentile:101:2", wantErr: true},
+		{spec: "percentile:50:x", wantErr: true},
+		{spec: "median", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			newEst, err := ParseEstimator(tt.spec, 100*time.Millisecond)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseEstimator() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidEstimator) {
+					t.Errorf("ParseEstimator() wrong error = %v", err)
+				}
+				return
+			}
+			est := newEst()
+			got := 0.0
+			for _, s := range tt.sample {
+				got = est.Update(s)
+			}
+			if got != tt.want {
+				t.Errorf("ParseEstimator() estimate = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package controller
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// errorDomain identifies the access controllers in gRPC error details.
+const errorDomain = "access.measurementlab.net"
+
+// grpcToken returns the access token from the "authorization" metadata, as a
+// bearer token, or from the "access_token" metadata.
+func grpcToken(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		if t, ok := strings.CutPrefix(v, "Bearer "); ok {
+			return t
+		}
+	}
+	if v := md.Get("access_token"); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// grpcRemoteIP returns the client IP of the gRPC peer, or nil.
+func grpcRemoteIP(ctx context.Context) net.IP {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// grpcError returns a status error with the given code and an ErrorInfo detail
+// carrying the reason.
+func grpcError(c codes.Code, msg, reason string) error {
+	st := status.New(c, msg)
+	if d, err := st.WithDetails(&errdetails.ErrorInfo{Reason: reason, Domain: errorDomain}); err == nil {
+		st = d
+	}
+	return st.Err()
+}
+
+// wrappedStream replaces the context of a grpc.ServerStream.
+type wrappedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (w *wrappedStream) Context() context.Context {
+	return w.ctx
+}
+
+// verifyGRPC verifies the access token of a call to the full method name,
+// e.g. "/package.Service/Method", which is the resource path checked against
+// the Enforced set.
+func (t *TokenController) verifyGRPC(ctx context.Context, method string) (context.Context, error) {
+	ok, ctx, reason := t.verify(ctx, method, grpcToken(ctx), grpcRemoteIP(ctx))
+	if !ok {
+		return ctx, grpcError(codes.Unauthenticated, "access token rejected", reason)
+	}
+	return ctx, nil
+}
+
+// UnaryServerInterceptor returns a gRPC interceptor that checks the access
+// token of unary calls, like Limit. Tokens are read from the "authorization"
+// metadata as bearer tokens, or from the "access_token" metadata. Rejected
+// calls return codes.Unauthenticated with an ErrorInfo detail giving the
+// reason. The verified claims are added to the handler context.
+func (t *TokenController) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := t.verifyGRPC(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor returns a gRPC interceptor that checks the access
+// token of streaming calls. See UnaryServerInterceptor.
+func (t *TokenController) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := t.verifyGRPC(ss.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &wrappedStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// limitGRPC applies the TxController limits to a call to the full method name.
+func (tx *TxController) limitGRPC(ctx context.Context, method string) error {
+	class := tx.classes.Classify(GetClaim(ctx))
+	if reason := tx.decide(ctx, "grpc", class, tx.Enforced[method]); reason != "" {
+		return grpcError(codes.ResourceExhausted, "tx rate limit exceeded", reason)
+	}
+	return nil
+}
+
+// UnaryServerInterceptor returns a gRPC interceptor that applies the
+// TxController limits to unary calls, like Limit. Enforced paths are full
+// method names, e.g. "/package.Service/Method". Rejected calls return
+// codes.ResourceExhausted with an ErrorInfo detail giving the reason. To bypass
+// limits for monitoring, run the TokenController interceptor first.
+func (tx *TxController) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := tx.limitGRPC(ctx, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor returns a gRPC interceptor that applies the
+// TxController limits to streaming calls. See UnaryServerInterceptor.
+func (tx *TxController) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := tx.limitGRPC(ss.Context(), info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
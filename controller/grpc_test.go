@@ -0,0 +1,224 @@
+package controller
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/m-lab/access/token"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const testMethod = "/test.Service/Method"
+
+// checkStatus verifies the status code and ErrorInfo reason of err.
+func checkStatus(t *testing.T, err error, code codes.Code, reason string) {
+	t.Helper()
+	st, _ := status.FromError(err)
+	if st.Code() != code {
+		t.Fatalf("wrong status code; got %v, want %v", st.Code(), code)
+	}
+	if code == codes.OK {
+		return
+	}
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.Reason == reason && info.Domain == errorDomain {
+			return
+		}
+	}
+	t.Errorf("missing ErrorInfo reason %q; got %v", reason, st.Details())
+}
+
+func TestTokenController_UnaryServerInterceptor(t *testing.T) {
+	tests := []struct {
+		name     string
+		required bool
+		md       metadata.MD
+		verifier *fakeVerifier
+		method   string
+		remote   net.Addr
+		code     codes.Code
+		reason   string
+		custom   bool
+	}{
+		{
+			name:     "success-bearer",
+			required: true,
+			md:       metadata.Pairs("authorization", "Bearer abc"),
+			verifier: &fakeVerifier{claims: &jwt.Claims{Subject: "ndt"}, custom: &testCustomClaims{Foo: "x"}},
+			method:   testMethod,
+			code:     codes.OK,
+			custom:   true,
+		},
+		{
+			name:     "success-access-token",
+			required: true,
+			md:       metadata.Pairs("access_token", "abc"),
+			verifier: &fakeVerifier{claims: &jwt.Claims{Subject: "ndt"}},
+			method:   testMethod,
+			code:     codes.OK,
+		},
+		{
+			name:     "success-unenforced-method",
+			required: true,
+			verifier: &fakeVerifier{},
+			method:   "/test.Service/Other",
+			code:     codes.OK,
+		},
+		{
+			name:     "success-not-required",
+			verifier: &fakeVerifier{},
+			method:   testMethod,
+			code:     codes.OK,
+		},
+		{
+			name:     "error-missing",
+			required: true,
+			verifier: &fakeVerifier{},
+			method:   testMethod,
+			code:     codes.Unauthenticated,
+			reason:   "missing",
+		},
+		{
+			name:     "error-invalid",
+			required: true,
+			md:       metadata.Pairs("authorization", "Bearer abc"),
+			verifier: &fakeVerifier{err: jose.ErrCryptoFailure},
+			method:   testMethod,
+			code:     codes.Unauthenticated,
+			reason:   "bad-signature",
+		},
+		{
+			name:     "error-client-ip-mismatch",
+			required: true,
+			md:       metadata.Pairs("authorization", "Bearer abc"),
+			verifier: &fakeVerifier{claims: &jwt.Claims{}, cnf: &token.Confirmation{IP: "192.0.2.1"}},
+			method:   testMethod,
+			remote:   &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 1234},
+			code:     codes.Unauthenticated,
+			reason:   "client-ip-mismatch",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := &TokenController{
+				Public:         tt.verifier,
+				Required:       tt.required,
+				Enforced:       Paths{testMethod: true},
+				NewCustomClaim: func() any { return &testCustomClaims{} },
+			}
+			ctx := metadata.NewIncomingContext(context.Background(), tt.md)
+			if tt.remote != nil {
+				ctx = peer.NewContext(ctx, &peer.Peer{Addr: tt.remote})
+			}
+			var got context.Context
+			handler := func(ctx context.Context, req any) (any, error) {
+				got = ctx
+				return nil, nil
+			}
+			_, err := tc.UnaryServerInterceptor()(ctx, nil, &grpc.UnaryServerInfo{FullMethod: tt.method}, handler)
+			checkStatus(t, err, tt.code, tt.reason)
+			if tt.code != codes.OK {
+				if got != nil {
+					t.Errorf("UnaryServerInterceptor() called handler after rejection")
+				}
+				return
+			}
+			if tt.verifier.claims != nil && GetClaim(got) != tt.verifier.claims {
+				t.Errorf("UnaryServerInterceptor() missing claims in handler context")
+			}
+			if c, _ := GetCustomClaim(got).(*testCustomClaims); tt.custom && (c == nil || c.Foo != "x") {
+				t.Errorf("UnaryServerInterceptor() missing custom claims; got %#v", c)
+			}
+		})
+	}
+}
+
+// fakeServerStream is a grpc.ServerStream with a given context.
+type fakeServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (f *fakeServerStream) Context() context.Context {
+	return f.ctx
+}
+
+func TestTokenController_StreamServerInterceptor(t *testing.T) {
+	tc := &TokenController{
+		Public:   &fakeVerifier{claims: &jwt.Claims{Subject: "ndt"}},
+		Required: true,
+		Enforced: Paths{testMethod: true},
+	}
+	info := &grpc.StreamServerInfo{FullMethod: testMethod}
+	var got *jwt.Claims
+	handler := func(srv any, ss grpc.ServerStream) error {
+		got = GetClaim(ss.Context())
+		return nil
+	}
+	ss := &fakeServerStream{ctx: metadata.NewIncomingContext(context.Background(), metadata.Pairs("access_token", "abc"))}
+	if err := tc.StreamServerInterceptor()(nil, ss, info, handler); err != nil || got == nil {
+		t.Errorf("StreamServerInterceptor() failed; err %v, claims %v", err, got)
+	}
+
+	got = nil
+	err := tc.StreamServerInterceptor()(nil, &fakeServerStream{ctx: context.Background()}, info, handler)
+	checkStatus(t, err, codes.Unauthenticated, "missing")
+	if got != nil {
+		t.Errorf("StreamServerInterceptor() called handler after rejection")
+	}
+}
+
+func TestTxController_ServerInterceptors(t *testing.T) {
+	tx := &TxController{
+		devices:  []*netDevice{{name: "eth0"}},
+		limits:   Limits{Tx: 100},
+		Enforced: Paths{testMethod: true},
+	}
+	tx.rates.set(200, 0)
+	unary := func(ctx context.Context, method string) error {
+		handler := func(ctx context.Context, req any) (any, error) { return nil, nil }
+		_, err := tx.UnaryServerInterceptor()(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+		return err
+	}
+	stream := func(ctx context.Context, method string) error {
+		handler := func(srv any, ss grpc.ServerStream) error { return nil }
+		return tx.StreamServerInterceptor()(nil, &fakeServerStream{ctx: ctx}, &grpc.StreamServerInfo{FullMethod: method}, handler)
+	}
+	monitoring := SetClaim(context.Background(), &jwt.Claims{Subject: monitorSubject})
+	for name, call := range map[string]func(context.Context, string) error{"unary": unary, "stream": stream} {
+		t.Run(name, func(t *testing.T) {
+			checkStatus(t, call(context.Background(), testMethod), codes.ResourceExhausted, "tx")
+			checkStatus(t, call(monitoring, testMethod), codes.OK, "")
+			checkStatus(t, call(context.Background(), "/test.Service/Other"), codes.OK, "")
+		})
+	}
+}
+
+func Test_grpcToken(t *testing.T) {
+	tests := []struct {
+		name string
+		md   metadata.MD
+		want string
+	}{
+		{name: "bearer", md: metadata.Pairs("authorization", "Bearer abc"), want: "abc"},
+		{name: "access-token", md: metadata.Pairs("access_token", "def"), want: "def"},
+		{name: "not-bearer", md: metadata.Pairs("authorization", "Basic abc")},
+		{name: "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := metadata.NewIncomingContext(context.Background(), tt.md)
+			if got := grpcToken(ctx); got != tt.want {
+				t.Errorf("grpcToken() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,307 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	ipListRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "controller_access_iplistcontroller_requests_total",
+			Help: "Total number of requests handled by the access iplistcontroller.",
+		},
+		[]string{"request", "protocol"},
+	)
+	ipListMatches = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "controller_access_iplistcontroller_matches_total",
+			Help: "Total number of client addresses matching an allow or deny list entry.",
+		},
+		[]string{"list", "entry"},
+	)
+
+	// ErrInvalidIPList is returned when an IP list file cannot be parsed.
+	ErrInvalidIPList = errors.New("invalid ip list")
+)
+
+// Names of the IP lists returned by IPListController.Check.
+const (
+	AllowList = "allow"
+	DenyList  = "deny"
+)
+
+// IPListEntry is a named set of client networks.
+type IPListEntry struct {
+	// Name identifies the entry in metrics, e.g. "partner-test".
+	Name string `json:"name"`
+
+	// CIDRs are the networks of the entry, e.g. "192.0.2.0/24". A single
+	// address matches only itself.
+	CIDRs []string `json:"cidrs"`
+}
+
+// IPLists are the allow and deny lists of an IPListController.
+type IPLists struct {
+	// Allow entries are accepted even when they also match a deny entry, and
+	// may use enforced resources without an access token. See GetAllowed.
+	Allow []IPListEntry `json:"allow,omitempty"`
+
+	// Deny entries are rejected on enforced resources.
+	Deny []IPListEntry `json:"deny,omitempty"`
+}
+
+// ipEntry is a parsed IPListEntry.
+type ipEntry struct {
+	name     string
+	prefixes []netip.Prefix
+}
+
+// ipLists are the parsed IPLists.
+type ipLists struct {
+	allow []ipEntry
+	deny  []ipEntry
+}
+
+// ParseIPLists parses YAML or JSON allow and deny lists, e.g.:
+//
+//	allow:
+//	- name: partner-test
+//	  cidrs: [192.0.2.0/24]
+//	deny:
+//	- name: abuse
+//	  cidrs: [198.51.100.0/24, "2001:db8::/32"]
+//
+// Entry names must be unique within a list.
+func ParseIPLists(b []byte) (*IPLists, error) {
+	l := &IPLists{}
+	if err := yaml.UnmarshalStrict(b, l); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIPList, err)
+	}
+	if _, err := l.parse(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// parse validates the lists and parses their networks.
+func (l *IPLists) parse() (*ipLists, error) {
+	allow, err := parseEntries(AllowList, l.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseEntries(DenyList, l.Deny)
+	if err != nil {
+		return nil, err
+	}
+	return &ipLists{allow: allow, deny: deny}, nil
+}
+
+// parseEntries parses the entries of the named list.
+func parseEntries(list string, entries []IPListEntry) ([]ipEntry, error) {
+	names := map[string]bool{}
+	parsed := make([]ipEntry, 0, len(entries))
+	for _, e := range entries {
+		if e.Name == "" || names[e.Name] {
+			return nil, fmt.Errorf("%w: %s entry name %q must be unique and non-empty", ErrInvalidIPList, list, e.Name)
+		}
+		names[e.Name] = true
+		p := ipEntry{name: e.Name}
+		for _, s := range e.CIDRs {
+			prefix, err := parsePrefix(s)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s entry %q: %v", ErrInvalidIPList, list, e.Name, err)
+			}
+			p.prefixes = append(p.prefixes, prefix)
+		}
+		parsed = append(parsed, p)
+	}
+	return parsed, nil
+}
+
+// parsePrefix parses a CIDR network or a single address.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return p.Masked(), nil
+}
+
+// match returns the name of the first entry containing addr, or "".
+func match(entries []ipEntry, addr netip.Addr) string {
+	for _, e := range entries {
+		for _, p := range e.prefixes {
+			if p.Contains(addr) {
+				return e.name
+			}
+		}
+	}
+	return ""
+}
+
+// IPListController accepts or rejects clients by matching their address
+// against allow and deny lists read from a file. Clients matching a deny entry
+// are rejected, unless they also match an allow entry. Clients matching an
+// allow entry may use enforced resources without an access token when the
+// IPListController runs before a TokenController with AllowListBypass set.
+type IPListController struct {
+	file  string
+	lists atomic.Pointer[ipLists]
+
+	// Enforced is a set of HTTP request resource paths on which the
+	// IPListController rejects denied clients. Any resource missing from the
+	// Enforced set, is allowed. When the IPListController is used for
+	// Accept(), these paths have no effect.
+	Enforced Paths
+}
+
+// NewIPListController creates an IPListController with the lists read from the
+// named file. See ParseIPLists for the file format.
+func NewIPListController(file string, enforced Paths) (*IPListController, error) {
+	if enforced == nil {
+		return nil, ErrNilPaths
+	}
+	c := &IPListController{file: file, Enforced: enforced}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload re-reads the lists file. When the file is invalid, the current lists
+// are unchanged and the error is returned.
+func (c *IPListController) Reload() error {
+	b, err := os.ReadFile(c.file)
+	if err != nil {
+		return err
+	}
+	l, err := ParseIPLists(b)
+	if err != nil {
+		return err
+	}
+	// ParseIPLists already validated the lists.
+	parsed, _ := l.parse()
+	c.lists.Store(parsed)
+	return nil
+}
+
+// File returns the name of the lists file, or "" when c is nil.
+func (c *IPListController) File() string {
+	if c == nil {
+		return ""
+	}
+	return c.file
+}
+
+// Check returns the list (AllowList or DenyList) and the entry name matching
+// the client address, or empty strings when no entry matches. Allow entries
+// are checked first.
+func (c *IPListController) Check(ip net.IP) (string, string) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if c == nil || !ok {
+		return "", ""
+	}
+	addr = addr.Unmap()
+	l := c.lists.Load()
+	if name := match(l.allow, addr); name != "" {
+		ipListMatches.WithLabelValues(AllowList, name).Inc()
+		return AllowList, name
+	}
+	if name := match(l.deny, addr); name != "" {
+		ipListMatches.WithLabelValues(DenyList, name).Inc()
+		return DenyList, name
+	}
+	return "", ""
+}
+
+type allowedContextKeyType struct{}
+
+var allowedContextKey = allowedContextKeyType{}
+
+// SetAllowed returns a derived context recording that the client matched the
+// named allow list entry.
+func SetAllowed(ctx context.Context, entry string) context.Context {
+	return context.WithValue(ctx, allowedContextKey, entry)
+}
+
+// GetAllowed returns the allow list entry matched by the client, or "" when
+// the client is not on the allow list.
+func GetAllowed(ctx context.Context) string {
+	entry, _ := ctx.Value(allowedContextKey).(string)
+	return entry
+}
+
+// Limit rejects denied clients on enforced paths before running the next
+// handler. The entry matched by allowed clients is added to the request
+// context; see GetAllowed.
+func (c *IPListController) Limit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		list, entry := c.Check(remoteIP(r))
+		switch {
+		case list == AllowList:
+			r = r.Clone(SetAllowed(r.Context(), entry))
+		case list == DenyList && c.Enforced[r.URL.Path]:
+			ipListRequests.WithLabelValues("rejected", "http").Inc()
+			// 403 - https://tools.ietf.org/html/rfc7231#section-6.5.3
+			w.WriteHeader(http.StatusForbidden)
+			// Return without additional response.
+			return
+		}
+		ipListRequests.WithLabelValues("accepted", "http").Inc()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Accept wraps the call to listener's Accept. If the client address is
+// denied, then Accept immediately closes the connection and returns an error.
+func (c *IPListController) Accept(l net.Listener) (net.Conn, error) {
+	if c == nil {
+		// Simple pass-through.
+		return l.Accept()
+	}
+	return acceptWith(l, c, "IPListController")
+}
+
+// Name returns "iplist". Name implements Admitter.
+func (c *IPListController) Name() string {
+	return "iplist"
+}
+
+// Admit rejects new connections from denied client addresses. Admit
+// implements Admitter.
+func (c *IPListController) Admit(conn net.Conn) (net.Conn, string) {
+	if c == nil {
+		return conn, ""
+	}
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		ipListRequests.WithLabelValues("accepted", "raw").Inc()
+		return conn, ""
+	}
+	// NOTE: treat all raw accept requests as an "enforced path".
+	if list, _ := c.Check(addr.IP); list == DenyList {
+		ipListRequests.WithLabelValues("rejected", "raw").Inc()
+		return nil, "deny"
+	}
+	ipListRequests.WithLabelValues("accepted", "raw").Inc()
+	return conn, ""
+}
@@ -0,0 +1,197 @@
+package controller
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseIPLists(t *testing.T) {
+	tests := []struct {
+		name    string
+		b       string
+		wantErr bool
+	}{
+		{
+			name: "success",
+			b:    `{"allow": [{"name": "a", "cidrs": ["192.0.2.0/24", "2001:db8::1"]}]}`,
+		},
+		{
+			name: "success-empty",
+			b:    ``,
+		},
+		{
+			name:    "error-bad-cidr",
+			b:       `{"deny": [{"name": "a", "cidrs": ["192.0.2.0/33"]}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "error-empty-name",
+			b:       `{"deny": [{"cidrs": ["192.0.2.0/24"]}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "error-duplicate-name",
+			b:       `{"deny": [{"name": "a"}, {"name": "a"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "error-unknown-field",
+			b:       `{"block": []}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseIPLists([]byte(tt.b))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseIPLists() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidIPList) {
+				t.Errorf("ParseIPLists() wrong error; got %v", err)
+			}
+		})
+	}
+}
+
+func TestIPListController_Check(t *testing.T) {
+	c, err := NewIPListController("testdata/iplists.yaml", Paths{})
+	if err != nil {
+		t.Fatalf("NewIPListController() failed: %v", err)
+	}
+	tests := []struct {
+		ip    string
+		list  string
+		entry string
+	}{
+		{ip: "192.0.2.1", list: AllowList, entry: "partner-test"},
+		{ip: "::ffff:192.0.2.1", list: AllowList, entry: "partner-test"},
+		{ip: "192.0.2.100", list: DenyList, entry: "abuse"},
+		{ip: "198.51.100.7", list: DenyList, entry: "abuse"},
+		{ip: "198.51.100.8"},
+		{ip: "2001:db8::5", list: DenyList, entry: "abuse"},
+		{ip: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			list, entry := c.Check(net.ParseIP(tt.ip))
+			if list != tt.list || entry != tt.entry {
+				t.Errorf("Check() = %q, %q, want %q, %q", list, entry, tt.list, tt.entry)
+			}
+		})
+	}
+}
+
+func TestIPListController_Reload(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "iplists.yaml")
+	write := func(s string) {
+		if err := os.WriteFile(name, []byte(s), 0o644); err != nil {
+			t.Fatalf("Failed to write lists: %v", err)
+		}
+	}
+	if _, err := NewIPListController(name, Paths{}); err == nil {
+		t.Errorf("NewIPListController() missing file did not fail")
+	}
+	if _, err := NewIPListController(name, nil); err != ErrNilPaths {
+		t.Errorf("NewIPListController() wrong error; got %v, want %v", err, ErrNilPaths)
+	}
+	write(`{"deny": [{"name": "a", "cidrs": ["192.0.2.0/24"]}]}`)
+	c, err := NewIPListController(name, Paths{})
+	if err != nil {
+		t.Fatalf("NewIPListController() failed: %v", err)
+	}
+	ip := net.ParseIP("192.0.2.1")
+	write(`{"deny": [{"name": "b", "cidrs": ["192.0.2.0/24"]}]}`)
+	if err := c.Reload(); err != nil {
+		t.Fatalf("Reload() failed: %v", err)
+	}
+	if _, entry := c.Check(ip); entry != "b" {
+		t.Errorf("Reload() did not replace lists; got entry %q", entry)
+	}
+	// Invalid lists keep the current lists.
+	write(`{"deny": [{"name": "c", "cidrs": ["bad"]}]}`)
+	if err := c.Reload(); err == nil {
+		t.Errorf("Reload() invalid lists did not fail")
+	}
+	if _, entry := c.Check(ip); entry != "b" {
+		t.Errorf("Reload() replaced lists after error; got entry %q", entry)
+	}
+}
+
+func TestIPListController_Limit(t *testing.T) {
+	c, err := NewIPListController("testdata/iplists.yaml", Paths{"/": true})
+	if err != nil {
+		t.Fatalf("NewIPListController() failed: %v", err)
+	}
+	// Tokens are required, but allowed clients do not need one.
+	tc := &TokenController{Public: &fakeVerifier{}, Required: true, AllowListBypass: true, Enforced: Paths{"/": true}}
+	// Without AllowListBypass, the TokenController ignores the allow list.
+	strict := &TokenController{Public: &fakeVerifier{}, Required: true, Enforced: Paths{"/": true}}
+	tests := []struct {
+		name   string
+		tc     *TokenController
+		remote string
+		path   string
+		code   int
+	}{
+		{name: "allowed-without-token", remote: "192.0.2.1:1234", path: "/", code: http.StatusOK},
+		{name: "allowed-without-token-no-bypass", tc: strict, remote: "192.0.2.1:1234", path: "/", code: http.StatusUnauthorized},
+		{name: "denied", remote: "192.0.2.100:1234", path: "/", code: http.StatusForbidden},
+		{name: "denied-unenforced-path", remote: "192.0.2.100:1234", path: "/other", code: http.StatusOK},
+		{name: "unlisted-without-token", remote: "198.51.100.8:1234", path: "/", code: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.RemoteAddr = tt.remote
+			token := tc
+			if tt.tc != nil {
+				token = tt.tc
+			}
+			c.Limit(token.Limit(next)).ServeHTTP(rw, req)
+			if rw.Code != tt.code {
+				t.Errorf("Limit() wrong code; got %d, want %d", rw.Code, tt.code)
+			}
+		})
+	}
+}
+
+func TestIPListController_Accept(t *testing.T) {
+	c, err := NewIPListController("testdata/iplists.yaml", Paths{})
+	if err != nil {
+		t.Fatalf("NewIPListController() failed: %v", err)
+	}
+	tests := []struct {
+		name       string
+		c          *IPListController
+		ip         string
+		wantClosed int
+		wantErr    bool
+	}{
+		{name: "success-accepted", c: c, ip: "198.51.100.8"},
+		{name: "success-allowed", c: c, ip: "192.0.2.1"},
+		{name: "success-rejected", c: c, ip: "192.0.2.100", wantClosed: 1, wantErr: true},
+		{name: "success-nil", ip: "192.0.2.100"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &addrListener{remote: &net.TCPAddr{IP: net.ParseIP(tt.ip), Port: 1234}}
+			conn, err := tt.c.Accept(l)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Accept() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr == (conn != nil) {
+				t.Errorf("Accept() conn = %v, wantErr %v", conn, tt.wantErr)
+			}
+			if l.conns[0].closed != tt.wantClosed {
+				t.Errorf("Accept() closed = %d, want %d", l.conns[0].closed, tt.wantClosed)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package controller
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var listenerConnections = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "controller_access_listener_connections_total",
+		Help: "Total number of connections handled by the access listener, by the rejecting controller.",
+	},
+	[]string{"request", "controller"},
+)
+
+// Admitter is a connection-level access controller used by a Listener.
+type Admitter interface {
+	// Name identifies the controller in metrics and decisions, e.g. "tx".
+	Name() string
+
+	// Admit decides whether to accept a new connection. Admit returns the
+	// connection to use, which may wrap conn, e.g. to release resources when
+	// closed. When conn is rejected, Admit returns the reason, and the caller
+	// closes conn. Wrapping connections may also implement releaser, so that
+	// a Listener can release their resources before closing the connection.
+	Admit(conn net.Conn) (net.Conn, string)
+}
+
+// releaser is implemented by connections that hold resources of an Admitter,
+// to release them without closing the connection. Release must be safe to
+// call before Close.
+type releaser interface {
+	Release()
+}
+
+// acceptWith accepts the next connection from l and admits it with a. The
+// name is used in the error returned for rejected connections.
+func acceptWith(l net.Listener, a Admitter, name string) (net.Conn, error) {
+	conn, err := l.Accept()
+	if err != nil {
+		// No need to check limits, the accept failed.
+		return nil, err
+	}
+	c, reason := a.Admit(conn)
+	if reason != "" {
+		defer conn.Close()
+		return nil, fmt.Errorf("%s rejected connection %s", name, conn.RemoteAddr())
+	}
+	return c, nil
+}
+
+// RejectMode is how a Listener closes rejected connections.
+type RejectMode int
+
+const (
+	// RejectClose closes rejected connections normally.
+	RejectClose RejectMode = iota
+
+	// RejectReset closes rejected TCP connections with a reset (RST), so
+	// clients fail immediately.
+	RejectReset
+
+	// RejectDelay closes rejected connections after a delay, to slow down
+	// clients that retry immediately. The connection is held open until then,
+	// but resources reserved by admitters are released immediately.
+	RejectDelay
+)
+
+// defaultMaxDelayed is the number of rejected connections held open with
+// RejectDelay when unspecified.
+const defaultMaxDelayed = 1024
+
+// ListenerConfig configures a Listener.
+type ListenerConfig struct {
+	// Reject is how rejected connections are closed.
+	Reject RejectMode
+
+	// Delay is the time before closing rejected connections with RejectDelay.
+	Delay time.Duration
+
+	// MaxDelayed bounds the number of rejected connections held open with
+	// RejectDelay. Once reached, rejected connections are closed like
+	// RejectClose. When zero, 1024 connections may be held open.
+	MaxDelayed int
+}
+
+// Decision describes how a Listener admitted a connection.
+type Decision struct {
+	// Time is when the connection was admitted.
+	Time time.Time
+
+	// Admitters are the names of the controllers that admitted the
+	// connection, in order.
+	Admitters []string
+}
+
+// AdmittedConn is a connection accepted by a Listener.
+type AdmittedConn struct {
+	net.Conn
+	Decision Decision
+}
+
+// Unwrap returns the connection admitted by the Listener controllers.
+func (c *AdmittedConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+// ConnClaims returns the verified claims of a connection accepted by a
+// TokenListener, possibly wrapped by a Listener, or nil if there are none.
+func ConnClaims(c net.Conn) *jwt.Claims {
+	for c != nil {
+		switch v := c.(type) {
+		case *TokenConn:
+			return v.Claims()
+		case interface{ Unwrap() net.Conn }:
+			c = v.Unwrap()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// Listener wraps a net.Listener to admit new connections with a chain of
+// controllers. Unlike the Accept helpers of individual controllers, Accept
+// never returns an error for rejected connections, so a Listener may be used
+// with http.Server.Serve and other libraries that take a net.Listener.
+type Listener struct {
+	net.Listener
+	cfg       ListenerConfig
+	admitters []Admitter
+	delayed   atomic.Int64 // Rejected connections held open.
+}
+
+// NewListener creates a Listener that admits connections from l with each
+// admitter, in order. A connection is accepted only if every admitter accepts
+// it. Nil controllers accept every connection.
+func NewListener(l net.Listener, cfg ListenerConfig, admitters ...Admitter) *Listener {
+	if cfg.MaxDelayed == 0 {
+		cfg.MaxDelayed = defaultMaxDelayed
+	}
+	return &Listener{Listener: l, cfg: cfg, admitters: admitters}
+}
+
+// Accept returns the next admitted connection as an *AdmittedConn. Rejected
+// connections are closed according to the ListenerConfig, and Accept waits
+// for the next connection. Errors from the underlying listener are returned.
+func (l *Listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if c, ok := l.admit(conn); ok {
+			return c, nil
+		}
+	}
+}
+
+// admit runs conn through the admitters, and rejects it if any admitter does.
+func (l *Listener) admit(raw net.Conn) (net.Conn, bool) {
+	d := Decision{Time: time.Now()}
+	conn := raw
+	for _, a := range l.admitters {
+		c, reason := a.Admit(conn)
+		if reason != "" {
+			listenerConnections.WithLabelValues("rejected", a.Name()).Inc()
+			l.reject(raw, conn)
+			return nil, false
+		}
+		conn = c
+		d.Admitters = append(d.Admitters, a.Name())
+	}
+	listenerConnections.WithLabelValues("accepted", "").Inc()
+	return &AdmittedConn{Conn: conn, Decision: d}, true
+}
+
+// reject closes conn, which wraps raw, according to the reject mode. Closing
+// conn releases resources held by earlier admitters. With RejectDelay, the
+// resources are released immediately, and only raw is closed after the delay.
+func (l *Listener) reject(raw, conn net.Conn) {
+	switch l.cfg.Reject {
+	case RejectReset:
+		for c := raw; c != nil; {
+			if tc, ok := c.(interface{ SetLinger(sec int) error }); ok {
+				// A zero linger discards unsent data and sends a reset on close.
+				tc.SetLinger(0)
+				break
+			}
+			u, ok := c.(interface{ Unwrap() net.Conn })
+			if !ok {
+				break
+			}
+			c = u.Unwrap()
+		}
+	case RejectDelay:
+		release(raw, conn)
+		if l.delayed.Add(1) <= int64(l.cfg.MaxDelayed) {
+			time.AfterFunc(l.cfg.Delay, func() {
+				l.delayed.Add(-1)
+				raw.Close()
+			})
+			return
+		}
+		// Too many connections are held open, so close this one now.
+		l.delayed.Add(-1)
+	}
+	conn.Close()
+}
+
+// release releases the resources of the connections wrapping raw in conn.
+func release(raw, conn net.Conn) {
+	for c := conn; c != nil && c != raw; {
+		if r, ok := c.(releaser); ok {
+			r.Release()
+		}
+		u, ok := c.(interface{ Unwrap() net.Conn })
+		if !ok {
+			return
+		}
+		c = u.Unwrap()
+	}
+}
@@ -0,0 +1,173 @@
+package controller
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// rejectAdmitter rejects every connection.
+type rejectAdmitter struct{}
+
+func (rejectAdmitter) Name() string { return "reject" }
+func (rejectAdmitter) Admit(conn net.Conn) (net.Conn, string) {
+	return nil, "always"
+}
+
+func TestListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	cc, err := NewConcurrencyController(Paths{}, ConcurrencyConfig{Max: 1})
+	if err != nil {
+		t.Fatalf("NewConcurrencyController() failed: %v", err)
+	}
+	var tx *TxController // A nil controller accepts every connection.
+	nl := NewListener(l, ListenerConfig{Reject: RejectReset}, tx, cc)
+	defer nl.Close()
+
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		return c
+	}
+	first := dial()
+	defer first.Close()
+	conn, err := nl.Accept()
+	if err != nil {
+		t.Fatalf("Listener.Accept() failed: %v", err)
+	}
+	ac, ok := conn.(*AdmittedConn)
+	if !ok {
+		t.Fatalf("Listener.Accept() wrong conn type %T", conn)
+	}
+	if len(ac.Decision.Admitters) != 2 || ac.Decision.Admitters[1] != "concurrency" || ac.Decision.Time.IsZero() {
+		t.Errorf("Listener.Accept() wrong decision; got %#v", ac.Decision)
+	}
+
+	// The second connection is over the limit, and is reset.
+	second := dial()
+	defer second.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		c, _ := nl.Accept()
+		accepted <- c
+	}()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := second.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Listener did not reject second connection")
+	}
+
+	// Closing the first connection releases its reservation for the third.
+	conn.Close()
+	third := dial()
+	defer third.Close()
+	select {
+	case c := <-accepted:
+		if c == nil {
+			t.Fatalf("Listener.Accept() did not return third connection")
+		}
+		c.Close()
+	case <-time.After(time.Second):
+		t.Fatalf("Listener.Accept() did not accept third connection")
+	}
+}
+
+func TestListener_reject(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    ListenerConfig
+		closed bool
+	}{
+		{name: "close", cfg: ListenerConfig{Reject: RejectClose}, closed: true},
+		{name: "reset", cfg: ListenerConfig{Reject: RejectReset}, closed: true},
+		{name: "delay", cfg: ListenerConfig{Reject: RejectDelay, Delay: time.Hour}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &fakeConn{}
+			nl := NewListener(&fakeListener{}, tt.cfg, rejectAdmitter{})
+			if _, ok := nl.admit(conn); ok {
+				t.Fatalf("Listener.admit() accepted connection")
+			}
+			if got := conn.closed == 1; got != tt.closed {
+				t.Errorf("Listener.admit() closed = %v, want %v", got, tt.closed)
+			}
+		})
+	}
+}
+
+// reserveAdmitter wraps every connection with a reservation.
+type reserveAdmitter struct {
+	reserved int
+}
+
+func (a *reserveAdmitter) Name() string { return "reserve" }
+func (a *reserveAdmitter) Admit(conn net.Conn) (net.Conn, string) {
+	a.reserved++
+	return &countedConn{Conn: conn, release: func() { a.reserved-- }}, ""
+}
+
+func TestListener_rejectDelay(t *testing.T) {
+	ra := &reserveAdmitter{}
+	cfg := ListenerConfig{Reject: RejectDelay, Delay: time.Hour, MaxDelayed: 1}
+	nl := NewListener(&fakeListener{}, cfg, ra, rejectAdmitter{})
+
+	// The reservation is released immediately, and the connection is held open.
+	held := &fakeConn{}
+	if _, ok := nl.admit(held); ok {
+		t.Fatalf("Listener.admit() accepted connection")
+	}
+	if ra.reserved != 0 || held.closed != 0 {
+		t.Errorf("Listener.admit() wrong delayed reject; reserved %d, closed %d", ra.reserved, held.closed)
+	}
+
+	// Once MaxDelayed connections are held, rejected connections are closed.
+	closed := &fakeConn{}
+	if _, ok := nl.admit(closed); ok {
+		t.Fatalf("Listener.admit() accepted connection")
+	}
+	if ra.reserved != 0 || closed.closed != 1 {
+		t.Errorf("Listener.admit() wrong reject over MaxDelayed; reserved %d, closed %d", ra.reserved, closed.closed)
+	}
+
+	// Held connections are closed after the delay.
+	nl = NewListener(&fakeListener{}, ListenerConfig{Reject: RejectDelay, Delay: time.Millisecond}, rejectAdmitter{})
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	nl.admit(conn)
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Listener did not close delayed connection; got %v", err)
+	}
+	if got := nl.delayed.Load(); got != 0 {
+		t.Errorf("Listener delayed connections = %d, want 0", got)
+	}
+}
+
+func TestListener_acceptError(t *testing.T) {
+	fail := errors.New("fake accept error")
+	nl := NewListener(&fakeListener{err: fail}, ListenerConfig{}, rejectAdmitter{})
+	if _, err := nl.Accept(); err != fail {
+		t.Errorf("Listener.Accept() wrong error; got %v, want %v", err, fail)
+	}
+}
+
+func TestConnClaims(t *testing.T) {
+	claims := &jwt.Claims{Subject: "ndt"}
+	tc := &TokenConn{Conn: &fakeConn{}, ctx: SetClaim(t.Context(), claims)}
+	wrapped := &AdmittedConn{Conn: &countedConn{Conn: tc, release: func() {}}}
+	if got := ConnClaims(wrapped); got != claims {
+		t.Errorf("ConnClaims() = %v, want %v", got, claims)
+	}
+	if got := ConnClaims(&fakeConn{}); got != nil {
+		t.Errorf("ConnClaims() = %v, want nil", got)
+	}
+}
@@ -0,0 +1,301 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/procfs"
+)
+
+var (
+	loadAccessRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "controller_access_loadcontroller_requests_total",
+			Help: "Total number of requests handled by the access loadcontroller.",
+		},
+		[]string{"request", "protocol", "reason"},
+	)
+	loadCurrent = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "controller_access_loadcontroller_load",
+			Help: "Current host load observed by the access loadcontroller, by resource.",
+		},
+		[]string{"resource"},
+	)
+
+	// ErrNoThresholds is returned when a LoadController has no thresholds.
+	ErrNoThresholds = errors.New("no load thresholds given")
+)
+
+// LoadConfig configures a LoadController. Zero thresholds are not enforced.
+type LoadConfig struct {
+	// MaxCPU is the maximum fraction of CPU time spent busy across all CPUs,
+	// from /proc/stat, between 0 and 1.
+	MaxCPU float64
+
+	// MaxCPUPressure and MaxMemoryPressure are the maximum percentages of time
+	// in the last 10 seconds that some tasks were stalled waiting for CPU or
+	// memory, from /proc/pressure.
+	MaxCPUPressure    float64
+	MaxMemoryPressure float64
+
+	// MaxTCPSockets is the maximum number of TCP sockets in use, and
+	// MaxTCPMemory is the maximum number of pages used by TCP buffers, from
+	// /proc/net/sockstat.
+	MaxTCPSockets int
+	MaxTCPMemory  int
+
+	// Period is the interval between samples. When zero, the period is one
+	// second.
+	Period time.Duration
+
+	// Classes are the priority classes of clients. Classes with Bypass are
+	// not limited; multipliers and reservations do not apply to host load.
+	// When nil, the DefaultClasses are used.
+	Classes Classes
+}
+
+// Load is a sample of the host load.
+type Load struct {
+	CPU            float64
+	CPUPressure    float64
+	MemoryPressure float64
+	TCPSockets     int
+	TCPMemory      int
+}
+
+// LoadController samples host CPU utilization, pressure stall information and
+// socket usage every period, and rejects new clients while any load exceeds its
+// threshold.
+type LoadController struct {
+	cfg     LoadConfig
+	pfs     procfs.FS
+	current atomic.Pointer[Load]
+	prevCPU *procfs.CPUStat
+
+	// Enforced is a set of HTTP request resource paths on which the
+	// LoadController will enforce load limits. Any resource missing from the
+	// Enforced set, is allowed. When the LoadController is used for Accept(),
+	// these paths have no effect.
+	Enforced Paths
+}
+
+// NewLoadController creates a new instance and runs LoadController.Watch in a
+// goroutine to sample the host load every period. When the given context is
+// canceled or expires, Watch will return and the LoadController will no longer
+// be updated until Watch is started again.
+func NewLoadController(ctx context.Context, enforced Paths, cfg LoadConfig) (*LoadController, error) {
+	if enforced == nil {
+		return nil, ErrNilPaths
+	}
+	if cfg.MaxCPU == 0 && cfg.MaxCPUPressure == 0 && cfg.MaxMemoryPressure == 0 &&
+		cfg.MaxTCPSockets == 0 && cfg.MaxTCPMemory == 0 {
+		return nil, ErrNoThresholds
+	}
+	if err := cfg.Classes.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Period == 0 {
+		cfg.Period = time.Second
+	}
+	pfs, err := procfs.NewFS(procPath)
+	if err != nil {
+		return nil, err
+	}
+	lc := &LoadController{
+		cfg:      cfg,
+		pfs:      pfs,
+		Enforced: enforced,
+	}
+	// Sample once to verify that every configured source is available.
+	if err := lc.sample(); err != nil {
+		return nil, err
+	}
+	// Run watch in a goroutine.
+	go lc.Watch(ctx)
+	return lc, nil
+}
+
+// Current returns the most recent load sample.
+func (lc *LoadController) Current() Load {
+	if l := lc.current.Load(); l != nil {
+		return *l
+	}
+	return Load{}
+}
+
+// sample reads the configured load sources and updates the current load. CPU
+// utilization is measured since the previous sample, so the first sample
+// reports zero CPU utilization.
+func (lc *LoadController) sample() error {
+	l := Load{}
+	if lc.cfg.MaxCPU > 0 {
+		stat, err := lc.pfs.Stat()
+		if err != nil {
+			return err
+		}
+		cur := stat.CPUTotal
+		if lc.prevCPU != nil {
+			l.CPU = cpuBusy(*lc.prevCPU, cur)
+		}
+		lc.prevCPU = &cur
+	}
+	if lc.cfg.MaxCPUPressure > 0 {
+		psi, err := lc.pfs.PSIStatsForResource("cpu")
+		if err != nil {
+			return err
+		}
+		if psi.Some != nil {
+			l.CPUPressure = psi.Some.Avg10
+		}
+	}
+	if lc.cfg.MaxMemoryPressure > 0 {
+		psi, err := lc.pfs.PSIStatsForResource("memory")
+		if err != nil {
+			return err
+		}
+		if psi.Some != nil {
+			l.MemoryPressure = psi.Some.Avg10
+		}
+	}
+	if lc.cfg.MaxTCPSockets > 0 || lc.cfg.MaxTCPMemory > 0 {
+		ss, err := lc.pfs.NetSockstat()
+		if err != nil {
+			return err
+		}
+		for _, p := range ss.Protocols {
+			if p.Protocol != "TCP" {
+				continue
+			}
+			l.TCPSockets = p.InUse
+			if p.Mem != nil {
+				l.TCPMemory = *p.Mem
+			}
+		}
+	}
+	lc.current.Store(&l)
+	loadCurrent.WithLabelValues("cpu").Set(l.CPU)
+	loadCurrent.WithLabelValues("cpu-pressure").Set(l.CPUPressure)
+	loadCurrent.WithLabelValues("memory-pressure").Set(l.MemoryPressure)
+	loadCurrent.WithLabelValues("tcp-sockets").Set(float64(l.TCPSockets))
+	loadCurrent.WithLabelValues("tcp-memory").Set(float64(l.TCPMemory))
+	return nil
+}
+
+// cpuBusy returns the fraction of CPU time spent busy between two samples.
+func cpuBusy(prev, cur procfs.CPUStat) float64 {
+	idle := (cur.Idle + cur.Iowait) - (prev.Idle + prev.Iowait)
+	total := cpuTotal(cur) - cpuTotal(prev)
+	if total <= 0 {
+		return 0
+	}
+	return (total - idle) / total
+}
+
+func cpuTotal(s procfs.CPUStat) float64 {
+	return s.User + s.Nice + s.System + s.Idle + s.Iowait + s.IRQ + s.SoftIRQ + s.Steal
+}
+
+// exceeded returns the first resource exceeding its threshold, or the empty
+// string if none are exceeded.
+func (lc *LoadController) exceeded() string {
+	l := lc.Current()
+	switch {
+	case lc.cfg.MaxCPU > 0 && l.CPU > lc.cfg.MaxCPU:
+		return "cpu"
+	case lc.cfg.MaxCPUPressure > 0 && l.CPUPressure > lc.cfg.MaxCPUPressure:
+		return "cpu-pressure"
+	case lc.cfg.MaxMemoryPressure > 0 && l.MemoryPressure > lc.cfg.MaxMemoryPressure:
+		return "memory-pressure"
+	case lc.cfg.MaxTCPSockets > 0 && l.TCPSockets > lc.cfg.MaxTCPSockets:
+		return "tcp-sockets"
+	case lc.cfg.MaxTCPMemory > 0 && l.TCPMemory > lc.cfg.MaxTCPMemory:
+		return "tcp-memory"
+	}
+	return ""
+}
+
+// isLimited checks the current load and returns whether the connection
+// should be accepted or rejected. If the class has Bypass, e.g. monitoring,
+// then even if a threshold is exceeded, the request will be accepted.
+func (lc *LoadController) isLimited(proto string, class *Class, enforcedPath bool) bool {
+	return lc.limitReason(proto, class, enforcedPath) != ""
+}
+
+// limitReason is like isLimited, but returns the reason the connection is
+// rejected, or the empty string when it is accepted.
+func (lc *LoadController) limitReason(proto string, class *Class, enforcedPath bool) string {
+	if !class.Bypass && enforcedPath {
+		if reason := lc.exceeded(); reason != "" {
+			loadAccessRequests.WithLabelValues("rejected", proto, reason).Inc()
+			return reason
+		}
+	}
+	loadAccessRequests.WithLabelValues("accepted", proto, "").Inc()
+	return ""
+}
+
+// Accept wraps the call to listener's Accept. If the LoadController is
+// limited, then Accept immediately closes the connection and returns an error.
+func (lc *LoadController) Accept(l net.Listener) (net.Conn, error) {
+	if lc == nil {
+		// Simple pass-through.
+		return l.Accept()
+	}
+	return acceptWith(l, lc, "LoadController")
+}
+
+// Name returns "load". Name implements Admitter.
+func (lc *LoadController) Name() string {
+	return "load"
+}
+
+// Admit applies the host load thresholds to a new connection. Admit
+// implements Admitter.
+func (lc *LoadController) Admit(conn net.Conn) (net.Conn, string) {
+	if lc == nil {
+		return conn, ""
+	}
+	// NOTE: treat all raw accept requests as an "enforced path".
+	return conn, lc.limitReason("raw", lc.cfg.Classes.Classify(ConnClaims(conn)), true)
+}
+
+// Limit enforces that the host load thresholds are respected before running
+// the next handler.
+func (lc *LoadController) Limit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Discover the priority class of the access token claims.
+		class := lc.cfg.Classes.Classify(GetClaim(r.Context()))
+		if lc.isLimited("http", class, lc.Enforced[r.URL.Path]) {
+			// 503 - https://tools.ietf.org/html/rfc7231#section-6.6.4
+			w.WriteHeader(http.StatusServiceUnavailable)
+			// Return without additional response.
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Watch samples the host load every period. If the context is cancelled, the
+// context error is returned. Callers should typically run Watch in a goroutine.
+func (lc *LoadController) Watch(ctx context.Context) error {
+	t := time.NewTicker(lc.cfg.Period)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			if err := lc.sample(); err != nil {
+				log.Println("Error sampling host load:", err)
+			}
+		}
+	}
+}
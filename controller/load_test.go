@@ -0,0 +1,283 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/prometheus/procfs"
+)
+
+func TestNewLoadController(t *testing.T) {
+	tests := []struct {
+		name     string
+		procPath string
+		enforced Paths
+		cfg      LoadConfig
+		want     Load
+		wantErr  bool
+		errIs    error
+	}{
+		{
+			name:     "success",
+			procPath: "testdata/proc-load",
+			enforced: Paths{},
+			cfg: LoadConfig{
+				MaxCPU:            0.9,
+				MaxCPUPressure:    50,
+				MaxMemoryPressure: 50,
+				MaxTCPSockets:     1000,
+				MaxTCPMemory:      10000,
+			},
+			want: Load{CPUPressure: 12.5, MemoryPressure: 1.5, TCPSockets: 300, TCPMemory: 4096},
+		},
+		{
+			name:     "success-only-configured-sources",
+			procPath: "testdata/proc-load",
+			enforced: Paths{},
+			cfg:      LoadConfig{MaxTCPSockets: 1000},
+			want:     Load{TCPSockets: 300, TCPMemory: 4096},
+		},
+		{
+			name:    "error-nil-paths",
+			cfg:     LoadConfig{MaxCPU: 0.9},
+			wantErr: true,
+			errIs:   ErrNilPaths,
+		},
+		{
+			name:     "error-no-thresholds",
+			enforced: Paths{},
+			wantErr:  true,
+			errIs:    ErrNoThresholds,
+		},
+		{
+			name:     "error-invalid-classes",
+			procPath: "testdata/proc-load",
+			enforced: Paths{},
+			cfg:      LoadConfig{MaxTCPSockets: 1000, Classes: Classes{{Name: ""}}},
+			wantErr:  true,
+			errIs:    ErrInvalidClass,
+		},
+		{
+			name:     "error-missing-pressure",
+			procPath: "testdata/proc-success",
+			enforced: Paths{},
+			cfg:      LoadConfig{MaxMemoryPressure: 50},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			procPath = tt.procPath
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			lc, err := NewLoadController(ctx, tt.enforced, tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewLoadController() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.errIs != nil && !errors.Is(err, tt.errIs) {
+				t.Errorf("NewLoadController() wrong error = %v, want %v", err, tt.errIs)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := lc.Current(); got != tt.want {
+				t.Errorf("NewLoadController() wrong load = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_cpuBusy(t *testing.T) {
+	prev := procfs.CPUStat{User: 100, System: 50, Idle: 800, Iowait: 50}
+	cur := procfs.CPUStat{User: 250, System: 100, Idle: 850, Iowait: 50}
+	if got := cpuBusy(prev, cur); math.Abs(got-0.8) > 1e-9 {
+		t.Errorf("cpuBusy() = %v, want 0.8", got)
+	}
+	if got := cpuBusy(cur, cur); got != 0 {
+		t.Errorf("cpuBusy() without elapsed time = %v, want 0", got)
+	}
+}
+
+func TestLoadController_Limit(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     LoadConfig
+		load    Load
+		claim   *jwt.Claims
+		path    string
+		visited bool
+	}{
+		{
+			name:    "success",
+			cfg:     LoadConfig{MaxCPU: 0.9, MaxTCPSockets: 100},
+			load:    Load{CPU: 0.5, TCPSockets: 50},
+			path:    "/",
+			visited: true,
+		},
+		{
+			name:    "reject-cpu",
+			cfg:     LoadConfig{MaxCPU: 0.9},
+			load:    Load{CPU: 0.95},
+			path:    "/",
+			visited: false,
+		},
+		{
+			name:    "reject-cpu-pressure",
+			cfg:     LoadConfig{MaxCPUPressure: 10},
+			load:    Load{CPUPressure: 20},
+			path:    "/",
+			visited: false,
+		},
+		{
+			name:    "reject-memory-pressure",
+			cfg:     LoadConfig{MaxMemoryPressure: 10},
+			load:    Load{MemoryPressure: 20},
+			path:    "/",
+			visited: false,
+		},
+		{
+			name:    "reject-tcp-sockets",
+			cfg:     LoadConfig{MaxTCPSockets: 100},
+			load:    Load{TCPSockets: 101},
+			path:    "/",
+			visited: false,
+		},
+		{
+			name:    "reject-tcp-memory",
+			cfg:     LoadConfig{MaxTCPMemory: 100},
+			load:    Load{TCPMemory: 101},
+			path:    "/",
+			visited: false,
+		},
+		{
+			name:    "success-unenforced-path",
+			cfg:     LoadConfig{MaxCPU: 0.9},
+			load:    Load{CPU: 0.95},
+			path:    "/metrics",
+			visited: true,
+		},
+		{
+			name:    "success-monitoring",
+			cfg:     LoadConfig{MaxCPU: 0.9},
+			load:    Load{CPU: 0.95},
+			claim:   &jwt.Claims{Subject: monitorSubject},
+			path:    "/",
+			visited: true,
+		},
+		{
+			name: "success-bypass-class",
+			cfg: LoadConfig{
+				MaxCPU:  0.9,
+				Classes: Classes{{Name: "partner", Issuers: []string{"partner"}, Bypass: true}},
+			},
+			load:    Load{CPU: 0.95},
+			claim:   &jwt.Claims{Issuer: "partner"},
+			path:    "/",
+			visited: true,
+		},
+		{
+			// Configured classes replace the default monitoring class.
+			name: "reject-monitoring-without-class",
+			cfg: LoadConfig{
+				MaxCPU:  0.9,
+				Classes: Classes{{Name: "partner", Issuers: []string{"partner"}, Bypass: true}},
+			},
+			load:    Load{CPU: 0.95},
+			claim:   &jwt.Claims{Subject: monitorSubject},
+			path:    "/",
+			visited: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lc := &LoadController{cfg: tt.cfg, Enforced: Paths{"/": true}}
+			lc.current.Store(&tt.load)
+
+			visited := false
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				visited = true
+			})
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req = req.Clone(SetClaim(req.Context(), tt.claim))
+			rw := httptest.NewRecorder()
+
+			lc.Limit(next).ServeHTTP(rw, req)
+
+			if visited != tt.visited {
+				t.Errorf("LoadController.Limit() got %t, want %t", visited, tt.visited)
+			}
+		})
+	}
+}
+
+func TestLoadController_Accept(t *testing.T) {
+	lc := &LoadController{cfg: LoadConfig{MaxCPU: 0.9}}
+	lc.current.Store(&Load{CPU: 0.5})
+	if _, err := lc.Accept(&fakeListener{}); err != nil {
+		t.Errorf("LoadController.Accept() failed: %v", err)
+	}
+
+	lc.current.Store(&Load{CPU: 0.95})
+	l := &fakeListener{}
+	if _, err := lc.Accept(l); err == nil || l.conn.closed != 1 {
+		t.Errorf("LoadController.Accept() accepted while limited; err %v, closed %d", err, l.conn.closed)
+	}
+	if _, err := lc.Accept(&fakeListener{err: errors.New("fake accept error")}); err == nil {
+		t.Errorf("LoadController.Accept() expected error")
+	}
+	var nilc *LoadController
+	if _, err := nilc.Accept(&fakeListener{}); err != nil {
+		t.Errorf("LoadController.Accept() with nil controller failed: %v", err)
+	}
+}
+
+func TestLoadController_Admit(t *testing.T) {
+	lc := &LoadController{cfg: LoadConfig{MaxCPU: 0.9}}
+	lc.current.Store(&Load{CPU: 0.95})
+	if _, reason := lc.Admit(&fakeConn{}); reason != "cpu" {
+		t.Errorf("LoadController.Admit() wrong reason; got %q, want %q", reason, "cpu")
+	}
+	// Connections with monitoring tokens bypass the thresholds.
+	tc := &TokenConn{Conn: &fakeConn{}, ctx: SetClaim(t.Context(), &jwt.Claims{Subject: monitorSubject})}
+	if _, reason := lc.Admit(tc); reason != "" {
+		t.Errorf("LoadController.Admit() rejected monitoring connection: %q", reason)
+	}
+}
+
+func TestLoadController_Watch(t *testing.T) {
+	procPath = "testdata/proc-load"
+	pfs, err := procfs.NewFS(procPath)
+	if err != nil {
+		t.Fatalf("Failed to allocate procfs: %v", err)
+	}
+	lc := &LoadController{
+		cfg: LoadConfig{MaxCPU: 0.9, MaxTCPSockets: 100, Period: time.Millisecond},
+		pfs: pfs,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := lc.Watch(ctx); err == nil {
+		t.Errorf("LoadController.Watch() expected context error")
+	}
+	if got := lc.Current(); got.TCPSockets != 300 {
+		t.Errorf("LoadController.Watch() did not sample; got %#v", got)
+	}
+
+	// Sampling errors are logged and Watch continues.
+	bad, err := procfs.NewFS("testdata/proc-nodevfile")
+	if err != nil {
+		t.Fatalf("Failed to allocate procfs: %v", err)
+	}
+	lc.pfs = bad
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := lc.Watch(ctx); err == nil {
+		t.Errorf("LoadController.Watch() expected context error")
+	}
+}
@@ -0,0 +1,170 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/justinas/alice"
+)
+
+// Policy declares a sequence of access controllers, each with its own
+// enforced paths. Controllers are applied in declared order, so controllers
+// that depend on token claims (e.g. priority classes) must follow the token
+// controller, and an IP list that lets allowed clients skip tokens must
+// precede it.
+type Policy struct {
+	// FailClosed makes Build return an error when a declared controller cannot
+	// be built. Otherwise, the controller is excluded and reported to
+	// OnExclude.
+	FailClosed bool
+
+	// OnExclude is called with the name and error of each controller that Build
+	// excludes. When nil, Build logs a warning.
+	OnExclude func(name string, err error)
+
+	steps []policyStep
+}
+
+// policyStep is one declared controller.
+type policyStep struct {
+	name string
+	// ctx is the parent context of a controller that runs in the background, or
+	// nil.
+	ctx   context.Context
+	build func(ctx context.Context) (Controller, error)
+}
+
+// Add declares a controller built by the given function. The name identifies
+// the controller in errors and in PolicyChain.Get.
+func (p *Policy) Add(name string, build func() (Controller, error)) *Policy {
+	return p.addWatched(name, nil, func(context.Context) (Controller, error) {
+		return build()
+	})
+}
+
+// addWatched declares a controller that runs in the background until the
+// context passed to build is canceled. Build cancels that context when it
+// excludes the controller or fails.
+func (p *Policy) addWatched(name string, ctx context.Context, build func(ctx context.Context) (Controller, error)) *Policy {
+	p.steps = append(p.steps, policyStep{name: name, ctx: ctx, build: build})
+	return p
+}
+
+// Token declares a TokenController. See NewTokenController.
+func (p *Policy) Token(v Verifier, required bool, exp jwt.Expected, enforced Paths) *Policy {
+	return p.Add("token", func() (Controller, error) {
+		return NewTokenController(v, required, exp, enforced)
+	})
+}
+
+// Tx declares a TxController. See NewTxController.
+func (p *Policy) Tx(ctx context.Context, enforced Paths, cfg TxConfig) *Policy {
+	return p.addWatched("tx", ctx, func(ctx context.Context) (Controller, error) {
+		return NewTxController(ctx, enforced, cfg)
+	})
+}
+
+// Concurrency declares a ConcurrencyController. See NewConcurrencyController.
+func (p *Policy) Concurrency(enforced Paths, cfg ConcurrencyConfig) *Policy {
+	return p.Add("concurrency", func() (Controller, error) {
+		return NewConcurrencyController(enforced, cfg)
+	})
+}
+
+// Rate declares a RateController. See NewRateController.
+func (p *Policy) Rate(enforced Paths, cfg RateConfig) *Policy {
+	return p.Add("rate", func() (Controller, error) {
+		return NewRateController(enforced, cfg)
+	})
+}
+
+// Load declares a LoadController. See NewLoadController.
+func (p *Policy) Load(ctx context.Context, enforced Paths, cfg LoadConfig) *Policy {
+	return p.addWatched("load", ctx, func(ctx context.Context) (Controller, error) {
+		return NewLoadController(ctx, enforced, cfg)
+	})
+}
+
+// IPList declares an IPListController. See NewIPListController.
+func (p *Policy) IPList(file string, enforced Paths) *Policy {
+	return p.Add("iplist", func() (Controller, error) {
+		return NewIPListController(file, enforced)
+	})
+}
+
+// namedController is a built controller of a PolicyChain.
+type namedController struct {
+	name string
+	c    Controller
+}
+
+// PolicyChain is the handler chain built from a Policy.
+type PolicyChain struct {
+	alice.Chain
+	controllers []namedController
+}
+
+// Build creates every declared controller, in order, and chains their Limit
+// handlers. When a controller cannot be built, Build returns the error if
+// FailClosed is set, and otherwise excludes the controller. When Build returns
+// an error, the controllers already built stop running in the background.
+func (p *Policy) Build() (*PolicyChain, error) {
+	pc := &PolicyChain{Chain: alice.New()}
+	var stops []context.CancelFunc
+	for _, s := range p.steps {
+		ctx, stop := context.Background(), func() {}
+		if s.ctx != nil {
+			ctx, stop = context.WithCancel(s.ctx)
+		}
+		c, err := s.build(ctx)
+		if err != nil {
+			stop()
+			if p.FailClosed {
+				for _, stop := range stops {
+					stop()
+				}
+				return nil, fmt.Errorf("%s controller: %w", s.name, err)
+			}
+			p.exclude(s.name, err)
+			continue
+		}
+		stops = append(stops, stop)
+		pc.controllers = append(pc.controllers, namedController{name: s.name, c: c})
+		pc.Chain = pc.Chain.Append(c.Limit)
+	}
+	return pc, nil
+}
+
+// exclude reports a controller excluded by Build.
+func (p *Policy) exclude(name string, err error) {
+	if p.OnExclude != nil {
+		p.OnExclude(name, err)
+		return
+	}
+	log.Printf("WARNING: %s controller is disabled: %v", name, err)
+}
+
+// Get returns the first built controller with the given name, or nil when it
+// was not declared or was excluded.
+func (pc *PolicyChain) Get(name string) Controller {
+	for _, nc := range pc.controllers {
+		if nc.name == name {
+			return nc.c
+		}
+	}
+	return nil
+}
+
+// Admitters returns the built controllers that also admit raw connections, in
+// order, for use with NewListener.
+func (pc *PolicyChain) Admitters() []Admitter {
+	var admitters []Admitter
+	for _, nc := range pc.controllers {
+		if a, ok := nc.c.(Admitter); ok {
+			admitters = append(admitters, a)
+		}
+	}
+	return admitters
+}
@@ -0,0 +1,150 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+func TestPolicy_Build(t *testing.T) {
+	exp := jwt.Expected{Issuer: locateIssuer, AnyAudience: jwt.Audience{"mlab1.fake0"}}
+	tests := []struct {
+		name       string
+		policy     *Policy
+		want       []string
+		wantErr    bool
+		wantStatus int
+	}{
+		{
+			name: "success-declared-order",
+			policy: (&Policy{FailClosed: true}).
+				IPList("testdata/iplists.yaml", Paths{"/": true}).
+				Add("token", func() (Controller, error) {
+					tc, err := NewTokenController(&fakeVerifier{}, true, exp, Paths{"/": true})
+					if err != nil {
+						return nil, err
+					}
+					tc.AllowListBypass = true
+					return tc, nil
+				}).
+				Concurrency(Paths{"/": true}, ConcurrencyConfig{Max: 1}).
+				Rate(Paths{"/": true}, RateConfig{Rate: 1, Burst: 1}),
+			want: []string{"iplist", "token", "concurrency", "rate"},
+			// The allowed client skips the token controller.
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "success-fail-open-excludes-controller",
+			policy: (&Policy{}).
+				Tx(context.Background(), Paths{}, TxConfig{}).
+				Token(&fakeVerifier{}, true, exp, Paths{"/": true}),
+			want:       []string{"token"},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "error-fail-closed",
+			policy: (&Policy{FailClosed: true}).
+				Token(&fakeVerifier{}, true, exp, Paths{"/": true}).
+				Load(context.Background(), Paths{}, LoadConfig{}),
+			wantErr: true,
+		},
+		{
+			name:       "success-empty",
+			policy:     &Policy{FailClosed: true},
+			wantStatus: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pc, err := tt.policy.Build()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Policy.Build() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			for _, name := range tt.want {
+				if pc.Get(name) == nil {
+					t.Errorf("Policy.Build() missing controller %q", name)
+				}
+			}
+			if len(pc.controllers) != len(tt.want) {
+				t.Errorf("Policy.Build() wrong controllers; got %d, want %v", len(pc.controllers), tt.want)
+			}
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			pc.Then(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(rw, req)
+			if rw.Code != tt.wantStatus {
+				t.Errorf("PolicyChain wrong status; got %d, want %d", rw.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestPolicy_FailClosedError(t *testing.T) {
+	_, err := (&Policy{FailClosed: true}).Rate(Paths{}, RateConfig{}).Build()
+	if !errors.Is(err, ErrInvalidRate) {
+		t.Errorf("Policy.Build() wrong error; got %v, want %v", err, ErrInvalidRate)
+	}
+}
+
+func TestPolicy_FailClosedStopsControllers(t *testing.T) {
+	var built, excluded context.Context
+	watch := func(got *context.Context, err error) func(ctx context.Context) (Controller, error) {
+		return func(ctx context.Context) (Controller, error) {
+			*got = ctx
+			if err != nil {
+				return nil, err
+			}
+			return NewConcurrencyController(Paths{}, ConcurrencyConfig{Max: 1})
+		}
+	}
+	p := (&Policy{FailClosed: true}).
+		addWatched("built", context.Background(), watch(&built, nil)).
+		addWatched("excluded", context.Background(), watch(&excluded, ErrNoThresholds)).
+		Rate(Paths{}, RateConfig{})
+	if _, err := p.Build(); err == nil {
+		t.Fatalf("Policy.Build() expected error")
+	}
+	if built.Err() == nil || excluded.Err() == nil {
+		t.Errorf("Policy.Build() did not stop controllers; got %v, %v", built.Err(), excluded.Err())
+	}
+
+	// Without FailClosed, only the excluded controller stops.
+	p.FailClosed = false
+	var names []string
+	p.OnExclude = func(name string, err error) { names = append(names, name) }
+	if _, err := p.Build(); err != nil {
+		t.Fatalf("Policy.Build() failed: %v", err)
+	}
+	if built.Err() != nil || excluded.Err() == nil {
+		t.Errorf("Policy.Build() wrong stopped controllers; got %v, %v", built.Err(), excluded.Err())
+	}
+	if len(names) != 2 || names[0] != "excluded" || names[1] != "rate" {
+		t.Errorf("Policy.Build() wrong excluded controllers; got %v", names)
+	}
+}
+
+func TestPolicyChain_Admitters(t *testing.T) {
+	pc, err := (&Policy{FailClosed: true}).
+		Token(&fakeVerifier{}, true, jwt.Expected{Issuer: locateIssuer, AnyAudience: jwt.Audience{"a"}}, Paths{}).
+		Concurrency(Paths{}, ConcurrencyConfig{Max: 1}).
+		Rate(Paths{}, RateConfig{Rate: 1, Burst: 1}).
+		Build()
+	if err != nil {
+		t.Fatalf("Policy.Build() failed: %v", err)
+	}
+	got := pc.Admitters()
+	// The token controller does not admit raw connections.
+	if len(got) != 2 || got[0].Name() != "concurrency" || got[1].Name() != "rate" {
+		t.Errorf("PolicyChain.Admitters() wrong admitters; got %v", got)
+	}
+	if pc.Get("missing") != nil {
+		t.Errorf("PolicyChain.Get() returned undeclared controller")
+	}
+}
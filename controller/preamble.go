@@ -0,0 +1,297 @@
+package controller
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// ErrInvalidPreamble is returned when a connection preamble cannot be read.
+var ErrInvalidPreamble = errors.New("invalid preamble")
+
+// defaultPreambleTimeout is the time allowed for clients to send a preamble.
+const defaultPreambleTimeout = 5 * time.Second
+
+// Default limits of concurrent handshakes. Each handshake may hold a buffer of
+// up to 64KiB until the preamble timeout, so the limits bound the memory that
+// clients can tie up, and the per-subnet limit keeps one client subnet from
+// using every handshake.
+const (
+	defaultMaxHandshakes       = 256
+	defaultMaxSubnetHandshakes = 16
+)
+
+// Preamble is sent by clients of raw TCP services before the application
+// protocol, to present an access token. On the wire, the preamble is a two
+// byte, big-endian length followed by the JSON encoded Preamble.
+type Preamble struct {
+	// Token is the access token. It may be empty when tokens are not required.
+	Token string `json:"token"`
+
+	// Metadata is optional information from the client, e.g. a client name.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// WritePreamble writes the framed preamble to w. Clients should call
+// WritePreamble immediately after connecting.
+func WritePreamble(w io.Writer, p *Preamble) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	if len(b) > math.MaxUint16 {
+		return fmt.Errorf("%w: too long: %d bytes", ErrInvalidPreamble, len(b))
+	}
+	frame := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(b)), uint16(len(b)))
+	_, err = w.Write(append(frame, b...))
+	return err
+}
+
+// readPreamble reads one framed preamble from r.
+func readPreamble(r io.Reader) (*Preamble, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPreamble, err)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPreamble, err)
+	}
+	p := &Preamble{}
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPreamble, err)
+	}
+	return p, nil
+}
+
+// TokenConn is a connection accepted by a TokenListener. TokenConn carries
+// the claims of the verified access token.
+type TokenConn struct {
+	net.Conn
+	ctx      context.Context
+	metadata map[string]string
+}
+
+// Context returns a context with the verified claims, for use with GetClaim
+// and GetCustomClaim.
+func (c *TokenConn) Context() context.Context {
+	return c.ctx
+}
+
+// Claims returns the verified access token claims, or nil when the client did
+// not present a token.
+func (c *TokenConn) Claims() *jwt.Claims {
+	return GetClaim(c.ctx)
+}
+
+// Unwrap returns the underlying connection.
+func (c *TokenConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+// Metadata returns the metadata sent by the client in the preamble.
+func (c *TokenConn) Metadata() map[string]string {
+	return c.metadata
+}
+
+// accepted is the result of one accepted connection.
+type accepted struct {
+	conn net.Conn
+	err  error
+}
+
+// TokenListener wraps a net.Listener to require a Preamble with a valid
+// access token from every new connection. Connections with a missing or
+// invalid preamble, or rejected tokens, are closed without being returned
+// from Accept. Every TokenListener connection is enforced, so the Enforced
+// paths of the TokenController have no effect. New connections are closed
+// while the maximum number of handshakes, in total or from the client IPv4 /24
+// or IPv6 /64 subnet, are in progress.
+type TokenListener struct {
+	net.Listener
+	token   *TokenController
+	timeout time.Duration
+
+	mu         sync.Mutex
+	max        int
+	maxSubnet  int
+	handshakes int
+	subnets    map[string]int
+
+	start  sync.Once
+	conns  chan accepted
+	closed chan struct{}
+	close  sync.Once
+	failed chan struct{} // Closed when the underlying listener fails.
+	err    error
+}
+
+// TokenListenerOption configures a TokenListener.
+type TokenListenerOption func(*TokenListener)
+
+// WithMaxHandshakes limits the number of connections a TokenListener reads
+// preambles from concurrently. The default is 256.
+func WithMaxHandshakes(n int) TokenListenerOption {
+	return func(tl *TokenListener) { tl.max = n }
+}
+
+// WithMaxSubnetHandshakes limits the number of connections from one client
+// IPv4 /24 or IPv6 /64 subnet that a TokenListener reads preambles from
+// concurrently. The default is 16.
+func WithMaxSubnetHandshakes(n int) TokenListenerOption {
+	return func(tl *TokenListener) { tl.maxSubnet = n }
+}
+
+// NewTokenListener creates a TokenListener that verifies preambles with the
+// given TokenController. Clients must send the preamble within timeout. When
+// timeout is zero, clients have five seconds.
+func NewTokenListener(l net.Listener, t *TokenController, timeout time.Duration, opts ...TokenListenerOption) *TokenListener {
+	if timeout == 0 {
+		timeout = defaultPreambleTimeout
+	}
+	tl := &TokenListener{
+		Listener:  l,
+		token:     t,
+		timeout:   timeout,
+		max:       defaultMaxHandshakes,
+		maxSubnet: defaultMaxSubnetHandshakes,
+		subnets:   map[string]int{},
+		conns:     make(chan accepted),
+		closed:    make(chan struct{}),
+		failed:    make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(tl)
+	}
+	return tl
+}
+
+// Accept returns the next connection with a verified access token. The
+// returned net.Conn is a *TokenConn. Preambles are read concurrently, so slow
+// clients do not delay other connections.
+func (tl *TokenListener) Accept() (net.Conn, error) {
+	tl.start.Do(func() { go tl.serve() })
+	select {
+	case a := <-tl.conns:
+		return a.conn, a.err
+	case <-tl.failed:
+		return nil, tl.err
+	case <-tl.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the underlying listener. Connections waiting for a preamble
+// are closed when their handshake completes.
+func (tl *TokenListener) Close() error {
+	tl.close.Do(func() { close(tl.closed) })
+	return tl.Listener.Close()
+}
+
+// serve accepts connections from the underlying listener until it fails.
+// Connections are closed when too many handshakes are in progress. Timeout
+// errors are returned by Accept, and serve continues. Other errors are
+// returned by every following call to Accept.
+func (tl *TokenListener) serve() {
+	for {
+		conn, err := tl.Listener.Accept()
+		var ne net.Error
+		switch {
+		case err == nil:
+			release, reason := tl.acquire(conn)
+			if release == nil {
+				tokenAccessRequests.WithLabelValues("raw", "rejected", reason).Inc()
+				conn.Close()
+				continue
+			}
+			go tl.handshake(conn, release)
+		case errors.As(err, &ne) && ne.Timeout():
+			select {
+			case tl.conns <- accepted{err: err}:
+			case <-tl.closed:
+			}
+		default:
+			tl.err = err
+			close(tl.failed)
+			return
+		}
+	}
+}
+
+// acquire reserves a handshake for conn. It returns the function to release
+// the handshake, or nil and the reason the connection is rejected.
+func (tl *TokenListener) acquire(conn net.Conn) (func(), string) {
+	subnet := ""
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && addr.IP != nil {
+		subnet = clientKey(addr.IP, "")
+	}
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	switch {
+	case tl.handshakes >= tl.max:
+		return nil, "max-handshakes"
+	case subnet != "" && tl.subnets[subnet] >= tl.maxSubnet:
+		return nil, "max-subnet-handshakes"
+	}
+	tl.handshakes++
+	if subnet != "" {
+		tl.subnets[subnet]++
+	}
+	return func() {
+		tl.mu.Lock()
+		defer tl.mu.Unlock()
+		tl.handshakes--
+		if subnet == "" {
+			return
+		}
+		if tl.subnets[subnet]--; tl.subnets[subnet] == 0 {
+			delete(tl.subnets, subnet)
+		}
+	}, ""
+}
+
+// handshake reads and verifies the preamble of conn, and delivers accepted
+// connections to Accept. handshake calls release when the handshake ends.
+func (tl *TokenListener) handshake(conn net.Conn, release func()) {
+	defer release()
+	tc, err := tl.verify(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	select {
+	case tl.conns <- accepted{conn: tc}:
+	case <-tl.closed:
+		conn.Close()
+	}
+}
+
+// verify reads the preamble of conn within the timeout and verifies the token.
+func (tl *TokenListener) verify(conn net.Conn) (*TokenConn, error) {
+	conn.SetReadDeadline(time.Now().Add(tl.timeout))
+	p, err := readPreamble(conn)
+	if err != nil {
+		tokenAccessRequests.WithLabelValues("raw", "rejected", "preamble").Inc()
+		return nil, err
+	}
+	// Clear the deadline for the application protocol.
+	conn.SetReadDeadline(time.Time{})
+	var remote net.IP
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		remote = addr.IP
+	}
+	ok, ctx, reason := tl.token.check(context.Background(), "raw", p.Token, remote)
+	if !ok {
+		return nil, fmt.Errorf("TokenListener rejected connection %s: %s", conn.RemoteAddr(), reason)
+	}
+	return &TokenConn{Conn: conn, ctx: ctx, metadata: p.Metadata}, nil
+}
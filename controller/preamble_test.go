@@ -0,0 +1,177 @@
+package controller
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+func TestWritePreamble(t *testing.T) {
+	buf := &bytes.Buffer{}
+	want := &Preamble{Token: "abc", Metadata: map[string]string{"client": "test"}}
+	if err := WritePreamble(buf, want); err != nil {
+		t.Fatalf("WritePreamble() failed: %v", err)
+	}
+	got, err := readPreamble(buf)
+	if err != nil {
+		t.Fatalf("readPreamble() failed: %v", err)
+	}
+	if got.Token != want.Token || got.Metadata["client"] != "test" {
+		t.Errorf("readPreamble() = %#v, want %#v", got, want)
+	}
+
+	long := &Preamble{Token: string(make([]byte, 70000))}
+	if err := WritePreamble(io.Discard, long); !errors.Is(err, ErrInvalidPreamble) {
+		t.Errorf("WritePreamble() wrong error for long preamble; got %v", err)
+	}
+	for name, b := range map[string][]byte{
+		"short-length": {0},
+		"short-body":   {0, 10, '{'},
+		"bad-json":     {0, 1, '['},
+	} {
+		if _, err := readPreamble(bytes.NewReader(b)); !errors.Is(err, ErrInvalidPreamble) {
+			t.Errorf("readPreamble(%s) wrong error; got %v", name, err)
+		}
+	}
+}
+
+func TestTokenListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	claims := &jwt.Claims{Subject: "ndt"}
+	tc := &TokenController{Public: &fakeVerifier{claims: claims}, Required: true}
+	tl := NewTokenListener(l, tc, 50*time.Millisecond)
+	defer tl.Close()
+
+	dial := func(p *Preamble) net.Conn {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		if p != nil {
+			if err := WritePreamble(c, p); err != nil {
+				t.Fatalf("WritePreamble() failed: %v", err)
+			}
+		}
+		return c
+	}
+	// A client that never sends a preamble, and one without a token, do not
+	// delay the valid client.
+	slow := dial(nil)
+	defer slow.Close()
+	empty := dial(&Preamble{})
+	defer empty.Close()
+	good := dial(&Preamble{Token: "abc", Metadata: map[string]string{"client": "test"}})
+	defer good.Close()
+
+	conn, err := tl.Accept()
+	if err != nil {
+		t.Fatalf("TokenListener.Accept() failed: %v", err)
+	}
+	defer conn.Close()
+	tconn, ok := conn.(*TokenConn)
+	if !ok {
+		t.Fatalf("TokenListener.Accept() wrong conn type %T", conn)
+	}
+	if tconn.Claims() != claims || GetClaim(tconn.Context()) != claims {
+		t.Errorf("TokenConn.Claims() wrong claims; got %v", tconn.Claims())
+	}
+	if tconn.Metadata()["client"] != "test" {
+		t.Errorf("TokenConn.Metadata() = %v", tconn.Metadata())
+	}
+	// The application protocol follows the preamble without a deadline.
+	if _, err := good.Write([]byte("hi")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "hi" {
+		t.Errorf("TokenConn read failed; got %q, %v", b, err)
+	}
+
+	// Rejected clients are closed.
+	for name, c := range map[string]net.Conn{"slow": slow, "empty": empty} {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := c.Read(b); err == nil {
+			t.Errorf("TokenListener did not close %s client", name)
+		}
+	}
+
+	tl.Close()
+	if _, err := tl.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("TokenListener.Accept() after Close wrong error; got %v", err)
+	}
+}
+
+func TestTokenListener_maxHandshakes(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	tc := &TokenController{Public: &fakeVerifier{claims: &jwt.Claims{}}, Required: true}
+	tl := NewTokenListener(l, tc, time.Minute, WithMaxHandshakes(2), WithMaxSubnetHandshakes(1))
+	defer tl.Close()
+
+	dial := func(local string) net.Conn {
+		d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(local)}}
+		c, err := d.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to dial from %s: %v", local, err)
+		}
+		return c
+	}
+	closed := func(c net.Conn) bool {
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := c.Read(make([]byte, 1))
+		return err == io.EOF
+	}
+
+	// The slow client holds the only handshake of its subnet, so the next
+	// client from that subnet is closed before it is read.
+	slow := dial("127.0.0.1")
+	defer slow.Close()
+	busy := dial("127.0.0.2")
+	defer busy.Close()
+	// Start serving without consuming an accepted connection.
+	tl.start.Do(func() { go tl.serve() })
+	if !closed(busy) {
+		t.Errorf("TokenListener did not close client from a busy subnet")
+	}
+
+	// A client from another subnet is not locked out by the slow client.
+	good := dial("127.0.1.1")
+	defer good.Close()
+	if err := WritePreamble(good, &Preamble{Token: "abc"}); err != nil {
+		t.Fatalf("WritePreamble() failed: %v", err)
+	}
+	conn, err := tl.Accept()
+	if err != nil {
+		t.Fatalf("TokenListener.Accept() failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Once every handshake is in progress, clients from any subnet are closed.
+	other := dial("127.0.2.1")
+	defer other.Close()
+	full := dial("127.0.3.1")
+	defer full.Close()
+	if !closed(full) {
+		t.Errorf("TokenListener did not close client while handshakes are full")
+	}
+}
+
+func TestTokenListener_acceptError(t *testing.T) {
+	fail := errors.New("fake accept error")
+	tl := NewTokenListener(&fakeListener{err: fail}, &TokenController{}, 0)
+	for i := 0; i < 2; i++ {
+		if _, err := tl.Accept(); err != fail {
+			t.Errorf("TokenListener.Accept() wrong error; got %v, want %v", err, fail)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+	"golang.org/x/sync/semaphore"
+)
+
+// ErrInvalidClass is returned when a priority class is misconfigured.
+var ErrInvalidClass = errors.New("invalid priority class")
+
+// Class is a priority class of clients, selected by access token claims.
+type Class struct {
+	// Name identifies the class.
+	Name string `json:"name"`
+
+	// Subjects and Issuers select the claims in this class. When both are
+	// given, claims must match both. When both are empty, the class matches
+	// every request, including requests without claims.
+	Subjects []string `json:"subjects,omitempty"`
+	Issuers  []string `json:"issuers,omitempty"`
+
+	// Bypass accepts requests of this class without enforcing limits.
+	Bypass bool `json:"bypass,omitempty"`
+
+	// Multiplier scales the TxController limits for this class, e.g. 1.2
+	// admits the class until rates reach 120% of the limits, and 0.5 rejects
+	// the class above half of the limits. When zero, the multiplier is 1.
+	Multiplier float64 `json:"multiplier,omitempty"`
+
+	// Reserved is the concurrency capacity, or number of grants, reserved for
+	// this class. Other classes cannot use reserved capacity. When the
+	// reserved capacity is used, the class shares the remaining capacity.
+	Reserved int64 `json:"reserved,omitempty"`
+}
+
+// defaultClass is used for requests that match no configured class.
+var defaultClass = &Class{Name: "default"}
+
+// matches reports whether the (possibly nil) claim belongs to the class.
+func (c *Class) matches(cl *jwt.Claims) bool {
+	if len(c.Subjects) == 0 && len(c.Issuers) == 0 {
+		return true
+	}
+	if cl == nil {
+		return false
+	}
+	if len(c.Subjects) > 0 && !slices.Contains(c.Subjects, cl.Subject) {
+		return false
+	}
+	if len(c.Issuers) > 0 && !slices.Contains(c.Issuers, cl.Issuer) {
+		return false
+	}
+	return true
+}
+
+// multiplier returns the effective limit multiplier of the class.
+func (c *Class) multiplier() float64 {
+	if c.Multiplier == 0 {
+		return 1
+	}
+	return c.Multiplier
+}
+
+// Classes is an ordered list of priority classes. A nil Classes is equal to
+// DefaultClasses.
+type Classes []Class
+
+// DefaultClasses returns the classes used when none are configured: tokens
+// issued for the "monitoring" subject bypass all limits.
+func DefaultClasses() Classes {
+	return Classes{{Name: monitorSubject, Subjects: []string{monitorSubject}, Bypass: true}}
+}
+
+// Classify returns the first class matching the (possibly nil) claim, or a
+// default class without bypass, multiplier or reserved capacity.
+func (cs Classes) Classify(cl *jwt.Claims) *Class {
+	if cs == nil {
+		cs = DefaultClasses()
+	}
+	for i := range cs {
+		if cs[i].matches(cl) {
+			return &cs[i]
+		}
+	}
+	return defaultClass
+}
+
+// Validate checks that class names are unique and that multipliers and
+// reserved capacity are not negative.
+func (cs Classes) Validate() error {
+	names := map[string]bool{}
+	for _, c := range cs {
+		switch {
+		case c.Name == "" || c.Name == defaultClass.Name || names[c.Name]:
+			return fmt.Errorf("%w: missing, reserved or duplicate name %q", ErrInvalidClass, c.Name)
+		case c.Multiplier < 0:
+			return fmt.Errorf("%w: %q: negative multiplier", ErrInvalidClass, c.Name)
+		case c.Reserved < 0:
+			return fmt.Errorf("%w: %q: negative reserved capacity", ErrInvalidClass, c.Name)
+		}
+		names[c.Name] = true
+	}
+	return nil
+}
+
+// scale returns the limits multiplied by m. Non-zero limits remain non-zero.
+func (l Limits) scale(m float64) Limits {
+	if m == 1 {
+		return l
+	}
+	s := func(v uint64) uint64 {
+		if v == 0 {
+			return 0
+		}
+		return max(1, uint64(math.Round(float64(v)*m)))
+	}
+	return Limits{Tx: s(l.Tx), Rx: s(l.Rx), Total: s(l.Total)}
+}
+
+// ClassLimiter limits the concurrent use of a capacity shared by all classes,
+// with part of the capacity reserved for individual classes. A nil
+// ClassLimiter does not limit.
+type ClassLimiter struct {
+	shared   *semaphore.Weighted
+	reserved map[string]*semaphore.Weighted
+}
+
+// NewClassLimiter creates a ClassLimiter for max concurrent users. The
+// reserved capacity of all classes must not exceed max.
+func NewClassLimiter(max int64, classes Classes) (*ClassLimiter, error) {
+	if err := classes.Validate(); err != nil {
+		return nil, err
+	}
+	l := &ClassLimiter{reserved: map[string]*semaphore.Weighted{}}
+	shared := max
+	for _, c := range classes {
+		if c.Reserved > 0 {
+			l.reserved[c.Name] = semaphore.NewWeighted(c.Reserved)
+			shared -= c.Reserved
+		}
+	}
+	if max < 0 || shared < 0 {
+		return nil, fmt.Errorf("%w: reserved capacity exceeds %d", ErrInvalidLimit, max)
+	}
+	l.shared = semaphore.NewWeighted(shared)
+	return l, nil
+}
+
+// TryAcquire reserves one unit of capacity for the class, using the reserved
+// capacity of the class first. On success, TryAcquire returns a release
+// function that must be called exactly once. Otherwise, it returns false.
+func (l *ClassLimiter) TryAcquire(c *Class) (func(), bool) {
+	if l == nil {
+		return func() {}, true
+	}
+	for _, sem := range []*semaphore.Weighted{l.reserved[c.Name], l.shared} {
+		if sem != nil && sem.TryAcquire(1) {
+			return func() { sem.Release(1) }, true
+		}
+	}
+	return nil, false
+}
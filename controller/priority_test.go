@@ -0,0 +1,122 @@
+package controller
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+func TestClasses_Classify(t *testing.T) {
+	classes := Classes{
+		{Name: "partner", Subjects: []string{"ndt"}, Issuers: []string{"partner"}},
+		{Name: "research", Subjects: []string{"wehe", "ndt"}},
+	}
+	tests := []struct {
+		name    string
+		classes Classes
+		claim   *jwt.Claims
+		want    string
+	}{
+		{name: "nil-claim", classes: classes, want: "default"},
+		{name: "subject-and-issuer", classes: classes, claim: &jwt.Claims{Subject: "ndt", Issuer: "partner"}, want: "partner"},
+		{name: "subject-only", classes: classes, claim: &jwt.Claims{Subject: "ndt", Issuer: "locate"}, want: "research"},
+		{name: "no-match", classes: classes, claim: &jwt.Claims{Subject: "other"}, want: "default"},
+		{name: "default-monitoring", claim: &jwt.Claims{Subject: monitorSubject}, want: monitorSubject},
+		{name: "empty-classes-monitoring", classes: Classes{}, claim: &jwt.Claims{Subject: monitorSubject}, want: "default"},
+		{name: "match-all", classes: Classes{{Name: "all"}}, want: "all"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.classes.Classify(tt.claim); got.Name != tt.want {
+				t.Errorf("Classes.Classify() = %q, want %q", got.Name, tt.want)
+			}
+		})
+	}
+}
+
+func TestClasses_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		classes Classes
+		wantErr bool
+	}{
+		{name: "success", classes: Classes{{Name: "a", Multiplier: 2, Reserved: 1}, {Name: "b"}}},
+		{name: "success-nil"},
+		{name: "error-missing-name", classes: Classes{{}}, wantErr: true},
+		{name: "error-default-name", classes: Classes{{Name: "default"}}, wantErr: true},
+		{name: "error-duplicate-name", classes: Classes{{Name: "a"}, {Name: "a"}}, wantErr: true},
+		{name: "error-negative-multiplier", classes: Classes{{Name: "a", Multiplier: -1}}, wantErr: true},
+		{name: "error-negative-reserved", classes: Classes{{Name: "a", Reserved: -1}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.classes.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Classes.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidClass) {
+				t.Errorf("Classes.Validate() wrong error = %v", err)
+			}
+		})
+	}
+}
+
+func TestLimits_scale(t *testing.T) {
+	l := Limits{Tx: 100, Total: 1}
+	if got := l.scale(1.5); got != (Limits{Tx: 150, Total: 2}) {
+		t.Errorf("Limits.scale(1.5) = %#v", got)
+	}
+	if got := l.scale(0.1); got != (Limits{Tx: 10, Total: 1}) {
+		t.Errorf("Limits.scale(0.1) = %#v", got)
+	}
+}
+
+func TestClassLimiter(t *testing.T) {
+	classes := Classes{{Name: "premium", Reserved: 1}, {Name: "other"}}
+	l, err := NewClassLimiter(2, classes)
+	if err != nil {
+		t.Fatalf("NewClassLimiter() failed: %v", err)
+	}
+	premium, other := &classes[0], &classes[1]
+
+	// The other class uses the shared capacity, but not the reserved capacity.
+	releaseOther, ok := l.TryAcquire(other)
+	if !ok {
+		t.Fatalf("ClassLimiter.TryAcquire() failed for shared capacity")
+	}
+	if _, ok := l.TryAcquire(other); ok {
+		t.Errorf("ClassLimiter.TryAcquire() used reserved capacity of another class")
+	}
+	// The premium class uses its reserved capacity first.
+	releasePremium, ok := l.TryAcquire(premium)
+	if !ok {
+		t.Fatalf("ClassLimiter.TryAcquire() failed for reserved capacity")
+	}
+	if _, ok := l.TryAcquire(premium); ok {
+		t.Errorf("ClassLimiter.TryAcquire() exceeded max")
+	}
+	// After release, the premium class may use the shared capacity.
+	releaseOther()
+	releasePremium()
+	if _, ok := l.TryAcquire(premium); !ok {
+		t.Errorf("ClassLimiter.TryAcquire() failed after release")
+	}
+	if _, ok := l.TryAcquire(premium); !ok {
+		t.Errorf("ClassLimiter.TryAcquire() failed to use shared capacity")
+	}
+
+	var nilLimiter *ClassLimiter
+	if release, ok := nilLimiter.TryAcquire(other); !ok {
+		t.Errorf("ClassLimiter.TryAcquire() with nil limiter failed")
+	} else {
+		release()
+	}
+
+	if _, err := NewClassLimiter(1, Classes{{Name: "a", Reserved: 2}}); !errors.Is(err, ErrInvalidLimit) {
+		t.Errorf("NewClassLimiter() wrong error = %v", err)
+	}
+	if _, err := NewClassLimiter(1, Classes{{}}); !errors.Is(err, ErrInvalidClass) {
+		t.Errorf("NewClassLimiter() wrong error = %v", err)
+	}
+}
@@ -0,0 +1,234 @@
+package controller
+
+import (
+	"container/list"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+)
+
+var (
+	rateAccessRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "controller_access_ratecontroller_requests_total",
+			Help: "Total number of requests handled by the access ratecontroller.",
+		},
+		[]string{"request", "protocol"},
+	)
+	rateLimitedClients = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "controller_access_ratecontroller_limited_clients_total",
+			Help: "Total number of times a client subnet became rate limited.",
+		},
+	)
+	rateTrackedClients = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "controller_access_ratecontroller_clients",
+			Help: "Current number of client subnets tracked by the access ratecontroller.",
+		},
+	)
+
+	// ErrInvalidRate is returned when a RateConfig has a non-positive rate or burst.
+	ErrInvalidRate = errors.New("rate and burst must be positive")
+)
+
+// defaultMaxClients is the number of client keys tracked when unspecified.
+const defaultMaxClients = 10000
+
+// RateConfig configures a RateController.
+type RateConfig struct {
+	// Rate is the sustained number of requests per second allowed for each
+	// client subnet.
+	Rate float64
+
+	// Burst is the number of requests a client subnet may make at once.
+	Burst int
+
+	// BySubject limits clients separately for each token subject, so that a
+	// client of one service does not exhaust the limit of another.
+	BySubject bool
+
+	// MaxClients bounds the number of tracked clients. When full, the least
+	// recently seen client is forgotten. When zero, 10000 clients are tracked.
+	MaxClients int
+
+	// Classes are the priority classes of clients. Classes with Bypass are
+	// not limited; multipliers and reservations do not apply to request
+	// rates. When nil, the DefaultClasses are used.
+	Classes Classes
+}
+
+// RateController applies token bucket rate limits to requests and raw
+// connections, keyed by the client IPv4 /24 or IPv6 /64 subnet.
+type RateController struct {
+	cfg     RateConfig
+	mu      sync.Mutex
+	order   *list.List // Most recently used first.
+	clients map[string]*list.Element
+
+	// Enforced is a set of HTTP request resource paths on which the
+	// RateController will enforce rate limits. Any resource missing from the
+	// Enforced set, is allowed. When the RateController is used for Accept(),
+	// these paths have no effect.
+	Enforced Paths
+}
+
+// rateClient is the limiter for one client key.
+type rateClient struct {
+	key     string
+	limiter *rate.Limiter
+	limited bool
+}
+
+// NewRateController creates a new instance that limits the request rate of
+// client subnets on the enforced paths.
+func NewRateController(enforced Paths, cfg RateConfig) (*RateController, error) {
+	if enforced == nil {
+		return nil, ErrNilPaths
+	}
+	if cfg.Rate <= 0 || cfg.Burst <= 0 {
+		return nil, ErrInvalidRate
+	}
+	if err := cfg.Classes.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.MaxClients <= 0 {
+		cfg.MaxClients = defaultMaxClients
+	}
+	return &RateController{
+		cfg:      cfg,
+		order:    list.New(),
+		clients:  map[string]*list.Element{},
+		Enforced: enforced,
+	}, nil
+}
+
+// clientKey returns the subnet of ip, followed by the subject when non-empty.
+func clientKey(ip net.IP, subject string) string {
+	var subnet string
+	if ip4 := ip.To4(); ip4 != nil {
+		subnet = ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	} else {
+		subnet = ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+	}
+	if subject == "" {
+		return subnet
+	}
+	return subnet + " " + subject
+}
+
+// admit takes a token for the client ip and claims, unless the claims are of
+// a class with Bypass. When the client is limited, admit returns how long the
+// client should wait before trying again.
+func (rc *RateController) admit(ip net.IP, cl *jwt.Claims) (time.Duration, bool) {
+	if rc.cfg.Classes.Classify(cl).Bypass {
+		return 0, true
+	}
+	subject := ""
+	if rc.cfg.BySubject && cl != nil {
+		subject = cl.Subject
+	}
+	return rc.reserve(clientKey(ip, subject))
+}
+
+// reserve takes a token for the client key. When the client is limited,
+// reserve returns how long the client should wait before trying again.
+func (rc *RateController) reserve(key string) (time.Duration, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	var c *rateClient
+	if e, ok := rc.clients[key]; ok {
+		rc.order.MoveToFront(e)
+		c = e.Value.(*rateClient)
+	} else {
+		c = &rateClient{key: key, limiter: rate.NewLimiter(rate.Limit(rc.cfg.Rate), rc.cfg.Burst)}
+		rc.clients[key] = rc.order.PushFront(c)
+		if rc.order.Len() > rc.cfg.MaxClients {
+			oldest := rc.order.Remove(rc.order.Back()).(*rateClient)
+			delete(rc.clients, oldest.key)
+		}
+		rateTrackedClients.Set(float64(rc.order.Len()))
+	}
+	r := c.limiter.Reserve()
+	if d := r.Delay(); d > 0 {
+		// Return the token, since the request is rejected rather than delayed.
+		r.Cancel()
+		if !c.limited {
+			rateLimitedClients.Inc()
+		}
+		c.limited = true
+		return d, false
+	}
+	c.limited = false
+	return 0, true
+}
+
+// Limit enforces the client rate limits before running the next handler.
+// Limited clients receive 429 Too Many Requests with a Retry-After header.
+// Requests of classes with Bypass, e.g. monitoring, and requests without a
+// parsable remote address, are always accepted.
+func (rc *RateController) Limit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := remoteIP(r)
+		if !rc.Enforced[r.URL.Path] || ip == nil {
+			rateAccessRequests.WithLabelValues("accepted", "http").Inc()
+			next.ServeHTTP(w, r)
+			return
+		}
+		if wait, ok := rc.admit(ip, GetClaim(r.Context())); !ok {
+			rateAccessRequests.WithLabelValues("rejected", "http").Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			// 429 - https://tools.ietf.org/html/rfc6585#section-4
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		rateAccessRequests.WithLabelValues("accepted", "http").Inc()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Accept wraps the call to listener's Accept. If the client subnet of the
+// accepted connection is rate limited, then Accept immediately closes the
+// connection and returns an error.
+func (rc *RateController) Accept(l net.Listener) (net.Conn, error) {
+	if rc == nil {
+		// Simple pass-through.
+		return l.Accept()
+	}
+	return acceptWith(l, rc, "RateController")
+}
+
+// Name returns "rate". Name implements Admitter.
+func (rc *RateController) Name() string {
+	return "rate"
+}
+
+// Admit applies the rate limit of the client subnet to a new connection. The
+// class, and the subject with BySubject, come from the claims of connections
+// accepted by a TokenListener. Admit implements Admitter.
+func (rc *RateController) Admit(conn net.Conn) (net.Conn, string) {
+	if rc == nil {
+		return conn, ""
+	}
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || addr.IP == nil {
+		rateAccessRequests.WithLabelValues("accepted", "raw").Inc()
+		return conn, ""
+	}
+	// NOTE: treat all raw accept requests as an "enforced path".
+	if _, ok := rc.admit(addr.IP, ConnClaims(conn)); !ok {
+		rateAccessRequests.WithLabelValues("rejected", "raw").Inc()
+		return nil, "rate"
+	}
+	rateAccessRequests.WithLabelValues("accepted", "raw").Inc()
+	return conn, ""
+}
@@ -0,0 +1,268 @@
+package controller
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+func TestNewRateController(t *testing.T) {
+	tests := []struct {
+		name     string
+		enforced Paths
+		cfg      RateConfig
+		wantErr  error
+	}{
+		{
+			name:     "success",
+			enforced: Paths{},
+			cfg:      RateConfig{Rate: 1, Burst: 1},
+		},
+		{
+			name:    "error-nil-paths",
+			cfg:     RateConfig{Rate: 1, Burst: 1},
+			wantErr: ErrNilPaths,
+		},
+		{
+			name:     "error-zero-burst",
+			enforced: Paths{},
+			cfg:      RateConfig{Rate: 1},
+			wantErr:  ErrInvalidRate,
+		},
+		{
+			name:     "error-invalid-classes",
+			enforced: Paths{},
+			cfg:      RateConfig{Rate: 1, Burst: 1, Classes: Classes{{Name: ""}}},
+			wantErr:  ErrInvalidClass,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc, err := NewRateController(tt.enforced, tt.cfg)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("NewRateController() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && rc.cfg.MaxClients != defaultMaxClients {
+				t.Errorf("NewRateController() wrong MaxClients; got %d", rc.cfg.MaxClients)
+			}
+		})
+	}
+}
+
+func Test_clientKey(t *testing.T) {
+	tests := []struct {
+		ip      string
+		subject string
+		want    string
+	}{
+		{ip: "192.0.2.77", want: "192.0.2.0/24"},
+		{ip: "2001:db8:1:2:3::4", want: "2001:db8:1:2::/64"},
+		{ip: "192.0.2.77", subject: "ndt", want: "192.0.2.0/24 ndt"},
+	}
+	for _, tt := range tests {
+		if got := clientKey(net.ParseIP(tt.ip), tt.subject); got != tt.want {
+			t.Errorf("clientKey(%q, %q) = %q, want %q", tt.ip, tt.subject, got, tt.want)
+		}
+	}
+}
+
+func TestRateController_Limit(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       RateConfig
+		prior     []string // Remote addresses of earlier requests.
+		prevClaim *jwt.Claims
+		remote    string
+		claim     *jwt.Claims
+		path      string
+		visited   bool
+	}{
+		{
+			name:    "success",
+			cfg:     RateConfig{Rate: 1, Burst: 1},
+			remote:  "192.0.2.1:1234",
+			path:    "/",
+			visited: true,
+		},
+		{
+			name:    "reject-same-subnet",
+			cfg:     RateConfig{Rate: 0.01, Burst: 1},
+			prior:   []string{"192.0.2.1:1234"},
+			remote:  "192.0.2.2:1234",
+			path:    "/",
+			visited: false,
+		},
+		{
+			name:    "success-other-subnet",
+			cfg:     RateConfig{Rate: 0.01, Burst: 1},
+			prior:   []string{"192.0.2.1:1234"},
+			remote:  "198.51.100.1:1234",
+			path:    "/",
+			visited: true,
+		},
+		{
+			name:      "success-by-subject",
+			cfg:       RateConfig{Rate: 0.01, Burst: 1, BySubject: true},
+			prior:     []string{"192.0.2.1:1234"},
+			prevClaim: &jwt.Claims{Subject: "ndt"},
+			remote:    "192.0.2.1:1234",
+			claim:     &jwt.Claims{Subject: "wehe"},
+			path:      "/",
+			visited:   true,
+		},
+		{
+			name:    "success-unenforced-path",
+			cfg:     RateConfig{Rate: 0.01, Burst: 1},
+			prior:   []string{"192.0.2.1:1234"},
+			remote:  "192.0.2.1:1234",
+			path:    "/metrics",
+			visited: true,
+		},
+		{
+			name:    "success-monitoring",
+			cfg:     RateConfig{Rate: 0.01, Burst: 1},
+			prior:   []string{"192.0.2.1:1234"},
+			remote:  "192.0.2.1:1234",
+			claim:   &jwt.Claims{Subject: monitorSubject},
+			path:    "/",
+			visited: true,
+		},
+		{
+			name: "success-bypass-class",
+			cfg: RateConfig{
+				Rate: 0.01, Burst: 1,
+				Classes: Classes{{Name: "partner", Issuers: []string{"partner"}, Bypass: true}},
+			},
+			prior:   []string{"192.0.2.1:1234"},
+			remote:  "192.0.2.1:1234",
+			claim:   &jwt.Claims{Issuer: "partner"},
+			path:    "/",
+			visited: true,
+		},
+		{
+			// Configured classes replace the default monitoring class.
+			name: "reject-monitoring-without-class",
+			cfg: RateConfig{
+				Rate: 0.01, Burst: 1,
+				Classes: Classes{{Name: "partner", Issuers: []string{"partner"}, Bypass: true}},
+			},
+			prior:   []string{"192.0.2.1:1234"},
+			remote:  "192.0.2.1:1234",
+			claim:   &jwt.Claims{Subject: monitorSubject},
+			path:    "/",
+			visited: false,
+		},
+		{
+			name:    "success-evicted",
+			cfg:     RateConfig{Rate: 0.01, Burst: 1, MaxClients: 1},
+			prior:   []string{"192.0.2.1:1234", "198.51.100.1:1234"},
+			remote:  "192.0.2.1:1234",
+			path:    "/",
+			visited: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc, err := NewRateController(Paths{"/": true}, tt.cfg)
+			if err != nil {
+				t.Fatalf("NewRateController() failed: %v", err)
+			}
+			serve := func(remote, path string, cl *jwt.Claims, next http.Handler) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(http.MethodGet, path, nil)
+				req.RemoteAddr = remote
+				req = req.Clone(SetClaim(req.Context(), cl))
+				rw := httptest.NewRecorder()
+				rc.Limit(next).ServeHTTP(rw, req)
+				return rw
+			}
+			for _, remote := range tt.prior {
+				serve(remote, "/", tt.prevClaim, http.NotFoundHandler())
+			}
+
+			visited := false
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				visited = true
+			})
+			rw := serve(tt.remote, tt.path, tt.claim, next)
+
+			if visited != tt.visited {
+				t.Errorf("RateController.Limit() got %t, want %t", visited, tt.visited)
+			}
+			if !visited {
+				if rw.Code != http.StatusTooManyRequests {
+					t.Errorf("RateController.Limit() wrong code; got %d, want %d", rw.Code, http.StatusTooManyRequests)
+				}
+				// At 0.01 requests per second, the next token is 100s away.
+				if got := rw.Header().Get("Retry-After"); got != "100" {
+					t.Errorf("RateController.Limit() wrong Retry-After; got %q, want %q", got, "100")
+				}
+			}
+		})
+	}
+}
+
+type addrConn struct {
+	fakeConn
+	remote net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+type addrListener struct {
+	fakeListener
+	remote net.Addr
+	conns  []*addrConn
+}
+
+func (l *addrListener) Accept() (net.Conn, error) {
+	c := &addrConn{remote: l.remote}
+	l.conns = append(l.conns, c)
+	return c, nil
+}
+
+func TestRateController_Accept(t *testing.T) {
+	rc, err := NewRateController(Paths{}, RateConfig{Rate: 0.01, Burst: 1})
+	if err != nil {
+		t.Fatalf("NewRateController() failed: %v", err)
+	}
+	l := &addrListener{remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}}
+	if _, err := rc.Accept(l); err != nil {
+		t.Errorf("RateController.Accept() failed: %v", err)
+	}
+	if _, err := rc.Accept(l); err == nil || l.conns[1].closed != 1 {
+		t.Errorf("RateController.Accept() accepted limited client; err %v", err)
+	}
+	// Connections without a TCP remote address are accepted.
+	if _, err := rc.Accept(&fakeListener{}); err != nil {
+		t.Errorf("RateController.Accept() failed without remote address: %v", err)
+	}
+	if _, err := rc.Accept(&fakeListener{err: errors.New("fake accept error")}); err == nil {
+		t.Errorf("RateController.Accept() expected error")
+	}
+	// Connections with monitoring tokens bypass the limit.
+	mc := &TokenConn{Conn: &addrConn{remote: l.remote}, ctx: SetClaim(t.Context(), &jwt.Claims{Subject: monitorSubject})}
+	if _, reason := rc.Admit(mc); reason != "" {
+		t.Errorf("RateController.Admit() rejected monitoring connection: %q", reason)
+	}
+	// With BySubject, connections are limited by their token subject.
+	bs, err := NewRateController(Paths{}, RateConfig{Rate: 0.01, Burst: 1, BySubject: true})
+	if err != nil {
+		t.Fatalf("NewRateController() failed: %v", err)
+	}
+	for _, subject := range []string{"ndt", "wehe"} {
+		c := &TokenConn{Conn: &addrConn{remote: l.remote}, ctx: SetClaim(t.Context(), &jwt.Claims{Subject: subject})}
+		if _, reason := bs.Admit(c); reason != "" {
+			t.Errorf("RateController.Admit() rejected %s connection: %q", subject, reason)
+		}
+	}
+	var nilrc *RateController
+	if _, err := nilrc.Accept(&fakeListener{}); err != nil {
+		t.Errorf("RateController.Accept() with nil controller failed: %v", err)
+	}
+}
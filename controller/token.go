@@ -3,14 +3,16 @@ package controller
 import (
 	"context"
 	"errors"
+	"net"
 	"net/http"
 	"reflect"
-	"strings"
 	"time"
 
 	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/m-lab/access/token"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var (
@@ -38,9 +40,17 @@ type TokenController struct {
 	// access token is provided it must be valid to be accepted.
 	Required bool
 
+	// AllowListBypass, when set, accepts requests without an access token from
+	// clients on the allow list of an IPListController that runs before the
+	// TokenController (see GetAllowed). Otherwise, the allow list has no
+	// effect on the TokenController.
+	AllowListBypass bool
+
 	// Expected JWT fields are used to validate access token claims.
 	// Client-provided claims are only valid if each non-empty expected field
-	// matches the corresponding claims field.
+	// matches the corresponding claims field. When the verifier binds keys to
+	// issuers (see token.NewIssuerVerifier), the issuer of the signing key
+	// replaces the expected issuer, audience and subject that it specifies.
 	Expected jwt.Expected
 
 	// Enforced is a set of HTTP request resource paths on which the
@@ -71,8 +81,9 @@ type Verifier interface {
 }
 
 // NewTokenController creates a new token controller that requires tokens (or
-// not) and the default expected claims. An audience must be specified. The
-// issuer should be provided.
+// not) and the default expected claims. An audience must be specified, and
+// may include aliases and patterns, e.g. "*.mlab-oti.measurement-lab.org" (see
+// token.MatchAudience). The issuer should be provided.
 func NewTokenController(verifier Verifier, required bool, exp jwt.Expected, enforced Paths) (*TokenController, error) {
 	if enforced == nil {
 		return nil, ErrNilPaths
@@ -85,7 +96,7 @@ func NewTokenController(verifier Verifier, required bool, exp jwt.Expected, enfo
 	if exp.Issuer == "" {
 		return nil, jwt.ErrInvalidIssuer
 	}
-	if exp.AnyAudience == nil || exp.AnyAudience.Contains("") {
+	if exp.AnyAudience == nil || !token.ValidAudience(exp.AnyAudience) {
 		return nil, jwt.ErrInvalidAudience
 	}
 	return &TokenController{
@@ -116,54 +127,113 @@ func (t *TokenController) Limit(next http.Handler) http.Handler {
 // token is valid, then the returned context will include a boolean value
 // indicating whether the token issuer is "monitoring" or not. When
 // NewCustomClaim is set, the populated custom claim value is also attached to
-// the context via SetCustomClaim.
+// the context via SetCustomClaim. When the token includes a confirmation
+// ("cnf") claim, the request is rejected unless the client address matches it.
 func (t *TokenController) isVerified(r *http.Request) (bool, context.Context) {
-	ctx := r.Context()
 	// NOTE: r.Form is not populated until calling ParseForm.
 	r.ParseForm()
-	accessToken := r.Form.Get("access_token")
+	ok, ctx, _ := t.verify(r.Context(), r.URL.Path, r.Form.Get("access_token"), remoteIP(r))
+	return ok, ctx
+}
+
+// verify validates the access token given for the resource path by the client
+// at the remote address, which may be nil. verify returns whether the request
+// is accepted, the context with the verified claims, and the reason the
+// request was rejected.
+func (t *TokenController) verify(ctx context.Context, path, accessToken string, remote net.IP) (bool, context.Context, string) {
 	pathLabel := "unknown"
-	if !t.Enforced[r.URL.Path] {
+	if !t.Enforced[path] {
 		// This path is not in the Enforced set, so accept the connection.
 		tokenAccessRequests.WithLabelValues(pathLabel, "accepted", "unenforced-path").Inc()
-		return true, ctx
+		return true, ctx, ""
 	}
 
 	// The path is an enforced path, so copy it wholesale as a label.
-	pathLabel = r.URL.Path
+	return t.check(ctx, path, accessToken, remote)
+}
+
+// check validates the access token like verify, for an enforced resource. The
+// path is only used as a metric label. The decision is recorded in a span.
+func (t *TokenController) check(ctx context.Context, pathLabel, accessToken string, remote net.IP) (bool, context.Context, string) {
+	_, span := startSpan(ctx, "access.token.verify", attribute.String("access.path", pathLabel))
+	ok, ctx, reason := t.checkToken(ctx, pathLabel, accessToken, remote)
+	if cl := GetClaim(ctx); ok && cl != nil {
+		span.SetAttributes(
+			attribute.String("token.issuer", cl.Issuer),
+			attribute.String("token.subject", cl.Subject),
+		)
+	}
+	endSpan(span, reason)
+	return ok, ctx, reason
+}
+
+// checkToken implements check.
+func (t *TokenController) checkToken(ctx context.Context, pathLabel, accessToken string, remote net.IP) (bool, context.Context, string) {
 	if accessToken == "" && !t.Required {
 		// The access token is missing and tokens are not requried, so accept the request.
 		tokenAccessRequests.WithLabelValues(pathLabel, "accepted", "empty").Inc()
-		return true, ctx
+		return true, ctx, ""
+	}
+	if accessToken == "" && t.AllowListBypass && GetAllowed(ctx) != "" {
+		// The client is on the allow list of an IPListController.
+		tokenAccessRequests.WithLabelValues(pathLabel, "accepted", "allow-list").Inc()
+		return true, ctx, ""
 	}
 	if accessToken == "" {
 		// The access token was required but not provided.
 		tokenAccessRequests.WithLabelValues(pathLabel, "rejected", "missing").Inc()
-		return false, ctx
+		return false, ctx, "missing"
 	}
 	// Attempt to verify the token.
 	exp := t.Expected
 	exp.Time = time.Now()
 
 	var custom any
-	var extraDest []any
+	cnf := &token.ConfirmationClaims{}
+	extraDest := []any{cnf}
 	if t.NewCustomClaim != nil {
 		if c := t.NewCustomClaim(); c != nil {
 			custom = c
-			extraDest = []any{c}
+			extraDest = append(extraDest, c)
 		}
 	}
 	cl, verifyErr := t.Public.Verify(accessToken, exp, extraDest...)
 	if verifyErr != nil {
-		reason := strings.TrimPrefix(verifyErr.Error(), "go-jose/go-jose/jwt: validation failed, ")
+		// NOTE: verifier errors may include client-provided values, so only
+		// the classified reason is used as a label.
+		reason := string(token.Classify(verifyErr))
+		tokenAccessRequests.WithLabelValues(pathLabel, "rejected", reason).Inc()
+		return false, ctx, reason
+	}
+	// When the token is bound to a client address, only that client may use it.
+	if err := cnf.Confirmation.Check(remote); err != nil {
+		reason := "client-ip-mismatch"
+		if errors.Is(err, token.ErrInvalidConfirmation) {
+			reason = "invalid-confirmation"
+		}
 		tokenAccessRequests.WithLabelValues(pathLabel, "rejected", reason).Inc()
-		return false, ctx
+		return false, ctx, reason
 	}
 
 	ctx = SetClaim(ctx, cl)
 	if custom != nil {
 		ctx = SetCustomClaim(ctx, custom)
 	}
-	tokenAccessRequests.WithLabelValues(pathLabel, "accepted", cl.Issuer).Inc()
-	return true, ctx
+	// NOTE: the issuer claim is only used as a label when the verifier checked
+	// it against the expected issuer, or the issuer bound to the signing key.
+	issuerLabel := "unknown"
+	if t.Expected.Issuer != "" {
+		issuerLabel = cl.Issuer
+	}
+	tokenAccessRequests.WithLabelValues(pathLabel, "accepted", issuerLabel).Inc()
+	return true, ctx, ""
+}
+
+// remoteIP returns the client IP from the request remote address, or nil.
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
 }
@@ -1,6 +1,9 @@
 package controller
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -8,8 +11,11 @@ import (
 	"testing"
 	"time"
 
+	"github.com/go-jose/go-jose/v4"
 	"github.com/go-jose/go-jose/v4/jwt"
 	"github.com/go-test/deep"
+	"github.com/m-lab/access/token"
+	"github.com/m-lab/go/rtx"
 )
 
 // testCustomClaims is a sample caller-defined claim type used to exercise the
@@ -21,7 +27,8 @@ type testCustomClaims struct {
 
 type fakeVerifier struct {
 	claims *jwt.Claims
-	custom *testCustomClaims // if non-nil, populates extra dest
+	custom *testCustomClaims   // if non-nil, populates extra dest
+	cnf    *token.Confirmation // if non-nil, populates confirmation dest
 	err    error
 }
 
@@ -33,6 +40,13 @@ func (f *fakeVerifier) Verify(tok string, exp jwt.Expected, extraDest ...any) (*
 			}
 		}
 	}
+	if f.cnf != nil {
+		for _, d := range extraDest {
+			if c, ok := d.(*token.ConfirmationClaims); ok {
+				c.Confirmation = f.cnf
+			}
+		}
+	}
 	return f.claims, f.err
 }
 
@@ -166,6 +180,17 @@ func TestTokenController_Limit(t *testing.T) {
 			expected: Paths{"/": true},
 			wantErr:  true,
 		},
+		{
+			name:    "error-invalid-audience-pattern",
+			issuer:  locateIssuer,
+			machine: "mlab*.fake0",
+			verifier: &fakeVerifier{
+				err: fmt.Errorf("fake failure to verify"),
+			},
+			required: true,
+			expected: Paths{"/": true},
+			wantErr:  true,
+		},
 		{
 			name:    "error-empty-issuer",
 			issuer:  "",
@@ -229,7 +254,7 @@ func TestTokenController_Limit(t *testing.T) {
 		},
 		{
 			// NewCustomClaim returning nil must be tolerated and must NOT
-			// cause the request to be rejected (no extra dest is sent to
+			// cause the request to be rejected (no custom dest is sent to
 			// Verify, and no value is attached to the context).
 			name:    "success-with-nil-custom-claim",
 			issuer:  locateIssuer,
@@ -249,6 +274,61 @@ func TestTokenController_Limit(t *testing.T) {
 			newCustom:  func() any { return nil },
 			wantCustom: nil,
 		},
+		{
+			name:    "success-with-matching-confirmation",
+			issuer:  locateIssuer,
+			machine: "mlab1.fake0",
+			verifier: &fakeVerifier{
+				claims: &jwt.Claims{
+					Issuer:   locateIssuer,
+					Audience: []string{"mlab1.fake0"},
+					Expiry:   jwt.NewNumericDate(time.Now()),
+				},
+				// httptest requests originate from 192.0.2.1.
+				cnf: &token.Confirmation{IP: "192.0.2.0/24"},
+			},
+			required: true,
+			token:    "this-is-a-fake-token",
+			code:     http.StatusOK,
+			visited:  true,
+			expected: Paths{"/": true},
+		},
+		{
+			name:    "error-confirmation-mismatch",
+			issuer:  locateIssuer,
+			machine: "mlab1.fake0",
+			verifier: &fakeVerifier{
+				claims: &jwt.Claims{
+					Issuer:   locateIssuer,
+					Audience: []string{"mlab1.fake0"},
+					Expiry:   jwt.NewNumericDate(time.Now()),
+				},
+				cnf: &token.Confirmation{IP: "198.51.100.1"},
+			},
+			required: true,
+			token:    "this-is-a-fake-token",
+			code:     http.StatusUnauthorized,
+			visited:  false,
+			expected: Paths{"/": true},
+		},
+		{
+			name:    "error-confirmation-invalid",
+			issuer:  locateIssuer,
+			machine: "mlab1.fake0",
+			verifier: &fakeVerifier{
+				claims: &jwt.Claims{
+					Issuer:   locateIssuer,
+					Audience: []string{"mlab1.fake0"},
+					Expiry:   jwt.NewNumericDate(time.Now()),
+				},
+				cnf: &token.Confirmation{IP: "not-an-ip"},
+			},
+			required: true,
+			token:    "this-is-a-fake-token",
+			code:     http.StatusUnauthorized,
+			visited:  false,
+			expected: Paths{"/": true},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -297,3 +377,71 @@ func TestTokenController_Limit(t *testing.T) {
 		})
 	}
 }
+
+func TestTokenController_issuers(t *testing.T) {
+	newKeys := func(kid string) ([]byte, []byte) {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		rtx.Must(err, "failed to generate key")
+		jwk := jose.JSONWebKey{Key: priv, KeyID: kid, Algorithm: string(jose.ES256), Use: "sig"}
+		privJSON, err := jwk.MarshalJSON()
+		rtx.Must(err, "failed to marshal private key")
+		pubJSON, err := jwk.Public().MarshalJSON()
+		rtx.Must(err, "failed to marshal public key")
+		return privJSON, pubJSON
+	}
+	locatePriv, locatePub := newKeys("locate-1")
+	monitorPriv, monitorPub := newKeys("monitor-1")
+	v, err := token.NewIssuerVerifier(
+		token.Issuer{Name: locateIssuer, Keys: [][]byte{locatePub}},
+		token.Issuer{Name: "monitoring-issuer", Keys: [][]byte{monitorPub}, Subjects: []string{monitorSubject}},
+	)
+	rtx.Must(err, "failed to create verifier")
+	tc, err := NewTokenController(v, true, jwt.Expected{Issuer: locateIssuer, AnyAudience: jwt.Audience{"mlab1"}}, Paths{"/": true})
+	rtx.Must(err, "failed to create token controller")
+
+	expiry := jwt.NewNumericDate(time.Now().Add(time.Minute))
+	tests := []struct {
+		name string
+		key  []byte
+		cl   jwt.Claims
+		want bool
+	}{
+		{
+			name: "success-locate",
+			key:  locatePriv,
+			cl:   jwt.Claims{Issuer: locateIssuer, Subject: "ndt", Audience: jwt.Audience{"mlab1"}, Expiry: expiry},
+			want: true,
+		},
+		{
+			name: "success-monitoring",
+			key:  monitorPriv,
+			cl:   jwt.Claims{Issuer: "monitoring-issuer", Subject: monitorSubject, Audience: jwt.Audience{"mlab1"}, Expiry: expiry},
+			want: true,
+		},
+		{
+			name: "error-monitoring-key-locate-issuer",
+			key:  monitorPriv,
+			cl:   jwt.Claims{Issuer: locateIssuer, Subject: monitorSubject, Audience: jwt.Audience{"mlab1"}, Expiry: expiry},
+		},
+		{
+			name: "error-monitoring-wrong-subject",
+			key:  monitorPriv,
+			cl:   jwt.Claims{Issuer: "monitoring-issuer", Subject: "ndt", Audience: jwt.Audience{"mlab1"}, Expiry: expiry},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := token.NewSigner(tt.key)
+			rtx.Must(err, "failed to create signer")
+			tok, err := s.Sign(tt.cl)
+			rtx.Must(err, "failed to sign claims")
+			ok, ctx, reason := tc.verify(t.Context(), "/", tok, nil)
+			if ok != tt.want {
+				t.Fatalf("TokenController.verify() = %v, %q, want %v", ok, reason, tt.want)
+			}
+			if ok && GetClaim(ctx).Issuer != tt.cl.Issuer {
+				t.Errorf("TokenController.verify() wrong claims; got %v", GetClaim(ctx))
+			}
+		})
+	}
+}
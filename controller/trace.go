@@ -0,0 +1,35 @@
+package controller
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation scope of access controller spans.
+const tracerName = "github.com/m-lab/access/controller"
+
+// startSpan starts a span for an access decision as a child of any span in
+// ctx. Spans use the global TracerProvider, so they are only recorded once the
+// application installs one, e.g. with otel.SetTracerProvider.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records the access decision and ends the span. An empty reason
+// means the request was accepted.
+func endSpan(span trace.Span, reason string) {
+	if reason == "" {
+		span.SetAttributes(attribute.String("access.decision", "accepted"))
+	} else {
+		span.SetAttributes(
+			attribute.String("access.decision", "rejected"),
+			attribute.String("access.reason", reason),
+		)
+		span.SetStatus(codes.Error, reason)
+	}
+	span.End()
+}
@@ -0,0 +1,94 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans installs a global TracerProvider that records ended spans.
+func recordSpans() *tracetest.SpanRecorder {
+	sr := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	return sr
+}
+
+// spanAttr returns the string value of the named span attribute.
+func spanAttr(s sdktrace.ReadOnlySpan, key string) string {
+	for _, kv := range s.Attributes() {
+		if kv.Key == attribute.Key(key) {
+			return kv.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestSpans(t *testing.T) {
+	sr := recordSpans()
+	tc := &TokenController{
+		Public:   &fakeVerifier{claims: &jwt.Claims{Issuer: locateIssuer, Subject: "ndt"}},
+		Required: true,
+		Enforced: Paths{"/": true},
+	}
+	tx := &TxController{limits: Limits{Tx: 100}, Enforced: Paths{"/": true}}
+	tx.rates.set(200, 0)
+	h := tc.Limit(tx.Limit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "request")
+	req := httptest.NewRequest(http.MethodGet, "/?access_token=abc", nil).WithContext(ctx)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	parent.End()
+
+	tests := []struct {
+		name     string
+		decision string
+		reason   string
+		attr     string
+		value    string
+	}{
+		{name: "access.token.verify", decision: "accepted", attr: "token.subject", value: "ndt"},
+		{name: "access.tx.limit", decision: "rejected", reason: "tx", attr: "access.protocol", value: "http"},
+	}
+	spans := sr.Ended()
+	if len(spans) != len(tests)+1 {
+		t.Fatalf("wrong number of spans; got %d, want %d", len(spans), len(tests)+1)
+	}
+	for i, tt := range tests {
+		s := spans[i]
+		if s.Name() != tt.name {
+			t.Errorf("span[%d] wrong name; got %q, want %q", i, s.Name(), tt.name)
+		}
+		if s.Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("span %q is not a child of the request span", s.Name())
+		}
+		if got := spanAttr(s, "access.decision"); got != tt.decision {
+			t.Errorf("span %q wrong decision; got %q, want %q", s.Name(), got, tt.decision)
+		}
+		if got := spanAttr(s, "access.reason"); got != tt.reason {
+			t.Errorf("span %q wrong reason; got %q, want %q", s.Name(), got, tt.reason)
+		}
+		if got := spanAttr(s, tt.attr); got != tt.value {
+			t.Errorf("span %q wrong %s; got %q, want %q", s.Name(), tt.attr, got, tt.value)
+		}
+	}
+}
+
+func TestSpans_tokenRejected(t *testing.T) {
+	sr := recordSpans()
+	tc := &TokenController{Public: &fakeVerifier{err: jose.ErrCryptoFailure}, Required: true}
+	if ok, _, _ := tc.check(context.Background(), "raw", "abc", nil); ok {
+		t.Fatalf("check() accepted invalid token")
+	}
+	spans := sr.Ended()
+	if len(spans) != 1 || spanAttr(spans[0], "access.reason") != "bad-signature" {
+		t.Errorf("check() wrong spans; got %v", spans)
+	}
+}
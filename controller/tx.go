@@ -7,46 +7,347 @@ import (
 	"fmt"
 	"log"
 	"math"
+	"math/rand/v2"
 	"net"
 	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/procfs"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var (
 	procPath         = "/proc"
-	device           string
-	maxRate          uint64
 	txAccessRequests = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "controller_access_txcontroller_requests_total",
 			Help: "Total number of requests handled by the access txcontroller.",
 		},
-		[]string{"request", "protocol"},
+		[]string{"request", "protocol", "reason"},
+	)
+	txRate = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "controller_access_txcontroller_rate_bits",
+			Help: "Current estimated rate in bits per second, by device (or all) and direction: tx, rx or total.",
+		},
+		[]string{"device", "direction"},
+	)
+	txLimited = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "controller_access_txcontroller_limited",
+			Help: "Whether the txcontroller is limited (1) or not (0), by device (or all) and direction: tx, rx or total.",
+		},
+		[]string{"device", "direction"},
+	)
+	txLimit = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "controller_access_txcontroller_limit_bits",
+			Help: "Configured limit in bits per second, by device (or all), direction: tx, rx or total, and watermark: high or low.",
+		},
+		[]string{"device", "direction", "watermark"},
+	)
+	txSampleErrors = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "controller_access_txcontroller_sample_errors_total",
+			Help: "Total number of failed reads of device counters by the access txcontroller.",
+		},
 	)
 	// ErrNoDevice is returned when device is empty or not found in procfs.
 	ErrNoDevice = errors.New("no device found")
 
 	// ErrNilPaths is returned when a nil Paths value is given.
 	ErrNilPaths = errors.New("nil paths value given")
+
+	// ErrInvalidDevice is returned when a device specification cannot be parsed.
+	ErrInvalidDevice = errors.New("invalid device specification")
+
+	// ErrInvalidEarly is returned when the early rejection start or curve is
+	// out of range.
+	ErrInvalidEarly = errors.New("invalid early rejection configuration")
 )
 
-func init() {
-	flag.StringVar(&device, "txcontroller.device", "", "Calculate bytes transmitted from this device.")
-	flag.Uint64Var(&maxRate, "txcontroller.max-rate", 0, "The max rate (in bit/s) beyond which, the TxController will reject new clients")
+// Limits are the maximum transmit, receive and combined rates in bits per
+// second. A zero limit is not enforced.
+type Limits struct {
+	Tx    uint64 `json:"tx,omitempty"`
+	Rx    uint64 `json:"rx,omitempty"`
+	Total uint64 `json:"total,omitempty"`
 }
 
-// TxController calculates the bytes transmitted every period from the named device.
+// isZero reports whether no limits are enforced.
+func (l Limits) isZero() bool {
+	return l == Limits{}
+}
+
+// limitState tracks whether the transmit, receive and combined rates are
+// limited. A rate becomes limited above its high watermark (the limit) and
+// remains limited until it falls to its low watermark.
+type limitState struct {
+	tx, rx, total atomic.Bool
+}
+
+// watermark updates the limited state of one rate and returns the new state.
+// A zero low watermark, or one above high, is equal to high.
+func watermark(limited *atomic.Bool, rate, high, low uint64) bool {
+	if low == 0 || low > high {
+		low = high
+	}
+	l := high > 0 && rate > high
+	if limited.Load() {
+		l = high > 0 && rate > low
+	}
+	limited.Store(l)
+	return l
+}
+
+// exceeded updates the limited state of the named device (or all) for the
+// given rates, and returns the direction ("tx", "rx" or "total") of the first
+// limited rate, or the empty string if none are limited. When name is empty,
+// the limited state is not exported.
+func (s *limitState) exceeded(name string, high, low Limits, tx, rx uint64) string {
+	reason := ""
+	for _, r := range []struct {
+		direction string
+		limited   *atomic.Bool
+		rate      uint64
+		high, low uint64
+	}{
+		{"tx", &s.tx, tx, high.Tx, low.Tx},
+		{"rx", &s.rx, rx, high.Rx, low.Rx},
+		{"total", &s.total, tx + rx, high.Total, low.Total},
+	} {
+		l := watermark(r.limited, r.rate, r.high, r.low)
+		if l && reason == "" {
+			reason = r.direction
+		}
+		if r.high > 0 && name != "" {
+			txLimited.WithLabelValues(name, r.direction).Set(boolToFloat(l))
+		}
+	}
+	return reason
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// DeviceLimits applies Limits to every device with a name matching Pattern.
+// Patterns use the syntax of path.Match, e.g. "eth*".
+type DeviceLimits struct {
+	Pattern string
+	Limits
+}
+
+// String formats the device limits as accepted by ParseDeviceLimits.
+func (d DeviceLimits) String() string {
+	fields := []string{d.Pattern}
+	for _, v := range []uint64{d.Tx, d.Rx, d.Total} {
+		if v == 0 {
+			fields = append(fields, "")
+		} else {
+			fields = append(fields, strconv.FormatUint(v, 10))
+		}
+	}
+	// Omit trailing unset limits.
+	for fields[len(fields)-1] == "" {
+		fields = fields[:len(fields)-1]
+	}
+	return strings.Join(fields, ":")
+}
+
+// DeviceList is a list of device limits. DeviceList implements flag.Value
+// using the format of ParseDeviceLimits.
+type DeviceList []DeviceLimits
+
+// String formats the device list as accepted by ParseDeviceLimits.
+func (l DeviceList) String() string {
+	specs := make([]string, 0, len(l))
+	for _, d := range l {
+		specs = append(specs, d.String())
+	}
+	return strings.Join(specs, ",")
+}
+
+// Set replaces the device list with the devices parsed from s.
+func (l *DeviceList) Set(s string) error {
+	devs, err := ParseDeviceLimits(s)
+	if err != nil {
+		return err
+	}
+	*l = devs
+	return nil
+}
+
+// TxConfig configures a TxController.
+type TxConfig struct {
+	// Devices are the monitored devices, with optional per-device limits.
+	Devices DeviceList
+
+	// Limits apply to the sum of all devices.
+	Limits Limits
+
+	// Low are the low watermarks of Limits. Once the sum of all devices
+	// exceeds a limit, the TxController rejects new clients until the rate
+	// falls to its low watermark, which prevents flapping around the limit.
+	// A zero low watermark is equal to its limit.
+	Low Limits
+
+	// Estimator names the rate estimator. See ParseEstimator. When empty,
+	// rates are estimated with an asymmetric EWMA.
+	Estimator string
+
+	// NewEstimator creates rate estimators. When not nil, NewEstimator
+	// overrides Estimator.
+	NewEstimator func() Estimator
+
+	// EarlyStart is the fraction of every limit, between 0 and 1, above which
+	// the TxController rejects new clients with a probability that increases
+	// from zero to one as the rate approaches the limit. Rejecting some
+	// clients early prevents synchronized waves of retries when the limit is
+	// reached. When zero, clients are only rejected above the limit.
+	EarlyStart float64
+
+	// EarlyCurve is the exponent of the early rejection probability: one is
+	// linear, larger values reject fewer clients until the rate is close to
+	// the limit. When zero, the curve is linear.
+	EarlyCurve float64
+
+	// Rand is the source of randomness for early rejection. When nil, a
+	// randomly seeded source is used.
+	Rand *rand.Rand
+
+	// Classes are the priority classes of clients. Classes with Bypass are
+	// never limited, and the limits of other classes are scaled by their
+	// Multiplier. When nil, the DefaultClasses are used.
+	Classes Classes
+}
+
+// ValidateEarly returns ErrInvalidEarly if EarlyStart is not between 0 and 1,
+// or EarlyCurve is negative.
+func (c *TxConfig) ValidateEarly() error {
+	if c.EarlyStart < 0 || c.EarlyStart >= 1 || c.EarlyCurve < 0 {
+		return fmt.Errorf("%w: start %v, curve %v", ErrInvalidEarly, c.EarlyStart, c.EarlyCurve)
+	}
+	return nil
+}
+
+// RegisterFlags binds the configuration to the -txcontroller.* flags in fs,
+// using the current values as defaults. Binaries that configure a
+// TxController from the command line should call RegisterFlags before parsing
+// flags.
+func (c *TxConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.Var(&c.Devices, "txcontroller.device",
+		"Calculate bytes transmitted from these devices: a comma separated list of glob patterns, "+
+			"each optionally followed by per-device limits in bit/s, e.g. eth0:<max-rate>:<max-rx-rate>:<max-total-rate>")
+	fs.Uint64Var(&c.Limits.Tx, "txcontroller.max-rate", c.Limits.Tx, "The max rate (in bit/s) of all devices beyond which, the TxController will reject new clients")
+	fs.Uint64Var(&c.Limits.Rx, "txcontroller.max-rx-rate", c.Limits.Rx, "The max receive rate (in bit/s) of all devices beyond which, the TxController will reject new clients")
+	fs.Uint64Var(&c.Limits.Total, "txcontroller.max-total-rate", c.Limits.Total, "The max combined transmit and receive rate (in bit/s) of all devices beyond which, the TxController will reject new clients")
+	fs.Uint64Var(&c.Low.Tx, "txcontroller.low-rate", c.Low.Tx, "Once limited, the TxController accepts new clients when the rate (in bit/s) of all devices falls to this rate. Default is max-rate")
+	fs.Uint64Var(&c.Low.Rx, "txcontroller.low-rx-rate", c.Low.Rx, "Once limited, the TxController accepts new clients when the receive rate (in bit/s) of all devices falls to this rate. Default is max-rx-rate")
+	fs.Uint64Var(&c.Low.Total, "txcontroller.low-total-rate", c.Low.Total, "Once limited, the TxController accepts new clients when the combined rate (in bit/s) of all devices falls to this rate. Default is max-total-rate")
+	fs.StringVar(&c.Estimator, "txcontroller.estimator", c.Estimator, "Rate estimator: ewma, max:<samples> or percentile:<p>:<samples>")
+	fs.Float64Var(&c.EarlyStart, "txcontroller.early-start", c.EarlyStart, "Fraction of each limit, between 0 and 1, above which the TxController rejects new clients with increasing probability. Default is disabled")
+	fs.Float64Var(&c.EarlyCurve, "txcontroller.early-curve", c.EarlyCurve, "Exponent of the early rejection probability curve. Default is 1 (linear)")
+}
+
+// ParseDeviceLimits parses a comma separated list of device specifications of
+// the form "pattern[:tx[:rx[:total]]]", where the optional limits are in bits
+// per second, e.g. "eth0:1000000000,bond*".
+func ParseDeviceLimits(s string) ([]DeviceLimits, error) {
+	devs := []DeviceLimits{}
+	if s == "" {
+		return devs, nil
+	}
+	for _, spec := range strings.Split(s, ",") {
+		fields := strings.Split(spec, ":")
+		if fields[0] == "" || len(fields) > 4 {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidDevice, spec)
+		}
+		if _, err := path.Match(fields[0], ""); err != nil {
+			return nil, fmt.Errorf("%w: %q: %v", ErrInvalidDevice, spec, err)
+		}
+		limits := make([]uint64, 3)
+		for i, f := range fields[1:] {
+			if f == "" {
+				continue
+			}
+			v, err := strconv.ParseUint(f, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %q: %v", ErrInvalidDevice, spec, err)
+			}
+			limits[i] = v
+		}
+		devs = append(devs, DeviceLimits{
+			Pattern: fields[0],
+			Limits:  Limits{Tx: limits[0], Rx: limits[1], Total: limits[2]},
+		})
+	}
+	return devs, nil
+}
+
+// rates holds the current transmit and receive rate estimates.
+type rates struct {
+	tx uint64
+	rx uint64
+}
+
+func (r *rates) load() (uint64, uint64) {
+	return atomic.LoadUint64(&r.tx), atomic.LoadUint64(&r.rx)
+}
+
+func (r *rates) set(tx, rx uint64) {
+	atomic.StoreUint64(&r.tx, tx)
+	atomic.StoreUint64(&r.rx, rx)
+}
+
+// scaledState is the limited state of all devices and of each device for the
+// limits scaled by one class multiplier.
+type scaledState struct {
+	all     limitState
+	devices []limitState
+}
+
+// netDevice is a monitored device with its limits and current rates.
+type netDevice struct {
+	name   string
+	limits Limits
+	state  limitState
+	rates
+}
+
+// TxController calculates the bytes transmitted and received every period from
+// a set of devices. The transmit, receive and combined rates have independent
+// limits for each device and for the sum of all devices. A zero limit is not
+// enforced.
 type TxController struct {
-	period  time.Duration
-	device  string
-	current uint64
-	limit   uint64
+	period       time.Duration
+	devices      []*netDevice
+	limits       Limits
+	low          Limits
+	state        limitState
+	scaledMu     sync.Mutex
+	scaled       map[float64]*scaledState
+	newEstimator func() Estimator
+	rates
 	pfs     procfs.FS
+	history history
+
+	earlyStart float64
+	earlyCurve float64
+	randMu     sync.Mutex
+	rand       *rand.Rand
+	classes    Classes
 
 	// Enforced is a set of HTTP request resource paths on which the
 	// TokenController will enforce token authorization. Any resource missing
@@ -55,87 +356,297 @@ type TxController struct {
 	Enforced Paths
 }
 
-// NewTxController creates a new instance and runs TxController.Watch in a
-// goroutine to observe the current rate every 100 msec. When the given context
-// is canceled or expires, Watch will return and the TxController will no longer
-// be updated until Watch is started again.
-func NewTxController(ctx context.Context, enforced Paths) (*TxController, error) {
+// NewTxController creates a new instance for the configured devices and runs
+// TxController.Watch in a goroutine to observe the current rate every 100 msec.
+// When the given context is canceled or expires, Watch will return and the
+// TxController will no longer be updated until Watch is started again.
+//
+// Device patterns are matched once, when the TxController is created. Devices
+// that appear later are not monitored.
+func NewTxController(ctx context.Context, enforced Paths, cfg TxConfig) (*TxController, error) {
 	if enforced == nil {
 		return nil, ErrNilPaths
 	}
-	if device == "" {
+	if len(cfg.Devices) == 0 {
 		return nil, ErrNoDevice
 	}
+	if err := cfg.ValidateEarly(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Classes.Validate(); err != nil {
+		return nil, err
+	}
 	pfs, err := procfs.NewFS(procPath)
 	if err != nil {
 		return nil, err
 	}
-	// Read the device once to verify that the device exists.
-	_, err = readNetDevLine(pfs, device)
+	// Read the devices once to verify that every pattern matches a device.
+	devices, err := matchDevices(pfs, cfg.Devices)
 	if err != nil {
 		return nil, err
 	}
+	period := 100 * time.Millisecond
+	newEstimator := cfg.NewEstimator
+	if newEstimator == nil {
+		newEstimator, err = ParseEstimator(cfg.Estimator, period)
+		if err != nil {
+			return nil, err
+		}
+	}
 	tx := &TxController{
-		device:   device,
-		limit:    maxRate,
-		pfs:      pfs,
-		period:   100 * time.Millisecond,
-		Enforced: enforced,
+		devices:      devices,
+		limits:       cfg.Limits,
+		low:          cfg.Low,
+		newEstimator: newEstimator,
+		pfs:          pfs,
+		period:       period,
+		earlyStart:   cfg.EarlyStart,
+		earlyCurve:   cfg.EarlyCurve,
+		rand:         cfg.Rand,
+		classes:      cfg.Classes,
+		Enforced:     enforced,
+	}
+	if tx.earlyCurve == 0 {
+		tx.earlyCurve = 1
 	}
+	if tx.rand == nil {
+		tx.rand = rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+	}
+	tx.exportLimits()
 	// Run watch in a goroutine.
 	go tx.Watch(ctx)
 	return tx, nil
 }
 
+// matchDevices returns the devices matching each spec. A device matching more
+// than one spec uses the limits of the first. Every spec must match a device.
+func matchDevices(pfs procfs.FS, specs []DeviceLimits) ([]*netDevice, error) {
+	nd, err := pfs.NetDev()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(nd))
+	for name := range nd {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	seen := map[string]bool{}
+	devices := []*netDevice{}
+	for _, spec := range specs {
+		found := false
+		for _, name := range names {
+			if ok, _ := path.Match(spec.Pattern, name); !ok {
+				continue
+			}
+			found = true
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			devices = append(devices, &netDevice{name: name, limits: spec.Limits})
+		}
+		if !found {
+			return nil, fmt.Errorf("Given device not found: %q", spec.Pattern)
+		}
+	}
+	return devices, nil
+}
+
 // Accept wraps the call to listener's Accept. If the TxController is
 // limited, then Accept immediately closes the connection and returns an error.
 func (tx *TxController) Accept(l net.Listener) (net.Conn, error) {
-	conn, err := l.Accept()
 	if tx == nil {
 		// Simple pass-through.
-		return conn, err
+		return l.Accept()
 	}
-	if err != nil {
-		// No need to check isLimited, the accept failed.
-		return nil, err
+	return acceptWith(l, tx, "TxController")
+}
+
+// Name returns "tx". Name implements Admitter.
+func (tx *TxController) Name() string {
+	return "tx"
+}
+
+// Admit applies the TxController limits to a new connection. The priority
+// class is taken from the claims of connections accepted by a TokenListener.
+// Admit implements Admitter.
+func (tx *TxController) Admit(conn net.Conn) (net.Conn, string) {
+	if tx == nil {
+		return conn, ""
 	}
 	// NOTE: treat all raw accept requests as an "enforced path".
-	if tx.isLimited("raw", false, true) {
-		defer conn.Close()
-		return nil, fmt.Errorf("TxController rejected connection %s", conn.RemoteAddr())
-	}
-	// err was nil, so the conn is good.
-	return conn, nil
+	return conn, tx.limitReason("raw", tx.classes.Classify(ConnClaims(conn)), true)
 }
 
-// Current exports the current rate. Useful for diagnostics.
+// Current exports the current transmit rate of all devices. Useful for
+// diagnostics.
 func (tx *TxController) Current() uint64 {
-	return atomic.LoadUint64(&tx.current)
+	return atomic.LoadUint64(&tx.rates.tx)
 }
-func (tx *TxController) set(value uint64) {
-	atomic.StoreUint64(&tx.current, value)
+
+// CurrentRx exports the current receive rate of all devices. Useful for
+// diagnostics.
+func (tx *TxController) CurrentRx() uint64 {
+	return atomic.LoadUint64(&tx.rates.rx)
 }
 
-// isLimited checks the current tx rate and returns whether the connection
-// should be accepted or rejected. If monitoring is true, then even if the
-// current limit is exceeded, the request will be accepted.
-func (tx *TxController) isLimited(proto string, monitoring, enforcedPath bool) bool {
-	cur := tx.Current()
-	if tx.limit > 0 && cur > tx.limit && !monitoring && enforcedPath {
-		txAccessRequests.WithLabelValues("rejected", proto).Inc()
-		return true
+// CurrentTotal exports the current combined transmit and receive rate of all
+// devices.
+func (tx *TxController) CurrentTotal() uint64 {
+	return tx.Current() + tx.CurrentRx()
+}
+
+// exceeded updates the limited state for the current rates and returns the
+// first limited rate, or the empty string if none are limited. Limits of
+// individual devices are prefixed with "device-".
+func (tx *TxController) exceeded() string {
+	tr, rr := tx.load()
+	reason := tx.state.exceeded("all", tx.limits, tx.low, tr, rr)
+	for _, d := range tx.devices {
+		tr, rr := d.load()
+		// Per-device limits have no low watermarks.
+		if r := d.state.exceeded(d.name, d.limits, Limits{}, tr, rr); r != "" && reason == "" {
+			reason = "device-" + r
+		}
 	}
-	txAccessRequests.WithLabelValues("accepted", proto).Inc()
-	return false
+	return reason
+}
+
+// scaledExceeded is like exceeded for the limits and low watermarks scaled by
+// m. Each multiplier keeps its own limited state, which is not exported.
+func (tx *TxController) scaledExceeded(m float64) string {
+	s := tx.scaledState(m)
+	tr, rr := tx.load()
+	reason := s.all.exceeded("", tx.limits.scale(m), tx.low.scale(m), tr, rr)
+	for i, d := range tx.devices {
+		tr, rr := d.load()
+		// Per-device limits have no low watermarks.
+		if r := s.devices[i].exceeded("", d.limits.scale(m), Limits{}, tr, rr); r != "" && reason == "" {
+			reason = "device-" + r
+		}
+	}
+	return reason
+}
+
+// scaledState returns the limited state for multiplier m, creating it on
+// first use.
+func (tx *TxController) scaledState(m float64) *scaledState {
+	tx.scaledMu.Lock()
+	defer tx.scaledMu.Unlock()
+	if tx.scaled == nil {
+		tx.scaled = map[float64]*scaledState{}
+	}
+	s, ok := tx.scaled[m]
+	if !ok {
+		s = &scaledState{devices: make([]limitState, len(tx.devices))}
+		tx.scaled[m] = s
+	}
+	return s
+}
+
+// early randomly rejects new clients when any rate is between the early start
+// and its limit scaled by m. It returns the reason for the rejection, prefixed
+// with "early-", or the empty string if the client is accepted.
+func (tx *TxController) early(m float64) string {
+	if tx.earlyStart == 0 {
+		return ""
+	}
+	p, reason := 0.0, ""
+	check := func(prefix string, l Limits, tr, rr uint64) {
+		for _, r := range []struct {
+			direction   string
+			rate, limit uint64
+		}{{"tx", tr, l.Tx}, {"rx", rr, l.Rx}, {"total", tr + rr, l.Total}} {
+			if q := earlyProbability(r.rate, r.limit, tx.earlyStart, tx.earlyCurve); q > p {
+				p, reason = q, "early-"+prefix+r.direction
+			}
+		}
+	}
+	tr, rr := tx.load()
+	check("", tx.limits.scale(m), tr, rr)
+	for _, d := range tx.devices {
+		tr, rr := d.load()
+		check("device-", d.limits.scale(m), tr, rr)
+	}
+	if p == 0 {
+		return ""
+	}
+	tx.randMu.Lock()
+	defer tx.randMu.Unlock()
+	if tx.rand.Float64() < p {
+		return reason
+	}
+	return ""
+}
+
+// earlyProbability returns the probability of rejecting a new client at the
+// given rate. The probability is zero up to start*limit and increases to one
+// at the limit, following the curve exponent. A zero limit is not enforced.
+func earlyProbability(rate, limit uint64, start, curve float64) float64 {
+	if limit == 0 {
+		return 0
+	}
+	lo := start * float64(limit)
+	if float64(rate) <= lo {
+		return 0
+	}
+	if rate >= limit {
+		return 1
+	}
+	return math.Pow((float64(rate)-lo)/(float64(limit)-lo), curve)
+}
+
+// isLimited checks the current rates and returns whether the connection
+// should be accepted or rejected. If the class has Bypass, e.g. monitoring,
+// then even if the current limit is exceeded, the request will be accepted.
+// Otherwise, the limits are scaled by the class multiplier.
+func (tx *TxController) isLimited(proto string, class *Class, enforcedPath bool) bool {
+	return tx.limitReason(proto, class, enforcedPath) != ""
+}
+
+// limitReason is like isLimited, but returns the reason the connection is
+// rejected, or the empty string when it is accepted.
+func (tx *TxController) limitReason(proto string, class *Class, enforcedPath bool) string {
+	if !class.Bypass && enforcedPath {
+		m := class.multiplier()
+		var reason string
+		if m == 1 {
+			reason = tx.exceeded()
+		} else {
+			reason = tx.scaledExceeded(m)
+		}
+		if reason == "" {
+			reason = tx.early(m)
+		}
+		if reason != "" {
+			txAccessRequests.WithLabelValues("rejected", proto, reason).Inc()
+			return reason
+		}
+	}
+	txAccessRequests.WithLabelValues("accepted", proto, "").Inc()
+	return ""
+}
+
+// decide is like limitReason, and records the decision in a span that is a
+// child of any span in ctx.
+func (tx *TxController) decide(ctx context.Context, proto string, class *Class, enforcedPath bool) string {
+	_, span := startSpan(ctx, "access.tx.limit",
+		attribute.String("access.protocol", proto),
+		attribute.String("access.class", class.Name),
+		attribute.Bool("access.enforced", enforcedPath),
+	)
+	reason := tx.limitReason(proto, class, enforcedPath)
+	endSpan(span, reason)
+	return reason
 }
 
 // Limit enforces that the TxController rate limit is respected before running
 // the next handler. If the rate is unspecified (zero), all requests are accepted.
 func (tx *TxController) Limit(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Discover whether the access token was issued for monitoring.
-		monitoring := IsMonitoring(GetClaim(r.Context()))
-		if tx.isLimited("http", monitoring, tx.Enforced[r.URL.Path]) {
+		// Discover the priority class of the access token claims.
+		class := tx.classes.Classify(GetClaim(r.Context()))
+		if tx.decide(r.Context(), "http", class, tx.Enforced[r.URL.Path]) != "" {
 			// 503 - https://tools.ietf.org/html/rfc7231#section-6.6.4
 			w.WriteHeader(http.StatusServiceUnavailable)
 			// Return without additional response.
@@ -145,64 +656,137 @@ func (tx *TxController) Limit(next http.Handler) http.Handler {
 	})
 }
 
-// Watch updates the current rate every period. If the context is cancelled, the
-// context error is returned. If the TxController rate is zero, Watch returns
-// immediately. Callers should typically run Watch in a goroutine.
+// exportLimits sets the limit gauges for the configured, non-zero limits.
+func (tx *TxController) exportLimits() {
+	set := func(name string, l Limits, watermark string) {
+		for _, v := range []struct {
+			direction string
+			limit     uint64
+		}{{"tx", l.Tx}, {"rx", l.Rx}, {"total", l.Total}} {
+			if v.limit > 0 {
+				txLimit.WithLabelValues(name, v.direction, watermark).Set(float64(v.limit))
+			}
+		}
+	}
+	set("all", tx.limits, "high")
+	set("all", tx.low, "low")
+	for _, d := range tx.devices {
+		set(d.name, d.limits, "high")
+	}
+}
+
+// enforced reports whether any TxController or device limit is non-zero.
+func (tx *TxController) enforced() bool {
+	if !tx.limits.isZero() {
+		return true
+	}
+	for _, d := range tx.devices {
+		if !d.limits.isZero() {
+			return true
+		}
+	}
+	return false
+}
+
+// estimate is the rate estimate of one device, or of the sum of all devices.
+type estimate struct {
+	name    string
+	r       *rates
+	tx, rx  Estimator
+	prevTx  uint64
+	prevRx  uint64
+	txBytes uint64
+	rxBytes uint64
+}
+
+// update sets the new rate estimates using the bytes counted since the
+// previous update over the given interval (in seconds).
+func (e *estimate) update(interval float64) {
+	tr := e.tx.Update(float64(8*(e.txBytes-e.prevTx)) / interval)
+	rr := e.rx.Update(float64(8*(e.rxBytes-e.prevRx)) / interval)
+	e.r.set(uint64(tr), uint64(rr))
+	txRate.WithLabelValues(e.name, "tx").Set(tr)
+	txRate.WithLabelValues(e.name, "rx").Set(rr)
+	txRate.WithLabelValues(e.name, "total").Set(tr + rr)
+	// Save the total bytes sent and received from this round for the next.
+	e.prevTx, e.prevRx = e.txBytes, e.rxBytes
+}
+
+// read counts the bytes of every device from a single read of /proc/net/dev.
+func (tx *TxController) read(ests []*estimate) error {
+	nd, err := tx.pfs.NetDev()
+	if err != nil {
+		return err
+	}
+	total := ests[len(ests)-1]
+	total.txBytes, total.rxBytes = 0, 0
+	for i, d := range tx.devices {
+		v, ok := nd[d.name]
+		if !ok {
+			return fmt.Errorf("Given device not found: %q", d.name)
+		}
+		ests[i].txBytes, ests[i].rxBytes = v.TxBytes, v.RxBytes
+		total.txBytes += v.TxBytes
+		total.rxBytes += v.RxBytes
+	}
+	return nil
+}
+
+// Watch updates the current rates every period. If the context is cancelled, the
+// context error is returned. If all TxController and device limits are zero,
+// Watch returns immediately. Callers should typically run Watch in a goroutine.
 func (tx *TxController) Watch(ctx context.Context) error {
-	if tx.limit == 0 {
+	if !tx.enforced() {
 		// No need to do anything.
 		return nil
 	}
 	t := time.NewTicker(tx.period)
 	defer t.Stop()
 
-	// Read current vaule of TxBytes for device to initialize the following loop.
-	v, err := readNetDevLine(tx.pfs, tx.device)
-	if err != nil {
+	// One estimate per device, followed by the estimate for all devices.
+	ests := make([]*estimate, 0, len(tx.devices)+1)
+	for _, d := range tx.devices {
+		ests = append(ests, &estimate{name: d.name, r: &d.rates, tx: tx.newEstimator(), rx: tx.newEstimator()})
+	}
+	ests = append(ests, &estimate{name: "all", r: &tx.rates, tx: tx.newEstimator(), rx: tx.newEstimator()})
+
+	// Read current values of TxBytes and RxBytes for devices to initialize the following loop.
+	if err := tx.read(ests); err != nil {
 		return err
 	}
+	for _, e := range ests {
+		e.prevTx, e.prevRx = e.txBytes, e.rxBytes
+	}
 
 	// Setup.
-	ratePrev := 0.0
-	prevTxBytes := v.TxBytes
 	tickNow := <-t.C                    // Read first time from ticker.
 	tickPrev := tickNow.Add(-tx.period) // Initialize difference to expected sample period.
-	alpha := tx.period.Seconds() / 2    // Alpha controls the decay rate based on configured period.
 
-	// Check the device every period until the context returns an error.
+	// Check the devices every period until the context returns an error.
 	for ; ctx.Err() == nil; tickNow = <-t.C {
-		cur, err := readNetDevLine(tx.pfs, tx.device)
-		if err != nil {
+		if err := tx.read(ests); err != nil {
 			log.Println("Error reading /proc/net/dev:", err)
+			txSampleErrors.Inc()
 			continue
 		}
 
 		// Under heavy load, tickers may fire slow (and then early). Only update
 		// values when interval is long enough, i.e. more than half the tx.period.
 		if tickNow.Sub(tickPrev).Seconds() > tx.period.Seconds()/2 {
-			// Calculate the new rate in bits-per-second, using the actual interval.
-			rateNow := float64(8*(cur.TxBytes-prevTxBytes)) / tickNow.Sub(tickPrev).Seconds()
-			// A few seconds for decreases and rapid response for increases.
-			ratePrev = math.Max(rateNow, (1-alpha)*ratePrev+alpha*rateNow)
-			tx.set(uint64(ratePrev))
-
-			// Save the total bytes sent from this round for the next.
-			prevTxBytes = cur.TxBytes
+			// Calculate the new rates in bits-per-second, using the actual interval.
+			interval := tickNow.Sub(tickPrev).Seconds()
+			for _, e := range ests {
+				e.update(interval)
+			}
+			// Update the limited state, even without new requests.
+			tx.history.add(tx.sample(tickNow, tx.exceeded()))
+			for i := range tx.classes {
+				if c := &tx.classes[i]; !c.Bypass && c.multiplier() != 1 {
+					tx.scaledExceeded(c.multiplier())
+				}
+			}
 			tickPrev = tickNow
 		}
 	}
 	return ctx.Err()
 }
-
-func readNetDevLine(pfs procfs.FS, device string) (procfs.NetDevLine, error) {
-	nd, err := pfs.NetDev()
-	if err != nil {
-		return procfs.NetDevLine{}, err
-	}
-	// Check at creation time whether device exists.
-	v, ok := nd[device]
-	if !ok {
-		return procfs.NetDevLine{}, fmt.Errorf("Given device not found: %q", device)
-	}
-	return v, nil
-}
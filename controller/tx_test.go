@@ -3,6 +3,9 @@ package controller
 import (
 	"context"
 	"errors"
+	"flag"
+	"math"
+	"math/rand/v2"
 	"net"
 	"net/http"
 	"net/http/httptest"
@@ -10,6 +13,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/go-jose/go-jose/v4/jwt"
 	"github.com/m-lab/go/rtx"
 
 	"github.com/prometheus/procfs"
@@ -17,12 +21,16 @@ import (
 
 func TestTxController_Limit(t *testing.T) {
 	tests := []struct {
-		name     string
-		limit    uint64
-		current  uint64
-		procPath string
-		visited  bool
-		wantErr  bool
+		name       string
+		limit      uint64
+		rxLimit    uint64
+		totalLimit uint64
+		current    uint64
+		currentRx  uint64
+		device     *netDevice
+		procPath   string
+		visited    bool
+		wantErr    bool
 	}{
 		{
 			name:     "success",
@@ -36,24 +44,62 @@ func TestTxController_Limit(t *testing.T) {
 			procPath: "testdata/proc-success",
 			visited:  false,
 		},
+		{
+			name:      "reject-rx",
+			rxLimit:   1,
+			currentRx: 2,
+			procPath:  "testdata/proc-success",
+			visited:   false,
+		},
+		{
+			name:       "reject-total",
+			limit:      3,
+			rxLimit:    3,
+			totalLimit: 4,
+			current:    2,
+			currentRx:  3,
+			procPath:   "testdata/proc-success",
+			visited:    false,
+		},
+		{
+			name: "reject-device",
+			device: &netDevice{
+				name:   "eth1",
+				limits: Limits{Rx: 1},
+				rates:  rates{rx: 2},
+			},
+			procPath: "testdata/proc-success",
+			visited:  false,
+		},
+		{
+			name:       "success-below-all-limits",
+			limit:      3,
+			rxLimit:    3,
+			totalLimit: 6,
+			current:    2,
+			currentRx:  3,
+			procPath:   "testdata/proc-success",
+			visited:    true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			procPath = tt.procPath
-			device = "eth0"
-			maxRate = tt.limit
 
 			pfs, err := procfs.NewFS(procPath)
 			rtx.Must(err, "Failed to allocate procfs")
 
 			tx := &TxController{
-				device:   device,
-				limit:    tt.limit,
+				devices:  []*netDevice{{name: "eth0"}},
+				limits:   Limits{Tx: tt.limit, Rx: tt.rxLimit, Total: tt.totalLimit},
+				rates:    rates{tx: tt.current, rx: tt.currentRx},
 				pfs:      pfs,
 				period:   time.Millisecond,
-				current:  tt.current,
 				Enforced: Paths{"/": true},
 			}
+			if tt.device != nil {
+				tx.devices = append(tx.devices, tt.device)
+			}
 
 			visited := false
 			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
@@ -118,11 +164,13 @@ func TestNewTxController(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			device = tt.device
 			procPath = tt.procPath
-			maxRate = tt.limit
+			cfg := TxConfig{Limits: Limits{Tx: tt.limit}}
+			if tt.device != "" {
+				cfg.Devices = DeviceList{{Pattern: tt.device}}
+			}
 			ctx := context.Background()
-			got, err := NewTxController(ctx, tt.enforced)
+			got, err := NewTxController(ctx, tt.enforced, cfg)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("NewTxController() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -134,10 +182,387 @@ func TestNewTxController(t *testing.T) {
 	}
 }
 
+func TestTxConfig_RegisterFlags(t *testing.T) {
+	cfg := TxConfig{}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.RegisterFlags(fs)
+	err := fs.Parse([]string{"-txcontroller.device=eth0:100,bond*::20", "-txcontroller.max-rx-rate=30",
+		"-txcontroller.low-rx-rate=10", "-txcontroller.estimator=max:5",
+		"-txcontroller.early-start=0.8", "-txcontroller.early-curve=2"})
+	if err != nil {
+		t.Fatalf("TxConfig.RegisterFlags() failed to parse flags: %v", err)
+	}
+	want := TxConfig{
+		Devices: DeviceList{
+			{Pattern: "eth0", Limits: Limits{Tx: 100}},
+			{Pattern: "bond*", Limits: Limits{Rx: 20}},
+		},
+		Limits:     Limits{Rx: 30},
+		Low:        Limits{Rx: 10},
+		Estimator:  "max:5",
+		EarlyStart: 0.8,
+		EarlyCurve: 2,
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("TxConfig.RegisterFlags() = %#v, want %#v", cfg, want)
+	}
+	if got := cfg.Devices.String(); got != "eth0:100,bond*::20" {
+		t.Errorf("DeviceList.String() = %q, want %q", got, "eth0:100,bond*::20")
+	}
+	if err := fs.Set("txcontroller.device", "eth0:fast"); err == nil {
+		t.Errorf("DeviceList.Set() expected error for invalid device")
+	}
+}
+
+func TestTxController_hysteresis(t *testing.T) {
+	tx := &TxController{
+		devices: []*netDevice{{name: "eth0", limits: Limits{Rx: 1000}}},
+		limits:  Limits{Tx: 100},
+		low:     Limits{Tx: 50},
+	}
+	steps := []struct {
+		rate uint64
+		want string
+	}{
+		{rate: 80, want: ""},
+		{rate: 120, want: "tx"},
+		{rate: 80, want: "tx"}, // Remains limited above the low watermark.
+		{rate: 50, want: ""},
+		{rate: 80, want: ""}, // Remains unlimited below the high watermark.
+	}
+	for i, s := range steps {
+		tx.set(s.rate, 0)
+		if got := tx.exceeded(); got != s.want {
+			t.Errorf("TxController.exceeded() step %d rate %d = %q, want %q", i, s.rate, got, s.want)
+		}
+	}
+	// Device limits have no low watermark.
+	tx.devices[0].set(0, 1001)
+	if got := tx.exceeded(); got != "device-rx" {
+		t.Errorf("TxController.exceeded() = %q, want %q", got, "device-rx")
+	}
+	tx.devices[0].set(0, 1000)
+	if got := tx.exceeded(); got != "" {
+		t.Errorf("TxController.exceeded() = %q, want no limit", got)
+	}
+}
+
+func TestTxController_scaledHysteresis(t *testing.T) {
+	tx := &TxController{
+		devices: []*netDevice{{name: "eth0", limits: Limits{Rx: 1000}}},
+		limits:  Limits{Tx: 100},
+		low:     Limits{Tx: 50},
+	}
+	// The limits and low watermarks are halved.
+	steps := []struct {
+		rate uint64
+		want string
+	}{
+		{rate: 40, want: ""},
+		{rate: 60, want: "tx"},
+		{rate: 40, want: "tx"}, // Remains limited above the scaled low watermark.
+		{rate: 25, want: ""},
+		{rate: 40, want: ""}, // Remains unlimited below the scaled high watermark.
+	}
+	for i, s := range steps {
+		tx.set(s.rate, 0)
+		if got := tx.scaledExceeded(0.5); got != s.want {
+			t.Errorf("TxController.scaledExceeded() step %d rate %d = %q, want %q", i, s.rate, got, s.want)
+		}
+	}
+	// Each multiplier has its own state.
+	tx.set(60, 0)
+	tx.scaledExceeded(0.5)
+	tx.set(40, 0)
+	if got := tx.scaledExceeded(0.8); got != "" {
+		t.Errorf("TxController.scaledExceeded() = %q, want no limit", got)
+	}
+	if got := tx.scaledExceeded(0.5); got != "tx" {
+		t.Errorf("TxController.scaledExceeded() = %q, want %q", got, "tx")
+	}
+	tx.set(0, 0)
+	tx.scaledExceeded(0.5)
+	// Scaled device limits have no low watermark.
+	tx.devices[0].set(0, 501)
+	if got := tx.scaledExceeded(0.5); got != "device-rx" {
+		t.Errorf("TxController.scaledExceeded() = %q, want %q", got, "device-rx")
+	}
+	tx.devices[0].set(0, 500)
+	if got := tx.scaledExceeded(0.5); got != "" {
+		t.Errorf("TxController.scaledExceeded() = %q, want no limit", got)
+	}
+}
+
+func TestParseDeviceLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    []DeviceLimits
+		wantErr bool
+	}{
+		{
+			name: "success-empty",
+			want: []DeviceLimits{},
+		},
+		{
+			name: "success-device",
+			s:    "eth0",
+			want: []DeviceLimits{{Pattern: "eth0"}},
+		},
+		{
+			name: "success-devices-with-limits",
+			s:    "eth0:100,bond*:1:2:3,eth1::20",
+			want: []DeviceLimits{
+				{Pattern: "eth0", Limits: Limits{Tx: 100}},
+				{Pattern: "bond*", Limits: Limits{Tx: 1, Rx: 2, Total: 3}},
+				{Pattern: "eth1", Limits: Limits{Rx: 20}},
+			},
+		},
+		{
+			name:    "error-empty-pattern",
+			s:       "eth0,:100",
+			wantErr: true,
+		},
+		{
+			name:    "error-bad-pattern",
+			s:       "eth[",
+			wantErr: true,
+		},
+		{
+			name:    "error-bad-limit",
+			s:       "eth0:fast",
+			wantErr: true,
+		},
+		{
+			name:    "error-too-many-limits",
+			s:       "eth0:1:2:3:4",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseDeviceLimits(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseDeviceLimits() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !errors.Is(err, ErrInvalidDevice) {
+				t.Errorf("ParseDeviceLimits() wrong error; got %v, want %v", err, ErrInvalidDevice)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseDeviceLimits() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_matchDevices(t *testing.T) {
+	tests := []struct {
+		name    string
+		specs   []DeviceLimits
+		want    []*netDevice
+		wantErr bool
+	}{
+		{
+			name: "success-glob",
+			specs: []DeviceLimits{
+				{Pattern: "eth1", Limits: Limits{Tx: 1}},
+				{Pattern: "eth*", Limits: Limits{Tx: 2}},
+			},
+			want: []*netDevice{
+				{name: "eth1", limits: Limits{Tx: 1}},
+				{name: "eth0", limits: Limits{Tx: 2}},
+			},
+		},
+		{
+			name:    "error-no-match",
+			specs:   []DeviceLimits{{Pattern: "eth0"}, {Pattern: "wlan*"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pfs, err := procfs.NewFS("testdata/proc-multi")
+			rtx.Must(err, "Failed to allocate procfs")
+			got, err := matchDevices(pfs, tt.specs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("matchDevices() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("matchDevices() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewTxController_devices(t *testing.T) {
+	procPath = "testdata/proc-multi"
+	cfg := TxConfig{Limits: Limits{Tx: 1}}
+	rtx.Must(cfg.Devices.Set("bond0:1,eth*"), "Failed to parse devices")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tx, err := NewTxController(ctx, Paths{}, cfg)
+	if err != nil {
+		t.Fatalf("NewTxController() failed: %v", err)
+	}
+	names := []string{}
+	for _, d := range tx.devices {
+		names = append(names, d.name)
+	}
+	if !reflect.DeepEqual(names, []string{"bond0", "eth0", "eth1"}) {
+		t.Errorf("NewTxController() wrong devices; got %v", names)
+	}
+	if tx.limits.Tx != 1 || tx.devices[0].limits.Tx != 1 || !tx.devices[1].limits.isZero() {
+		t.Errorf("NewTxController() wrong limits; got %v %v", tx.limits, tx.devices[0].limits)
+	}
+
+	cfg.Estimator = "median"
+	if _, err := NewTxController(ctx, Paths{}, cfg); !errors.Is(err, ErrInvalidEstimator) {
+		t.Errorf("NewTxController() wrong error for invalid estimator; got %v", err)
+	}
+	cfg.Estimator = ""
+	cfg.EarlyStart = 1
+	if _, err := NewTxController(ctx, Paths{}, cfg); !errors.Is(err, ErrInvalidEarly) {
+		t.Errorf("NewTxController() wrong error for invalid early start; got %v", err)
+	}
+}
+
+func Test_earlyProbability(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  uint64
+		limit uint64
+		start float64
+		curve float64
+		want  float64
+	}{
+		{name: "no-limit", rate: 100, limit: 0, start: 0.5, curve: 1, want: 0},
+		{name: "below-start", rate: 40, limit: 100, start: 0.5, curve: 1, want: 0},
+		{name: "linear", rate: 75, limit: 100, start: 0.5, curve: 1, want: 0.5},
+		{name: "quadratic", rate: 75, limit: 100, start: 0.5, curve: 2, want: 0.25},
+		{name: "at-limit", rate: 100, limit: 100, start: 0.5, curve: 2, want: 1},
+		{name: "above-limit", rate: 200, limit: 100, start: 0.5, curve: 1, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := earlyProbability(tt.rate, tt.limit, tt.start, tt.curve)
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("earlyProbability() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTxController_early(t *testing.T) {
+	newTx := func(seed uint64) *TxController {
+		tx := &TxController{
+			devices:    []*netDevice{{name: "eth0", limits: Limits{Rx: 100}}},
+			limits:     Limits{Tx: 100},
+			earlyStart: 0.5,
+			earlyCurve: 1,
+			rand:       rand.New(rand.NewPCG(seed, seed)),
+			Enforced:   Paths{"/": true},
+		}
+		tx.rates.set(75, 0)
+		tx.devices[0].rates.set(75, 60)
+		return tx
+	}
+	// With the same seed, decisions are identical.
+	a, b := newTx(1), newTx(1)
+	rejected := 0
+	for i := 0; i < 1000; i++ {
+		ra, rb := a.early(1), b.early(1)
+		if ra != rb {
+			t.Fatalf("early() not deterministic at %d; got %q and %q", i, ra, rb)
+		}
+		switch ra {
+		case "early-tx":
+			rejected++
+		case "":
+		default:
+			t.Fatalf("early() wrong reason; got %q", ra)
+		}
+	}
+	// The tx rate is halfway between start and the limit.
+	if rejected < 400 || rejected > 600 {
+		t.Errorf("early() rejected %d of 1000, want about 500", rejected)
+	}
+
+	// Early rejection is reported by isLimited.
+	a.rates.set(99, 0)
+	limited := 0
+	for i := 0; i < 100; i++ {
+		if a.isLimited("http", defaultClass, true) {
+			limited++
+		}
+	}
+	if limited == 0 {
+		t.Errorf("isLimited() did not reject near the limit")
+	}
+	if a.isLimited("http", Classes(nil).Classify(&jwt.Claims{Subject: monitorSubject}), true) {
+		t.Errorf("isLimited() rejected monitoring request")
+	}
+
+	// Disabled early rejection accepts below the limit.
+	a.earlyStart = 0
+	if got := a.early(1); got != "" {
+		t.Errorf("early() disabled, got %q", got)
+	}
+}
+
+func TestTxController_classes(t *testing.T) {
+	classes := Classes{
+		{Name: "monitoring", Subjects: []string{monitorSubject}, Bypass: true},
+		{Name: "partner", Issuers: []string{"partner"}, Multiplier: 1.2},
+		{Name: "batch", Subjects: []string{"batch"}, Multiplier: 0.5},
+	}
+	tests := []struct {
+		name     string
+		tx, rx   uint64
+		devRx    uint64
+		claim    *jwt.Claims
+		wantFail bool
+	}{
+		{name: "default-below-limit", tx: 90},
+		{name: "default-above-limit", tx: 110, wantFail: true},
+		{name: "monitoring-above-limit", tx: 500, claim: &jwt.Claims{Subject: monitorSubject}},
+		{name: "partner-above-limit", tx: 110, claim: &jwt.Claims{Issuer: "partner", Subject: "ndt"}},
+		{name: "partner-above-scaled-limit", tx: 130, claim: &jwt.Claims{Issuer: "partner"}, wantFail: true},
+		{name: "partner-above-scaled-device-limit", tx: 10, devRx: 130, claim: &jwt.Claims{Issuer: "partner"}, wantFail: true},
+		{name: "batch-below-limit", tx: 60, claim: &jwt.Claims{Subject: "batch"}, wantFail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := &TxController{
+				devices:  []*netDevice{{name: "eth0", limits: Limits{Rx: 100}}},
+				limits:   Limits{Tx: 100},
+				classes:  classes,
+				Enforced: Paths{"/": true},
+			}
+			tx.rates.set(tt.tx, tt.rx)
+			tx.devices[0].rates.set(tt.tx, tt.devRx)
+
+			visited := false
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				visited = true
+			})
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req = req.Clone(SetClaim(req.Context(), tt.claim))
+			tx.Limit(next).ServeHTTP(httptest.NewRecorder(), req)
+
+			if visited == tt.wantFail {
+				t.Errorf("TxController.Limit() visited = %t, want %t", visited, !tt.wantFail)
+			}
+		})
+	}
+}
+
 func TestTxController_Watch(t *testing.T) {
 	tests := []struct {
 		name         string
 		limit        uint64
+		rxLimit      uint64
+		deviceLimits Limits
 		want         *TxController
 		procPath     string
 		badProc      string
@@ -154,6 +579,18 @@ func TestTxController_Watch(t *testing.T) {
 			limit:        1,
 			wantWatchErr: true,
 		},
+		{
+			name:         "success-rx-rate",
+			procPath:     "testdata/proc-success",
+			rxLimit:      1,
+			wantWatchErr: true,
+		},
+		{
+			name:         "success-device-rate",
+			procPath:     "testdata/proc-success",
+			deviceLimits: Limits{Total: 1},
+			wantWatchErr: true,
+		},
 		{
 			name:         "success-error-reading-proc",
 			procPath:     "testdata/proc-success",
@@ -164,9 +601,7 @@ func TestTxController_Watch(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			device = "eth0"
 			procPath = tt.procPath
-			maxRate = tt.limit
 
 			pfs, err := procfs.NewFS(procPath)
 			rtx.Must(err, "Failed to allocate procfs")
@@ -174,10 +609,12 @@ func TestTxController_Watch(t *testing.T) {
 			// NewTxController starts Watch in a goroutine. But, we want to call
 			// tx.Watch explicitly below, so create a literal tx controller.
 			tx := &TxController{
-				device: device,
-				limit:  maxRate,
-				pfs:    pfs,
-				period: time.Millisecond,
+				devices: []*netDevice{{name: "eth0", limits: tt.deviceLimits}},
+				limits:  Limits{Tx: tt.limit, Rx: tt.rxLimit},
+				pfs:     pfs,
+				period:  time.Millisecond,
+				// Alpha is half the period in seconds, like ParseEstimator.
+				newEstimator: func() Estimator { return NewEWMA(0.0005) },
 			}
 
 			if tt.badProc != "" {
@@ -193,6 +630,9 @@ func TestTxController_Watch(t *testing.T) {
 				t.Errorf("Watch() error = %v, wantErr %v", err, tt.wantWatchErr)
 				return
 			}
+			if got := len(tx.History()) > 0; got != (tt.wantWatchErr && tt.badProc == "") {
+				t.Errorf("Watch() recorded history = %t", got)
+			}
 		})
 	}
 }
@@ -236,8 +676,7 @@ func TestTxController_Accept(t *testing.T) {
 			name: "success-accepted",
 			l:    &fakeListener{},
 			tx: &TxController{
-				current: 0,
-				limit:   1,
+				limits: Limits{Tx: 1},
 			},
 			wantClosed: 0,
 		},
@@ -245,8 +684,8 @@ func TestTxController_Accept(t *testing.T) {
 			name: "success-rejected",
 			l:    &fakeListener{conn: fakeConn{}},
 			tx: &TxController{
-				current: 2,
-				limit:   1,
+				limits: Limits{Tx: 1},
+				rates:  rates{tx: 2},
 			},
 			wantClosed: 1,
 			wantErr:    true,
@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// historySize is the number of samples kept by the TxController, one minute
+// at the default period.
+const historySize = 600
+
+// Rate is the estimated transmit and receive rate in bits per second.
+type Rate struct {
+	Tx uint64 `json:"tx"`
+	Rx uint64 `json:"rx"`
+}
+
+// Sample is the state of the TxController after one update.
+type Sample struct {
+	Time time.Time `json:"time"`
+	// Rates of each device and of all devices, by name ("all").
+	Rates map[string]Rate `json:"rates"`
+	// Limited is the first limited rate, as reported in the rejected request
+	// metrics, or empty when not limited.
+	Limited string `json:"limited,omitempty"`
+}
+
+// history is a ring buffer of the most recent samples.
+type history struct {
+	mu      sync.Mutex
+	samples []Sample
+	next    int
+}
+
+func (h *history) add(s Sample) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.samples) < historySize {
+		h.samples = append(h.samples, s)
+		return
+	}
+	h.samples[h.next] = s
+	h.next = (h.next + 1) % historySize
+}
+
+// list returns the samples, oldest first.
+func (h *history) list() []Sample {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := make([]Sample, 0, len(h.samples))
+	s = append(s, h.samples[h.next:]...)
+	return append(s, h.samples[:h.next]...)
+}
+
+// sample returns the current rates of every device and all devices.
+func (tx *TxController) sample(t time.Time, limited string) Sample {
+	s := Sample{Time: t, Rates: map[string]Rate{}, Limited: limited}
+	for _, d := range tx.devices {
+		tr, rr := d.load()
+		s.Rates[d.name] = Rate{Tx: tr, Rx: rr}
+	}
+	tr, rr := tx.load()
+	s.Rates["all"] = Rate{Tx: tr, Rx: rr}
+	return s
+}
+
+// History returns the recent samples recorded by Watch, oldest first.
+func (tx *TxController) History() []Sample {
+	return tx.history.list()
+}
+
+// DeviceState is the configuration of one monitored device.
+type DeviceState struct {
+	Name   string `json:"name"`
+	Limits Limits `json:"limits"`
+}
+
+// State is the configuration and recent history of a TxController.
+type State struct {
+	Period  string        `json:"period"`
+	Limits  Limits        `json:"limits"`
+	Low     Limits        `json:"low"`
+	Devices []DeviceState `json:"devices"`
+	History []Sample      `json:"history"`
+}
+
+// ServeHTTP returns the TxController State as JSON, for troubleshooting. It is
+// meant for a debug or metrics server, not for clients.
+func (tx *TxController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s := State{
+		Period:  tx.period.String(),
+		Limits:  tx.limits,
+		Low:     tx.low,
+		Devices: make([]DeviceState, 0, len(tx.devices)),
+		History: tx.History(),
+	}
+	for _, d := range tx.devices {
+		s.Devices = append(s.Devices, DeviceState{Name: d.name, Limits: d.limits})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
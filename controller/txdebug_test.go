@@ -0,0 +1,65 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_history(t *testing.T) {
+	h := &history{}
+	start := time.Unix(0, 0)
+	for i := 0; i < historySize+10; i++ {
+		h.add(Sample{Time: start.Add(time.Duration(i) * time.Second)})
+	}
+	got := h.list()
+	if len(got) != historySize {
+		t.Fatalf("history.list() wrong length; got %d, want %d", len(got), historySize)
+	}
+	if !got[0].Time.Equal(start.Add(10 * time.Second)) {
+		t.Errorf("history.list() wrong oldest sample; got %v", got[0].Time)
+	}
+	for i := 1; i < len(got); i++ {
+		if !got[i].Time.After(got[i-1].Time) {
+			t.Fatalf("history.list() out of order at %d", i)
+		}
+	}
+}
+
+func TestTxController_ServeHTTP(t *testing.T) {
+	tx := &TxController{
+		period:  100 * time.Millisecond,
+		devices: []*netDevice{{name: "eth0", limits: Limits{Rx: 20}}},
+		limits:  Limits{Tx: 10},
+		low:     Limits{Tx: 5},
+	}
+	tx.rates.set(15, 1)
+	tx.devices[0].rates.set(15, 1)
+	tx.history.add(tx.sample(time.Unix(1, 0), tx.exceeded()))
+
+	rw := httptest.NewRecorder()
+	tx.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/debug/txcontroller", nil))
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("ServeHTTP() wrong code; got %d", rw.Code)
+	}
+	s := State{}
+	if err := json.Unmarshal(rw.Body.Bytes(), &s); err != nil {
+		t.Fatalf("ServeHTTP() returned invalid JSON: %v", err)
+	}
+	if s.Period != "100ms" || s.Limits.Tx != 10 || s.Low.Tx != 5 {
+		t.Errorf("ServeHTTP() wrong configuration; got %#v", s)
+	}
+	if len(s.Devices) != 1 || s.Devices[0].Name != "eth0" || s.Devices[0].Limits.Rx != 20 {
+		t.Errorf("ServeHTTP() wrong devices; got %#v", s.Devices)
+	}
+	if len(s.History) != 1 {
+		t.Fatalf("ServeHTTP() wrong history; got %#v", s.History)
+	}
+	h := s.History[0]
+	if h.Limited != "tx" || h.Rates["all"] != (Rate{Tx: 15, Rx: 1}) || h.Rates["eth0"] != (Rate{Tx: 15, Rx: 1}) {
+		t.Errorf("ServeHTTP() wrong sample; got %#v", h)
+	}
+}
@@ -0,0 +1,85 @@
+package token
+
+import (
+	"strings"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// wildcard is the audience pattern label that matches any one DNS label.
+const wildcard = "*"
+
+// IsAudiencePattern reports whether the audience is a pattern, e.g.
+// "*.mlab-oti.measurement-lab.org".
+func IsAudiencePattern(aud string) bool {
+	return strings.Contains(aud, wildcard)
+}
+
+// ValidAudience reports whether every audience is non-empty, and whether in
+// every pattern each "*" is a whole DNS label and at least one label is not a
+// wildcard.
+func ValidAudience(auds jwt.Audience) bool {
+	for _, aud := range auds {
+		if aud == "" {
+			return false
+		}
+		if !IsAudiencePattern(aud) {
+			continue
+		}
+		literal := false
+		for _, label := range strings.Split(aud, ".") {
+			if label != wildcard && strings.Contains(label, wildcard) {
+				return false
+			}
+			literal = literal || (label != wildcard && label != "")
+		}
+		if !literal {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchAudience reports whether the audience matches the expected audience or
+// pattern. A "*" label in a pattern matches any one non-empty DNS label, so
+// "*.example.org" matches "mlab1.example.org" but not "example.org" or
+// "a.b.example.org".
+func MatchAudience(expected, aud string) bool {
+	if !IsAudiencePattern(expected) {
+		return expected == aud
+	}
+	want := strings.Split(expected, ".")
+	got := strings.Split(aud, ".")
+	if len(want) != len(got) {
+		return false
+	}
+	for i := range want {
+		if got[i] == "" || (want[i] != wildcard && want[i] != got[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasAudiencePattern reports whether any expected audience is a pattern.
+func hasAudiencePattern(expected jwt.Audience) bool {
+	for _, e := range expected {
+		if IsAudiencePattern(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAnyAudience reports whether any claimed audience matches any expected
+// audience or pattern.
+func matchAnyAudience(expected, claimed jwt.Audience) bool {
+	for _, e := range expected {
+		for _, aud := range claimed {
+			if MatchAudience(e, aud) {
+				return true
+			}
+		}
+	}
+	return false
+}
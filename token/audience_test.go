@@ -0,0 +1,96 @@
+package token
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/m-lab/go/rtx"
+)
+
+func TestMatchAudience(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+		aud      string
+		want     bool
+	}{
+		{name: "exact", expected: "mlab1-lga03.mlab-oti.measurement-lab.org", aud: "mlab1-lga03.mlab-oti.measurement-lab.org", want: true},
+		{name: "exact-mismatch", expected: "mlab1-lga03", aud: "mlab2-lga03"},
+		{name: "pattern", expected: "*.mlab-oti.measurement-lab.org", aud: "mlab1-lga03.mlab-oti.measurement-lab.org", want: true},
+		{name: "pattern-inner-label", expected: "mlab1-lga03.*.measurement-lab.org", aud: "mlab1-lga03.mlab-oti.measurement-lab.org", want: true},
+		{name: "pattern-one-label-only", expected: "*.mlab-oti.measurement-lab.org", aud: "a.b.mlab-oti.measurement-lab.org"},
+		{name: "pattern-empty-label", expected: "*.mlab-oti.measurement-lab.org", aud: ".mlab-oti.measurement-lab.org"},
+		{name: "pattern-no-label", expected: "*.mlab-oti.measurement-lab.org", aud: "mlab-oti.measurement-lab.org"},
+		{name: "pattern-wrong-domain", expected: "*.mlab-oti.measurement-lab.org", aud: "mlab1.mlab-oti.example.org"},
+		{name: "pattern-literal-aud", expected: "*.example.org", aud: "*.example.org", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MatchAudience(tt.expected, tt.aud); got != tt.want {
+				t.Errorf("MatchAudience(%q, %q) = %v, want %v", tt.expected, tt.aud, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidAudience(t *testing.T) {
+	tests := []struct {
+		name string
+		auds jwt.Audience
+		want bool
+	}{
+		{name: "aliases", auds: jwt.Audience{"mlab1-lga03", "mlab1-lga03.mlab-oti.measurement-lab.org"}, want: true},
+		{name: "pattern", auds: jwt.Audience{"*.mlab-oti.measurement-lab.org"}, want: true},
+		{name: "empty", auds: jwt.Audience{""}},
+		{name: "partial-label-wildcard", auds: jwt.Audience{"mlab*.measurement-lab.org"}},
+		{name: "only-wildcards", auds: jwt.Audience{"*.*"}},
+		{name: "wildcard", auds: jwt.Audience{"*"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ValidAudience(tt.auds); got != tt.want {
+				t.Errorf("ValidAudience(%q) = %v, want %v", tt.auds, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifier_audiencePatterns(t *testing.T) {
+	priv, pub := newTestKeys(t, "locate-1")
+	s, err := NewSigner(priv)
+	rtx.Must(err, "failed to create signer")
+	v, err := NewVerifier(pub)
+	rtx.Must(err, "failed to create verifier")
+
+	now := time.Date(2019, time.December, 1, 1, 2, 0, 0, time.UTC)
+	exp := jwt.Expected{
+		Issuer:      "locate",
+		AnyAudience: jwt.Audience{"mlab1-lga03", "*.mlab-oti.measurement-lab.org"},
+		Time:        now,
+	}
+	tests := []struct {
+		name string
+		cl   jwt.Claims
+		want Reason
+	}{
+		{name: "success-alias", cl: jwt.Claims{Issuer: "locate", Audience: jwt.Audience{"mlab1-lga03"}}},
+		{name: "success-pattern", cl: jwt.Claims{Issuer: "locate", Audience: jwt.Audience{"mlab1-lga03.mlab-oti.measurement-lab.org"}}},
+		{name: "error-audience", cl: jwt.Claims{Issuer: "locate", Audience: jwt.Audience{"mlab1-lga03.example.org"}}, want: ReasonWrongAudience},
+		{name: "error-issuer", cl: jwt.Claims{Issuer: "other", Audience: jwt.Audience{"mlab1-lga03"}}, want: ReasonWrongIssuer},
+		{
+			name: "error-expired",
+			cl:   jwt.Claims{Issuer: "locate", Audience: jwt.Audience{"mlab1-lga03"}, Expiry: jwt.NewNumericDate(now.Add(-time.Second))},
+			want: ReasonExpired,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tok, err := s.Sign(tt.cl)
+			rtx.Must(err, "failed to sign claims")
+			if _, err := v.Verify(tok, exp); Classify(err) != tt.want {
+				t.Errorf("Verify() error = %v, want reason %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package token
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ErrInvalidConfirmation is returned when a confirmation claim cannot be parsed.
+var ErrInvalidConfirmation = errors.New("invalid confirmation claim")
+
+// ErrConfirmationMismatch is returned when a client address does not match the
+// confirmation claim bound to a token.
+var ErrConfirmationMismatch = errors.New("client address does not match confirmation claim")
+
+// Confirmation is a "cnf" claim (RFC 7800) that binds a token to the network
+// location of the client allowed to present it.
+type Confirmation struct {
+	// IP is a single client IP address (e.g. "192.0.2.1") or a CIDR subnet
+	// (e.g. "2001:db8::/64").
+	IP string `json:"ip,omitempty"`
+}
+
+// ConfirmationClaims holds the optional "cnf" claim. ConfirmationClaims may be
+// passed as an extra claim to Signer.Sign or as an extra destination to
+// Verifier.Verify.
+type ConfirmationClaims struct {
+	Confirmation *Confirmation `json:"cnf,omitempty"`
+}
+
+// Check reports whether ip is permitted by the confirmation. A nil
+// confirmation, or one without an IP, permits every address. An error derived
+// from ErrInvalidConfirmation is returned when the IP field cannot be parsed,
+// and ErrConfirmationMismatch when ip is outside the confirmed address.
+func (c *Confirmation) Check(ip net.IP) error {
+	if c == nil || c.IP == "" {
+		return nil
+	}
+	subnet, err := c.subnet()
+	if err != nil {
+		return err
+	}
+	if ip == nil || !subnet.Contains(ip) {
+		return ErrConfirmationMismatch
+	}
+	return nil
+}
+
+// subnet returns the confirmed address as a network. A single address is
+// treated as a full-length prefix.
+func (c *Confirmation) subnet() (*net.IPNet, error) {
+	if strings.Contains(c.IP, "/") {
+		_, subnet, err := net.ParseCIDR(c.IP)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidConfirmation, c.IP)
+		}
+		return subnet, nil
+	}
+	ip := net.ParseIP(c.IP)
+	if ip == nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidConfirmation, c.IP)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
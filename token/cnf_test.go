@@ -0,0 +1,128 @@
+package token
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+func TestConfirmation_Check(t *testing.T) {
+	tests := []struct {
+		name    string
+		cnf     *Confirmation
+		ip      string
+		wantErr error
+	}{
+		{
+			name: "success-nil-confirmation",
+			cnf:  nil,
+			ip:   "192.0.2.1",
+		},
+		{
+			name: "success-empty-ip",
+			cnf:  &Confirmation{},
+			ip:   "192.0.2.1",
+		},
+		{
+			name: "success-ipv4-address",
+			cnf:  &Confirmation{IP: "192.0.2.1"},
+			ip:   "192.0.2.1",
+		},
+		{
+			name: "success-ipv4-subnet",
+			cnf:  &Confirmation{IP: "192.0.2.0/24"},
+			ip:   "192.0.2.200",
+		},
+		{
+			name: "success-ipv6-subnet",
+			cnf:  &Confirmation{IP: "2001:db8::/64"},
+			ip:   "2001:db8::1234",
+		},
+		{
+			name: "success-ipv4-mapped-client",
+			cnf:  &Confirmation{IP: "192.0.2.1"},
+			ip:   "::ffff:192.0.2.1",
+		},
+		{
+			name:    "error-ipv4-address-mismatch",
+			cnf:     &Confirmation{IP: "192.0.2.1"},
+			ip:      "192.0.2.2",
+			wantErr: ErrConfirmationMismatch,
+		},
+		{
+			name:    "error-ipv6-subnet-mismatch",
+			cnf:     &Confirmation{IP: "2001:db8::/64"},
+			ip:      "2001:db8:0:1::1",
+			wantErr: ErrConfirmationMismatch,
+		},
+		{
+			name:    "error-nil-client",
+			cnf:     &Confirmation{IP: "192.0.2.1"},
+			ip:      "",
+			wantErr: ErrConfirmationMismatch,
+		},
+		{
+			name:    "error-invalid-address",
+			cnf:     &Confirmation{IP: "this-is-not-an-ip"},
+			ip:      "192.0.2.1",
+			wantErr: ErrInvalidConfirmation,
+		},
+		{
+			name:    "error-invalid-subnet",
+			cnf:     &Confirmation{IP: "192.0.2.0/99"},
+			ip:      "192.0.2.1",
+			wantErr: ErrInvalidConfirmation,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cnf.Check(net.ParseIP(tt.ip))
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Confirmation.Check() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSignAndVerifyConfirmation(t *testing.T) {
+	insecurePrivateTestKey := `{"use":"sig","kty":"EC","kid":"112","crv":"P-256","alg":"ES256",` +
+		`"x":"V0NoRfUZ-fPACALnakvKtTyXJ5JtgAWlWm-0NaDWUOE","y":"RDbGu6RVhgJGKCTuya4_IzZhT1GzlEIA5ZkumEZ35Ag",` +
+		`"d":"RXSpuTicBEL5GY-76cGgRXIEOB-q4hJ0vqydEnOztIY"}`
+	insecurePublicTestKey := `{"use":"sig","kty":"EC","kid":"112","crv":"P-256","alg":"ES256",` +
+		`"x":"V0NoRfUZ-fPACALnakvKtTyXJ5JtgAWlWm-0NaDWUOE","y":"RDbGu6RVhgJGKCTuya4_IzZhT1GzlEIA5ZkumEZ35Ag"}`
+
+	s, err := NewSigner([]byte(insecurePrivateTestKey))
+	if err != nil {
+		t.Fatalf("NewSigner failed: %v", err)
+	}
+	v, err := NewVerifier([]byte(insecurePublicTestKey))
+	if err != nil {
+		t.Fatalf("NewVerifier failed: %v", err)
+	}
+	cl := jwt.Claims{
+		Issuer:   "locate",
+		Audience: jwt.Audience{"mlab1.fake0"},
+		Expiry:   jwt.NewNumericDate(time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC)),
+	}
+	tok, err := s.Sign(cl, ConfirmationClaims{Confirmation: &Confirmation{IP: "192.0.2.0/24"}})
+	if err != nil {
+		t.Fatalf("Sign failed: %v", err)
+	}
+	exp := jwt.Expected{
+		Issuer: "locate",
+		Time:   time.Date(2029, time.December, 31, 0, 0, 0, 0, time.UTC),
+	}
+	got := ConfirmationClaims{}
+	if _, err := v.Verify(tok, exp, &got); err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if got.Confirmation == nil || got.Confirmation.IP != "192.0.2.0/24" {
+		t.Fatalf("Verify wrong confirmation; got %#v, want 192.0.2.0/24", got.Confirmation)
+	}
+	if err := got.Confirmation.Check(net.ParseIP("192.0.2.7")); err != nil {
+		t.Errorf("Confirmation.Check() rejected matching client: %v", err)
+	}
+}
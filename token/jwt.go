@@ -5,6 +5,7 @@ package token
 import (
 	"errors"
 	"fmt"
+	"slices"
 
 	"github.com/go-jose/go-jose/v4"
 	"github.com/go-jose/go-jose/v4/jwt"
@@ -28,6 +29,28 @@ var ErrDuplicateKeyID = errors.New("Duplicate KeyID found")
 // Verifier is a JWT verifier. Requires a public JWK.
 type Verifier struct {
 	keys map[string]*jose.JSONWebKey
+
+	// issuers are the issuers bound to each key ID, if any.
+	issuers map[string]*Issuer
+}
+
+// Issuer binds public keys to a token issuer, with the claims expected in the
+// tokens of that issuer.
+type Issuer struct {
+	// Name is the issuer ("iss") of tokens signed by Keys.
+	Name string
+
+	// Keys are the serialized, public JWKs of the issuer.
+	Keys [][]byte
+
+	// Audience are the accepted audiences ("aud") or audience patterns. Tokens
+	// must include at least one. When empty, the audience expected by the
+	// caller is used.
+	Audience jwt.Audience
+
+	// Subjects are the accepted subjects ("sub"). When empty, the subject
+	// expected by the caller is used.
+	Subjects []string
 }
 
 // Signer is a JWT signer. Requires a private JWK.
@@ -78,52 +101,124 @@ func (s *Signer) JWKS() jose.JSONWebKeySet {
 // each must have a distinct "keyid". An error derived from ErrDuplicateKeyID is
 // returned when keys have the same keyid.
 func NewVerifier(keys ...[]byte) (*Verifier, error) {
-	pubKeys := map[string]*jose.JSONWebKey{}
+	k := &Verifier{keys: map[string]*jose.JSONWebKey{}}
+	if _, err := k.addKeys(keys); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// NewIssuerVerifier creates a new Verifier with keys bound to their issuers.
+// A token is only valid when its issuer is the issuer of the key that signed
+// it, and its audience and subject are expected by that issuer. Key IDs must be
+// distinct across all issuers.
+func NewIssuerVerifier(issuers ...Issuer) (*Verifier, error) {
+	k := &Verifier{
+		keys:    map[string]*jose.JSONWebKey{},
+		issuers: map[string]*Issuer{},
+	}
+	names := map[string]bool{}
+	for i := range issuers {
+		iss := &issuers[i]
+		if iss.Name == "" || names[iss.Name] {
+			return nil, fmt.Errorf("issuer name %q must be unique and non-empty", iss.Name)
+		}
+		names[iss.Name] = true
+		if !ValidAudience(iss.Audience) {
+			return nil, fmt.Errorf("issuer %q has an invalid audience %q", iss.Name, iss.Audience)
+		}
+		if len(iss.Keys) == 0 {
+			return nil, fmt.Errorf("issuer %q has no keys", iss.Name)
+		}
+		keyIDs, err := k.addKeys(iss.Keys)
+		if err != nil {
+			return nil, fmt.Errorf("issuer %q: %w", iss.Name, err)
+		}
+		for _, keyID := range keyIDs {
+			k.issuers[keyID] = iss
+		}
+	}
+	return k, nil
+}
+
+// addKeys loads the serialized, public JWKs and returns their key IDs.
+func (k *Verifier) addKeys(keys [][]byte) ([]string, error) {
+	keyIDs := make([]string, 0, len(keys))
 	for i := range keys {
 		pub, err := LoadJSONWebKey(keys[i], true)
 		if err != nil {
 			return nil, err
 		}
-		if _, dupKeyID := pubKeys[pub.KeyID]; dupKeyID {
+		if _, dupKeyID := k.keys[pub.KeyID]; dupKeyID {
 			return nil, fmt.Errorf("%w: %s", ErrDuplicateKeyID, pub.KeyID)
 		}
-		pubKeys[pub.KeyID] = pub
+		k.keys[pub.KeyID] = pub
+		keyIDs = append(keyIDs, pub.KeyID)
 	}
-	return &Verifier{
-		keys: pubKeys,
-	}, nil
+	return keyIDs, nil
 }
 
 // parsedToken parses a signed token string and resolves the signing key.
+// Errors are returned as a *VerifyError.
 func (k *Verifier) parsedToken(token string) (*jwt.JSONWebToken, *jose.JSONWebKey, error) {
 	tok, err := jwt.ParseSigned(token, supportedAlgorithms)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, &VerifyError{Reason: ReasonMalformed, Err: err}
 	}
 	headers := tok.Headers
 	if len(headers) == 0 {
-		return nil, nil, errors.New("no headers found in token")
+		return nil, nil, &VerifyError{Reason: ReasonMalformed, Err: errors.New("no headers found in token")}
 	}
 	// Note: We will not support tokens with multiple signatures/headers.
 	keyID := headers[0].KeyID
 	pub, found := k.keys[keyID]
 	if !found {
-		return nil, nil, fmt.Errorf("%w: %s", ErrKeyIDNotFound, keyID)
+		return nil, nil, &VerifyError{
+			Reason: ReasonUnknownKeyID,
+			KeyID:  keyID,
+			Claims: unverifiedClaims(tok),
+			Err:    fmt.Errorf("%w: %s", ErrKeyIDNotFound, keyID),
+		}
 	}
 	return tok, pub, nil
 }
 
+// unverifiedClaims returns the token claims without authenticating them, or
+// nil when they cannot be parsed.
+func unverifiedClaims(tok *jwt.JSONWebToken) *jwt.Claims {
+	cl := &jwt.Claims{}
+	if err := tok.UnsafeClaimsWithoutVerification(cl); err != nil {
+		return nil
+	}
+	return cl
+}
+
+// claims authenticates the token signature with pub and unmarshals the payload
+// into each dest. Errors are returned as a *VerifyError.
+func claims(tok *jwt.JSONWebToken, pub *jose.JSONWebKey, dest ...any) error {
+	err := tok.Claims(pub, dest...)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, jose.ErrCryptoFailure):
+		return &VerifyError{Reason: ReasonBadSignature, KeyID: pub.KeyID, Claims: unverifiedClaims(tok), Err: err}
+	default:
+		// The signature is valid, but the payload could not be unmarshaled.
+		return &VerifyError{Reason: ReasonMalformed, KeyID: pub.KeyID, Err: err}
+	}
+}
+
 // Claims extracts the standard JWT claims from a signed token. It fails on
 // signature mismatch (or missing/unknown key ID); otherwise it returns the
 // claims as-is. The claim values are not validated against any jwt.Expected,
-// that's the caller's responsibility.
+// that's the caller's responsibility. Errors are returned as a *VerifyError.
 func (k *Verifier) Claims(token string) (*jwt.Claims, error) {
 	tok, pub, err := k.parsedToken(token)
 	if err != nil {
 		return nil, err
 	}
 	cl := &jwt.Claims{}
-	if err := tok.Claims(pub, cl); err != nil {
+	if err := claims(tok, pub, cl); err != nil {
 		return nil, err
 	}
 	return cl, nil
@@ -140,8 +235,20 @@ func (k *Verifier) Claims(token string) (*jwt.Claims, error) {
 // Fields in extraDest are JSON-unmarshaled only; no value-level check is
 // performed on them, that's the caller's responsibility.
 //
+// Expected audiences may include patterns, e.g. "*.example.org"; see
+// MatchAudience.
+//
+// When the signing key is bound to an Issuer (see NewIssuerVerifier), the
+// issuer, and the audience and subject given by the Issuer, replace those of
+// exp.
+//
 // If parsing succeeds but expected-claims validation fails, Verify returns
-// the parsed claims along with the non-nil validation error.
+// the parsed claims along with the non-nil validation error. Errors are
+// returned as a *VerifyError, which may be matched with errors.Is, e.g.
+//
+//	if errors.Is(err, token.ErrExpired) {
+//		// Ask the client for a new token.
+//	}
 func (k *Verifier) Verify(token string, exp jwt.Expected, extraDest ...any) (*jwt.Claims, error) {
 	tok, pub, err := k.parsedToken(token)
 	if err != nil {
@@ -151,13 +258,39 @@ func (k *Verifier) Verify(token string, exp jwt.Expected, extraDest ...any) (*jw
 	dest := make([]any, 0, 1+len(extraDest))
 	dest = append(dest, cl)
 	dest = append(dest, extraDest...)
-	if err := tok.Claims(pub, dest...); err != nil {
+	if err := claims(tok, pub, dest...); err != nil {
 		return nil, err
 	}
+	iss := k.issuers[pub.KeyID]
+	if iss != nil {
+		// The issuer of the signing key replaces the expected claims.
+		exp.Issuer = iss.Name
+		if len(iss.Audience) > 0 {
+			exp.AnyAudience = iss.Audience
+		}
+		if len(iss.Subjects) > 0 {
+			exp.Subject = ""
+		}
+	}
+	// go-jose only matches exact audiences, so audience patterns are matched
+	// after the other claims.
+	var patterns jwt.Audience
+	if hasAudiencePattern(exp.AnyAudience) {
+		patterns, exp.AnyAudience = exp.AnyAudience, nil
+	}
 	// Verify that the expected claims satisfy the signed claims. Default leeway
 	// for Validate() would be 1*time.Minute. This sets it to 0.
 	err = cl.ValidateWithLeeway(exp, 0)
-	return cl, err
+	if err == nil && patterns != nil && !matchAnyAudience(patterns, cl.Audience) {
+		err = jwt.ErrInvalidAudience
+	}
+	if err == nil && iss != nil && len(iss.Subjects) > 0 && !slices.Contains(iss.Subjects, cl.Subject) {
+		err = jwt.ErrInvalidSubject
+	}
+	if err != nil {
+		return cl, &VerifyError{Reason: Classify(err), KeyID: pub.KeyID, Claims: cl, Err: err}
+	}
+	return cl, nil
 }
 
 // LoadJSONWebKey loads and validates the given JWK.
@@ -1,6 +1,11 @@
 package token
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"strings"
 	"testing"
 	"time"
 
@@ -384,3 +389,142 @@ func TestSignerJWKS(t *testing.T) {
 		t.Errorf("Expected algorithm 'ES256', got '%s'", jwks.Keys[0].Algorithm)
 	}
 }
+
+// newTestKeys generates a serialized private and public JWK with the key ID.
+func newTestKeys(t *testing.T, kid string) ([]byte, []byte) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rtx.Must(err, "failed to generate key")
+	jwk := jose.JSONWebKey{Key: priv, KeyID: kid, Algorithm: string(jose.ES256), Use: "sig"}
+	privJSON, err := jwk.MarshalJSON()
+	rtx.Must(err, "failed to marshal private key")
+	pubJSON, err := jwk.Public().MarshalJSON()
+	rtx.Must(err, "failed to marshal public key")
+	return privJSON, pubJSON
+}
+
+func TestNewIssuerVerifier(t *testing.T) {
+	_, locatePub := newTestKeys(t, "locate-1")
+	_, monitorPub := newTestKeys(t, "monitor-1")
+	tests := []struct {
+		name    string
+		issuers []Issuer
+		wantErr error
+	}{
+		{
+			name: "success",
+			issuers: []Issuer{
+				{Name: "locate", Keys: [][]byte{locatePub}},
+				{Name: "monitoring", Keys: [][]byte{monitorPub}},
+			},
+		},
+		{
+			name: "error-duplicate-keyid-across-issuers",
+			issuers: []Issuer{
+				{Name: "locate", Keys: [][]byte{locatePub}},
+				{Name: "monitoring", Keys: [][]byte{locatePub}},
+			},
+			wantErr: ErrDuplicateKeyID,
+		},
+		{
+			name:    "error-empty-name",
+			issuers: []Issuer{{Keys: [][]byte{locatePub}}},
+		},
+		{
+			name: "error-duplicate-name",
+			issuers: []Issuer{
+				{Name: "locate", Keys: [][]byte{locatePub}},
+				{Name: "locate", Keys: [][]byte{monitorPub}},
+			},
+		},
+		{
+			name:    "error-no-keys",
+			issuers: []Issuer{{Name: "locate"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewIssuerVerifier(tt.issuers...)
+			if (err != nil) != strings.HasPrefix(tt.name, "error") {
+				t.Fatalf("NewIssuerVerifier() error = %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("NewIssuerVerifier() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifier_issuers(t *testing.T) {
+	locatePriv, locatePub := newTestKeys(t, "locate-1")
+	monitorPriv, monitorPub := newTestKeys(t, "monitor-1")
+	v, err := NewIssuerVerifier(
+		Issuer{Name: "locate", Keys: [][]byte{locatePub}},
+		Issuer{
+			Name:     "monitoring",
+			Keys:     [][]byte{monitorPub},
+			Audience: jwt.Audience{"monitoring-probe"},
+			Subjects: []string{"monitoring"},
+		},
+	)
+	rtx.Must(err, "failed to create verifier")
+	locate, err := NewSigner(locatePriv)
+	rtx.Must(err, "failed to create signer")
+	monitor, err := NewSigner(monitorPriv)
+	rtx.Must(err, "failed to create signer")
+
+	now := time.Date(2019, time.December, 1, 1, 2, 0, 0, time.UTC)
+	// The expectations of the caller, e.g. the TokenController.
+	exp := jwt.Expected{Issuer: "locate", AnyAudience: jwt.Audience{"mlab1"}, Time: now}
+	expiry := jwt.NewNumericDate(now.Add(time.Minute))
+	tests := []struct {
+		name   string
+		signer *Signer
+		cl     jwt.Claims
+		want   Reason
+	}{
+		{
+			name:   "success-locate",
+			signer: locate,
+			cl:     jwt.Claims{Issuer: "locate", Subject: "ndt", Audience: jwt.Audience{"mlab1"}, Expiry: expiry},
+		},
+		{
+			name:   "success-monitoring",
+			signer: monitor,
+			cl:     jwt.Claims{Issuer: "monitoring", Subject: "monitoring", Audience: jwt.Audience{"monitoring-probe"}, Expiry: expiry},
+		},
+		{
+			name:   "error-monitoring-claims-locate-issuer",
+			signer: monitor,
+			cl:     jwt.Claims{Issuer: "locate", Subject: "monitoring", Audience: jwt.Audience{"monitoring-probe"}, Expiry: expiry},
+			want:   ReasonWrongIssuer,
+		},
+		{
+			name:   "error-locate-claims-monitoring-issuer",
+			signer: locate,
+			cl:     jwt.Claims{Issuer: "monitoring", Subject: "monitoring", Audience: jwt.Audience{"mlab1"}, Expiry: expiry},
+			want:   ReasonWrongIssuer,
+		},
+		{
+			name:   "error-monitoring-wrong-audience",
+			signer: monitor,
+			cl:     jwt.Claims{Issuer: "monitoring", Subject: "monitoring", Audience: jwt.Audience{"mlab1"}, Expiry: expiry},
+			want:   ReasonWrongAudience,
+		},
+		{
+			name:   "error-monitoring-wrong-subject",
+			signer: monitor,
+			cl:     jwt.Claims{Issuer: "monitoring", Subject: "ndt", Audience: jwt.Audience{"monitoring-probe"}, Expiry: expiry},
+			want:   ReasonWrongSubject,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tok, err := tt.signer.Sign(tt.cl)
+			rtx.Must(err, "failed to sign claims")
+			_, err = v.Verify(tok, exp)
+			if got := Classify(err); got != tt.want {
+				t.Errorf("Verify() error = %v, want reason %q", err, tt.want)
+			}
+		})
+	}
+}
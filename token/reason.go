@@ -0,0 +1,158 @@
+package token
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// Errors matching a VerifyError of each Reason with errors.Is.
+var (
+	// ErrBadSignature is returned when the token signature does not match the
+	// signing key.
+	ErrBadSignature = errors.New("bad token signature")
+
+	// ErrExpired is returned when the token is expired.
+	ErrExpired = errors.New("token is expired")
+
+	// ErrNotValidYet is returned when the token is used before it is valid.
+	ErrNotValidYet = errors.New("token is not valid yet")
+
+	// ErrWrongAudience is returned when the token audience is not expected.
+	ErrWrongAudience = errors.New("wrong token audience")
+
+	// ErrWrongIssuer is returned when the token issuer is not expected.
+	ErrWrongIssuer = errors.New("wrong token issuer")
+
+	// ErrWrongSubject is returned when the token subject is not expected.
+	ErrWrongSubject = errors.New("wrong token subject")
+
+	// ErrMalformedToken is returned when a token cannot be parsed.
+	ErrMalformedToken = errors.New("malformed token")
+
+	// ErrRevoked may be returned by verifiers that support revocation when a
+	// token was revoked.
+	ErrRevoked = errors.New("token is revoked")
+
+	// ErrInvalidToken is returned for all other invalid tokens.
+	ErrInvalidToken = errors.New("invalid token")
+)
+
+// Reason classifies why a token was rejected. Reasons form a small, fixed set,
+// so unlike error messages or token claims they are safe to use as metric
+// labels.
+type Reason string
+
+// Reasons returned by Classify.
+const (
+	ReasonBadSignature  Reason = "bad-signature"
+	ReasonUnknownKeyID  Reason = "unknown-kid"
+	ReasonExpired       Reason = "expired"
+	ReasonNotValidYet   Reason = "not-yet-valid"
+	ReasonWrongAudience Reason = "wrong-audience"
+	ReasonWrongIssuer   Reason = "wrong-issuer"
+	ReasonWrongSubject  Reason = "wrong-subject"
+	ReasonMalformed     Reason = "malformed"
+	ReasonRevoked       Reason = "revoked"
+	// ReasonInvalid is used for all other errors.
+	ReasonInvalid Reason = "invalid"
+)
+
+// reasonErrors are the errors matching a VerifyError of each reason.
+var reasonErrors = map[Reason]error{
+	ReasonBadSignature:  ErrBadSignature,
+	ReasonUnknownKeyID:  ErrKeyIDNotFound,
+	ReasonExpired:       ErrExpired,
+	ReasonNotValidYet:   ErrNotValidYet,
+	ReasonWrongAudience: ErrWrongAudience,
+	ReasonWrongIssuer:   ErrWrongIssuer,
+	ReasonWrongSubject:  ErrWrongSubject,
+	ReasonMalformed:     ErrMalformedToken,
+	ReasonRevoked:       ErrRevoked,
+	ReasonInvalid:       ErrInvalidToken,
+}
+
+// reasons maps the errors of other verifiers and of go-jose to their reason,
+// in the order they are checked.
+var reasons = []struct {
+	err    error
+	reason Reason
+}{
+	{ErrBadSignature, ReasonBadSignature},
+	{jose.ErrCryptoFailure, ReasonBadSignature},
+	{ErrKeyIDNotFound, ReasonUnknownKeyID},
+	{ErrRevoked, ReasonRevoked},
+	{ErrExpired, ReasonExpired},
+	{jwt.ErrExpired, ReasonExpired},
+	{ErrNotValidYet, ReasonNotValidYet},
+	{jwt.ErrNotValidYet, ReasonNotValidYet},
+	{jwt.ErrIssuedInTheFuture, ReasonNotValidYet},
+	{ErrWrongAudience, ReasonWrongAudience},
+	{jwt.ErrInvalidAudience, ReasonWrongAudience},
+	{ErrWrongIssuer, ReasonWrongIssuer},
+	{jwt.ErrInvalidIssuer, ReasonWrongIssuer},
+	{ErrWrongSubject, ReasonWrongSubject},
+	{jwt.ErrInvalidSubject, ReasonWrongSubject},
+	{ErrMalformedToken, ReasonMalformed},
+	{jwt.ErrInvalidClaims, ReasonMalformed},
+	{jwt.ErrInvalidContentType, ReasonMalformed},
+	{jwt.ErrUnmarshalAudience, ReasonMalformed},
+	{jwt.ErrUnmarshalNumericDate, ReasonMalformed},
+}
+
+// VerifyError is returned by Verifier when a token is rejected. errors.Is
+// matches a VerifyError to the error of its Reason (e.g. ErrExpired), and to
+// the underlying cause, e.g. jwt.ErrExpired from go-jose.
+type VerifyError struct {
+	// Reason classifies the error.
+	Reason Reason
+
+	// KeyID is the key ID from the token header, or "" when the token is
+	// malformed.
+	KeyID string
+
+	// Claims are the parsed token claims, or nil when they could not be parsed.
+	// Claims are only authenticated by the token signature when the Reason is a
+	// claim validation failure (expired, not-yet-valid, or wrong-*). Otherwise,
+	// they are unverified and may be chosen by anyone; use them only for
+	// diagnostics.
+	Claims *jwt.Claims
+
+	// Err is the underlying cause.
+	Err error
+}
+
+// Error returns the reason and the underlying cause.
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Reason, e.Err)
+}
+
+// Unwrap returns the underlying cause.
+func (e *VerifyError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the error of the Reason.
+func (e *VerifyError) Is(target error) bool {
+	return target == reasonErrors[e.Reason]
+}
+
+// Classify returns the reason for a token verification error, or "" when err
+// is nil. Errors that are not recognized are classified as ReasonInvalid.
+func Classify(err error) Reason {
+	if err == nil {
+		return ""
+	}
+	var ve *VerifyError
+	if errors.As(err, &ve) {
+		return ve.Reason
+	}
+	for _, r := range reasons {
+		if errors.Is(err, r.err) {
+			return r.reason
+		}
+	}
+	return ReasonInvalid
+}
@@ -0,0 +1,154 @@
+package token
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/m-lab/go/rtx"
+)
+
+func TestClassify(t *testing.T) {
+	insecurePrivateTestKey := `{"use":"sig","kty":"EC","kid":"112","crv":"P-256","alg":"ES256",` +
+		`"x":"V0NoRfUZ-fPACALnakvKtTyXJ5JtgAWlWm-0NaDWUOE","y":"RDbGu6RVhgJGKCTuya4_IzZhT1GzlEIA5ZkumEZ35Ag",` +
+		`"d":"RXSpuTicBEL5GY-76cGgRXIEOB-q4hJ0vqydEnOztIY"}`
+	insecurePublicTestKey := `{"use":"sig","kty":"EC","kid":"112","crv":"P-256","alg":"ES256",` +
+		`"x":"V0NoRfUZ-fPACALnakvKtTyXJ5JtgAWlWm-0NaDWUOE","y":"RDbGu6RVhgJGKCTuya4_IzZhT1GzlEIA5ZkumEZ35Ag"}`
+	otherPublicTestKey := `{"use":"sig","kty":"EC","kid":"113","crv":"P-256","alg":"ES256",` +
+		`"x":"V0NoRfUZ-fPACALnakvKtTyXJ5JtgAWlWm-0NaDWUOE","y":"RDbGu6RVhgJGKCTuya4_IzZhT1GzlEIA5ZkumEZ35Ag"}`
+
+	now := time.Date(2019, time.December, 1, 1, 2, 0, 0, time.UTC)
+	valid := jwt.Claims{
+		Issuer:    "locate",
+		Subject:   "ndt",
+		Audience:  jwt.Audience{"mlab1"},
+		Expiry:    jwt.NewNumericDate(now.Add(time.Minute)),
+		NotBefore: jwt.NewNumericDate(now.Add(-time.Minute)),
+	}
+	exp := jwt.Expected{Issuer: "locate", Subject: "ndt", AnyAudience: jwt.Audience{"mlab1"}, Time: now}
+
+	s, err := NewSigner([]byte(insecurePrivateTestKey))
+	rtx.Must(err, "failed to create signer")
+	sign := func(change func(cl *jwt.Claims)) string {
+		cl := valid
+		change(&cl)
+		tok, err := s.Sign(cl)
+		rtx.Must(err, "failed to sign claims")
+		return tok
+	}
+	ok := sign(func(cl *jwt.Claims) {})
+	other := sign(func(cl *jwt.Claims) { cl.Subject = "other" })
+	// A token with the signature of different claims.
+	badSignature := ok[:strings.LastIndex(ok, ".")] + other[strings.LastIndex(other, "."):]
+
+	tests := []struct {
+		name   string
+		key    string
+		token  string
+		want   Reason
+		is     error
+		kid    string
+		claims bool
+	}{
+		{name: "success", key: insecurePublicTestKey, token: ok, want: ""},
+		{name: "bad-signature", key: insecurePublicTestKey, token: badSignature, want: ReasonBadSignature, is: ErrBadSignature, kid: "112", claims: true},
+		{name: "unknown-kid", key: otherPublicTestKey, token: ok, want: ReasonUnknownKeyID, is: ErrKeyIDNotFound, kid: "112", claims: true},
+		{
+			name:   "expired",
+			key:    insecurePublicTestKey,
+			token:  sign(func(cl *jwt.Claims) { cl.Expiry = jwt.NewNumericDate(now.Add(-time.Second)) }),
+			want:   ReasonExpired,
+			is:     ErrExpired,
+			kid:    "112",
+			claims: true,
+		},
+		{
+			name:   "not-yet-valid",
+			key:    insecurePublicTestKey,
+			token:  sign(func(cl *jwt.Claims) { cl.NotBefore = jwt.NewNumericDate(now.Add(time.Second)) }),
+			want:   ReasonNotValidYet,
+			is:     ErrNotValidYet,
+			kid:    "112",
+			claims: true,
+		},
+		{
+			name:   "wrong-audience",
+			key:    insecurePublicTestKey,
+			token:  sign(func(cl *jwt.Claims) { cl.Audience = jwt.Audience{"mlab2"} }),
+			want:   ReasonWrongAudience,
+			is:     ErrWrongAudience,
+			kid:    "112",
+			claims: true,
+		},
+		{
+			name:   "wrong-issuer",
+			key:    insecurePublicTestKey,
+			token:  sign(func(cl *jwt.Claims) { cl.Issuer = "attacker-chosen-issuer" }),
+			want:   ReasonWrongIssuer,
+			is:     ErrWrongIssuer,
+			kid:    "112",
+			claims: true,
+		},
+		{name: "wrong-subject", key: insecurePublicTestKey, token: other, want: ReasonWrongSubject, is: ErrWrongSubject, kid: "112", claims: true},
+		{name: "malformed", key: insecurePublicTestKey, token: "a.b.c", want: ReasonMalformed, is: ErrMalformedToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := NewVerifier([]byte(tt.key))
+			rtx.Must(err, "failed to create verifier")
+			_, err = v.Verify(tt.token, exp)
+			if got := Classify(err); got != tt.want {
+				t.Errorf("Classify(%v) = %q, want %q", err, got, tt.want)
+			}
+			if err == nil {
+				return
+			}
+			if !errors.Is(err, tt.is) {
+				t.Errorf("Verify() error %v is not %v", err, tt.is)
+			}
+			var ve *VerifyError
+			if !errors.As(err, &ve) {
+				t.Fatalf("Verify() error %T is not a *VerifyError", err)
+			}
+			if ve.KeyID != tt.kid || (ve.Claims != nil) != tt.claims {
+				t.Errorf("Verify() wrong VerifyError; got kid %q, claims %v", ve.KeyID, ve.Claims)
+			}
+			if tt.claims && ve.Claims.Issuer == "" {
+				t.Errorf("Verify() VerifyError missing claims; got %#v", ve.Claims)
+			}
+		})
+	}
+}
+
+func TestVerifyError_cause(t *testing.T) {
+	err := error(&VerifyError{Reason: ReasonExpired, Err: jwt.ErrExpired})
+	if !errors.Is(err, ErrExpired) || !errors.Is(err, jwt.ErrExpired) {
+		t.Errorf("VerifyError does not match its reason and cause")
+	}
+	if errors.Is(err, ErrWrongIssuer) {
+		t.Errorf("VerifyError matches another reason")
+	}
+}
+
+func TestClassify_errors(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want Reason
+	}{
+		{name: "nil", err: nil, want: ""},
+		{name: "revoked", err: fmt.Errorf("jti 123: %w", ErrRevoked), want: ReasonRevoked},
+		{name: "invalid", err: errors.New("some other error"), want: ReasonInvalid},
+		{name: "malformed-audience", err: jwt.ErrUnmarshalAudience, want: ReasonMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Classify(tt.err); got != tt.want {
+				t.Errorf("Classify(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}